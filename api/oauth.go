@@ -0,0 +1,279 @@
+package api
+
+import (
+	"errors"
+	"github.com/nieben/auth-service-sample/model"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// OAuth 2.0, RFC 6749 and RFC 7636(pkce)
+const (
+	OAuthInvalidRequest          = "invalid_request"
+	OAuthInvalidClient           = "invalid_client"
+	OAuthInvalidGrant            = "invalid_grant"
+	OAuthInvalidScope            = "invalid_scope"
+	OAuthUnauthorizedClient      = "unauthorized_client"
+	OAuthUnsupportedGrantType    = "unsupported_grant_type"
+	OAuthUnsupportedResponseType = "unsupported_response_type"
+	OAuthAccessDenied            = "access_denied"
+	OAuthServerError             = "server_error"
+	OAuthInvalidToken            = "invalid_token"         // RFC 6750
+	OAuthInsufficientScope       = "insufficient_scope"    // RFC 6750
+	OAuthAuthorizationPending    = "authorization_pending" // RFC 8628
+	OAuthSlowDown                = "slow_down"             // RFC 8628
+	OAuthExpiredToken            = "expired_token"         // RFC 8628
+
+	OAuthNonceMaxLength = 256
+
+	OAuthAccessToken  = "access_token"  // token_type_hint, RFC 7009
+	OAuthRefreshToken = "refresh_token" // token_type_hint, RFC 7009
+)
+
+var (
+	OAuthClientAuthErr   = errors.New("client authentication failed")
+	OAuthResponseTypeErr = errors.New("response_type only in code")
+	OAuthPKCEErr         = errors.New("code_challenge required for public clients, code_challenge_method only in S256")
+	OAuthGrantErr        = errors.New("grant not allowed for the client")
+	OAuthParamErr        = errors.New("missing or invalid parameter")
+	OAuthNonceErr        = errors.New("nonce len <= 256")
+	OAuthTokenOwnerErr   = errors.New("token was not issued to the client")
+	OIDCScopeErr         = errors.New("openid scope required")
+)
+
+type CreateClient struct {
+	Name         string   `json:"name" binding:"required"`
+	RedirectURIs []string `json:"redirectUris"`
+	Grants       []string `json:"grants"` // default authorization_code, refresh_token
+	Scopes       []string `json:"scopes"`
+	Public       bool     `json:"public"` // no secret, pkce only
+}
+
+func (in *CreateClient) Check() error {
+	in.Name = strings.TrimSpace(in.Name)
+	if len(in.Name) == 0 || len(in.Name) > model.ClientNameMaxLength {
+		return model.ClientNameErr
+	}
+	if len(in.Grants) == 0 {
+		in.Grants = []string{model.GrantAuthorizationCode, model.GrantRefreshToken}
+	}
+	for _, g := range in.Grants {
+		known := false
+		for _, grant := range model.Grants {
+			known = known || g == grant
+		}
+		if !known {
+			return model.ClientGrantErr
+		}
+		if in.Public && g == model.GrantClientCredentials {
+			return model.ClientPublicErr
+		}
+	}
+	if len(in.RedirectURIs) > model.ClientMaxRedirects {
+		return model.ClientRedirectErr
+	}
+	for _, uri := range in.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || len(u.Fragment) > 0 || strings.Contains(uri, "#") {
+			return model.ClientRedirectErr
+		}
+	}
+	for _, g := range in.Grants {
+		if g == model.GrantAuthorizationCode && len(in.RedirectURIs) == 0 {
+			return model.ClientRedirectErr
+		}
+	}
+
+	return CheckScopes(in.Scopes)
+}
+
+type DeleteClient struct {
+	ClientID string `json:"clientId" binding:"required"`
+}
+
+func (in *DeleteClient) Check() error {
+	in.ClientID = strings.TrimSpace(in.ClientID)
+	if len(in.ClientID) != model.ClientIDLength {
+		return model.ClientNotExistErr
+	}
+
+	return nil
+}
+
+// SetClientSessionPolicy sets the idle timeout and max age of the client's tokens, both 0 restores the default.
+type SetClientSessionPolicy struct {
+	ClientID    string `json:"clientId" binding:"required"`
+	IdleTimeout int64  `json:"idleTimeout"`
+	MaxAge      int64  `json:"maxAge"`
+}
+
+func (in *SetClientSessionPolicy) Check() error {
+	in.ClientID = strings.TrimSpace(in.ClientID)
+	if len(in.ClientID) != model.ClientIDLength {
+		return model.ClientNotExistErr
+	}
+
+	if p := in.Policy(); p != nil {
+		return p.Check()
+	}
+
+	return nil
+}
+
+func (in *SetClientSessionPolicy) Policy() *model.SessionPolicy {
+	return sessionPolicy(in.IdleTimeout, in.MaxAge)
+}
+
+// OAuthAuthorize is bound from query on GET and from form on POST with the login fields.
+type OAuthAuthorize struct {
+	ResponseType        string `form:"response_type"`
+	ClientID            string `form:"client_id"`
+	RedirectURI         string `form:"redirect_uri"`
+	Scope               string `form:"scope"`
+	State               string `form:"state"`
+	CodeChallenge       string `form:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method"`
+	Nonce               string `form:"nonce"` // openid connect
+
+	Username string `form:"username"`
+	Password string `form:"password"`
+	Code     string `form:"code"` // totp or recovery code, when mfa is enabled
+
+	Action    string `form:"action"`     // consent: approve or deny
+	CSRFToken string `form:"csrf_token"` // consent, of the browser session
+
+	Scopes []string `form:"-"`
+}
+
+// CheckClient validates the client and redirect uri, errors are shown to the user, not redirected.
+func (in *OAuthAuthorize) CheckClient() (*model.Client, error) {
+	client := model.GetClient(in.ClientID)
+	if client == nil {
+		return nil, model.ClientNotExistErr
+	}
+	if len(in.RedirectURI) == 0 && len(client.RedirectURIs) == 1 {
+		in.RedirectURI = client.RedirectURIs[0]
+	}
+	if !client.AllowRedirect(in.RedirectURI) {
+		return nil, model.ClientRedirectErr
+	}
+
+	return client, nil
+}
+
+// Check returns an oauth error code, errors are redirected to the client.
+func (in *OAuthAuthorize) Check(client *model.Client) (string, error) {
+	if in.ResponseType != "code" {
+		return OAuthUnsupportedResponseType, OAuthResponseTypeErr
+	}
+	if !client.AllowGrant(model.GrantAuthorizationCode) {
+		return OAuthUnauthorizedClient, OAuthGrantErr
+	}
+	// pkce is required for public clients, confidential clients authenticate at the token endpoint
+	if client.Public || len(in.CodeChallenge) > 0 || len(in.CodeChallengeMethod) > 0 {
+		if in.CodeChallengeMethod != model.PKCEMethodS256 || !regexp.MustCompile(model.PKCEChallengeRegex).MatchString(in.CodeChallenge) {
+			return OAuthInvalidRequest, OAuthPKCEErr
+		}
+	}
+	if len(in.Nonce) > OAuthNonceMaxLength {
+		return OAuthInvalidRequest, OAuthNonceErr
+	}
+	in.Scopes = strings.Fields(in.Scope)
+	if err := CheckScopes(in.Scopes); err != nil {
+		return OAuthInvalidScope, err
+	}
+	scopes, err := client.GrantScopes(in.Scopes)
+	if err != nil {
+		return OAuthInvalidScope, err
+	}
+	in.Scopes = scopes
+
+	return "", nil
+}
+
+// OAuthTokenRequest is bound from form, client credentials are in basic auth or the form.
+type OAuthTokenRequest struct {
+	GrantType    string `form:"grant_type"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	CodeVerifier string `form:"code_verifier"`
+	RefreshToken string `form:"refresh_token"`
+	DeviceCode   string `form:"device_code"`
+	Scope        string `form:"scope"`
+	ClientID     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+
+	Scopes []string `form:"-"`
+}
+
+func (in *OAuthTokenRequest) Check() error {
+	in.Scopes = strings.Fields(in.Scope)
+	switch in.GrantType {
+	case model.GrantAuthorizationCode:
+		if len(in.Code) == 0 || len(in.CodeVerifier) > 0 && !regexp.MustCompile(model.PKCEVerifierRegex).MatchString(in.CodeVerifier) {
+			return OAuthParamErr
+		}
+	case model.GrantRefreshToken:
+		if len(in.RefreshToken) == 0 {
+			return OAuthParamErr
+		}
+	case model.GrantDeviceCode:
+		if len(in.DeviceCode) == 0 {
+			return OAuthParamErr
+		}
+	}
+
+	return CheckScopes(in.Scopes)
+}
+
+// OAuthDeviceAuthorization is bound from form, RFC 8628 3.1.
+type OAuthDeviceAuthorization struct {
+	Scope        string `form:"scope"`
+	ClientID     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+
+	Scopes []string `form:"-"`
+}
+
+func (in *OAuthDeviceAuthorization) Check() error {
+	in.Scopes = strings.Fields(in.Scope)
+
+	return CheckScopes(in.Scopes)
+}
+
+// OAuthDevice is the verification page, bound from query on GET and from form on POST.
+type OAuthDevice struct {
+	UserCode string `form:"user_code"`
+	Username string `form:"username"`
+	Password string `form:"password"`
+	Code     string `form:"code"`   // totp or recovery code, when mfa is enabled
+	Action   string `form:"action"` // approve, deny
+}
+
+// OAuthTokenHint is bound from form by /oauth/introspect(RFC 7662) and /oauth/revoke(RFC 7009).
+type OAuthTokenHint struct {
+	Token         string `form:"token"`
+	TokenTypeHint string `form:"token_type_hint"` // access_token, refresh_token
+	ClientID      string `form:"client_id"`
+	ClientSecret  string `form:"client_secret"`
+}
+
+func (in *OAuthTokenHint) Check() error {
+	if len(in.Token) == 0 {
+		return OAuthParamErr
+	}
+
+	return nil
+}
+
+func CheckScopes(scopes []string) error {
+	scopeReg := regexp.MustCompile(model.ScopeRegex)
+	for _, s := range scopes {
+		if !scopeReg.MatchString(s) {
+			return model.ScopeErr
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"errors"
+	"github.com/nieben/auth-service-sample/model"
+	"regexp"
+	"strings"
+)
+
+const (
+	PageDefaultReturnTo = "/account"
+
+	ConsolePath = "/admin/console"
+)
+
+var (
+	PageFormErr       = errors.New("the form has expired, please try again")
+	PageSessionErr    = errors.New("browser sessions are disabled")
+	PasswordRepeatErr = errors.New("the passwords do not match")
+	ConsoleAdminErr   = errors.New("the console is for admins only")
+	ConsoleActionErr  = errors.New("unknown action")
+)
+
+// PageLogin is posted by the hosted login page.
+type PageLogin struct {
+	Username  string `form:"username"`
+	Password  string `form:"password"`
+	ReturnTo  string `form:"return_to"` // a path of the service
+	CSRFToken string `form:"csrf_token"`
+}
+
+func (in *PageLogin) Check() error {
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	in.ReturnTo = ReturnTo(in.ReturnTo)
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	if !nameReg.MatchString(in.Username) {
+		return model.UserCheckErr
+	}
+
+	return nil
+}
+
+// PageMFA is posted by the mfa prompt after the password.
+type PageMFA struct {
+	MFAToken  string `form:"mfa_token"`
+	Code      string `form:"code"` // totp or recovery code
+	ReturnTo  string `form:"return_to"`
+	CSRFToken string `form:"csrf_token"`
+}
+
+func (in *PageMFA) Check() error {
+	in.Code = strings.ToLower(strings.TrimSpace(in.Code))
+	in.ReturnTo = ReturnTo(in.ReturnTo)
+	if len(in.MFAToken) != model.MFAChallengeLength {
+		return model.MFAChallengeErr
+	}
+
+	return nil
+}
+
+// PageForgot requests a password reset mail.
+type PageForgot struct {
+	Username  string `form:"username"`
+	CSRFToken string `form:"csrf_token"`
+}
+
+func (in *PageForgot) Check() error {
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	if !nameReg.MatchString(in.Username) {
+		return model.UserNameErr
+	}
+
+	return nil
+}
+
+// PageReset sets the password with the link of the reset mail.
+type PageReset struct {
+	Token     string `form:"token"`
+	Password  string `form:"password"`
+	Confirm   string `form:"confirm"`
+	CSRFToken string `form:"csrf_token"`
+}
+
+func (in *PageReset) Check() error {
+	pwdReg := regexp.MustCompile(model.PwdRegex)
+	if !pwdReg.MatchString(in.Password) {
+		return model.UserPwdErr
+	}
+	if in.Password != in.Confirm {
+		return PasswordRepeatErr
+	}
+
+	return nil
+}
+
+// ConsoleRole grants or revokes a role of the user in the console.
+type ConsoleRole struct {
+	Role      string `form:"role"`
+	Action    string `form:"action"` // add, revoke
+	CSRFToken string `form:"csrf_token"`
+}
+
+func (in *ConsoleRole) Check() error {
+	in.Role = strings.ToLower(strings.TrimSpace(in.Role))
+	if in.Action != "add" && in.Action != "revoke" {
+		return ConsoleActionErr
+	}
+	roleReg := regexp.MustCompile(model.RoleRegex)
+	if !roleReg.MatchString(in.Role) {
+		return model.RoleNameErr
+	}
+
+	return nil
+}
+
+// ConsoleStatus disables or enables the user in the console.
+type ConsoleStatus struct {
+	Action    string `form:"action"` // disable, enable
+	CSRFToken string `form:"csrf_token"`
+}
+
+func (in *ConsoleStatus) Check() error {
+	if in.Action != "disable" && in.Action != "enable" {
+		return ConsoleActionErr
+	}
+
+	return nil
+}
+
+// ConsoleSessions ends one session of the user, by its id, or all of them in the console.
+type ConsoleSessions struct {
+	Session   string `form:"session"`
+	Action    string `form:"action"` // revoke, revokeAll
+	CSRFToken string `form:"csrf_token"`
+}
+
+func (in *ConsoleSessions) Check() error {
+	if in.Action != "revoke" && in.Action != "revokeAll" {
+		return ConsoleActionErr
+	}
+	if in.Action == "revoke" && len(in.Session) == 0 {
+		return model.TokenNotExistErr
+	}
+
+	return nil
+}
+
+// ReturnTo keeps local paths only, others would redirect off the service after login.
+func ReturnTo(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.ContainsAny(path, "\\\r\n") {
+		return PageDefaultReturnTo
+	}
+
+	return path
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"encoding/base64"
+	"errors"
 	"github.com/nieben/auth-service-sample/model"
 	"regexp"
 	"strings"
@@ -9,6 +11,7 @@ import (
 type CreateUser struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	Email    string `json:"email"` // verification mail is sent when set
 }
 
 func (in *CreateUser) Check() error {
@@ -21,6 +24,11 @@ func (in *CreateUser) Check() error {
 	if !pwdReg.MatchString(in.Password) {
 		return model.UserPwdErr
 	}
+	in.Email = strings.ToLower(strings.TrimSpace(in.Email))
+	emailReg := regexp.MustCompile(model.EmailRegex)
+	if len(in.Email) > 0 && !emailReg.MatchString(in.Email) {
+		return model.ProfileEmailErr
+	}
 
 	return nil
 }
@@ -39,8 +47,38 @@ func (in *DeleteUser) Check() error {
 	return nil
 }
 
+type DisableUser struct {
+	Username string `json:"username" binding:"required"`
+}
+
+func (in *DisableUser) Check() error {
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	if !nameReg.MatchString(in.Username) {
+		return model.UserNameErr
+	}
+
+	return nil
+}
+
+type EnableUser struct {
+	Username string `json:"username" binding:"required"`
+}
+
+func (in *EnableUser) Check() error {
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	if !nameReg.MatchString(in.Username) {
+		return model.UserNameErr
+	}
+
+	return nil
+}
+
 type CreateRole struct {
-	Role string `json:"role" binding:"required"`
+	Role        string            `json:"role" binding:"required"`
+	Description string            `json:"description"`
+	Metadata    map[string]string `json:"metadata"`
 }
 
 func (in *CreateRole) Check() error {
@@ -49,8 +87,12 @@ func (in *CreateRole) Check() error {
 	if !roleReg.MatchString(in.Role) {
 		return model.RoleNameErr
 	}
+	in.Description = strings.TrimSpace(in.Description)
+	if len(in.Description) > model.RoleDescriptionMaxLength {
+		return model.RoleDescriptionErr
+	}
 
-	return nil
+	return model.CheckRoleMetadata(in.Metadata)
 }
 
 type DeleteRole struct {
@@ -67,6 +109,68 @@ func (in *DeleteRole) Check() error {
 	return nil
 }
 
+// UpdateRole renames the role or changes its description, omitted fields are kept.
+type UpdateRole struct {
+	Role        string  `json:"role" binding:"required"`
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
+
+func (in *UpdateRole) Check() error {
+	in.Role = strings.ToLower(strings.TrimSpace(in.Role))
+	roleReg := regexp.MustCompile(model.RoleRegex)
+	if !roleReg.MatchString(in.Role) {
+		return model.RoleNameErr
+	}
+	if in.Name != nil {
+		*in.Name = strings.ToLower(strings.TrimSpace(*in.Name))
+		if !roleReg.MatchString(*in.Name) {
+			return model.RoleNameErr
+		}
+	}
+	if in.Description != nil {
+		*in.Description = strings.TrimSpace(*in.Description)
+		if len(*in.Description) > model.RoleDescriptionMaxLength {
+			return model.RoleDescriptionErr
+		}
+	}
+
+	return nil
+}
+
+// SetRoleSessionPolicy sets the idle timeout and max age of tokens with the role, both 0 restores the default.
+type SetRoleSessionPolicy struct {
+	Role        string `json:"role" binding:"required"`
+	IdleTimeout int64  `json:"idleTimeout"`
+	MaxAge      int64  `json:"maxAge"`
+}
+
+func (in *SetRoleSessionPolicy) Check() error {
+	in.Role = strings.ToLower(strings.TrimSpace(in.Role))
+	roleReg := regexp.MustCompile(model.RoleRegex)
+	if !roleReg.MatchString(in.Role) {
+		return model.RoleNameErr
+	}
+
+	if p := in.Policy(); p != nil {
+		return p.Check()
+	}
+
+	return nil
+}
+
+func (in *SetRoleSessionPolicy) Policy() *model.SessionPolicy {
+	return sessionPolicy(in.IdleTimeout, in.MaxAge)
+}
+
+func sessionPolicy(idleTimeout, maxAge int64) *model.SessionPolicy {
+	if idleTimeout == 0 && maxAge == 0 {
+		return nil
+	}
+
+	return &model.SessionPolicy{IdleTimeout: idleTimeout, MaxAge: maxAge}
+}
+
 type AddUserRole struct {
 	Username string `json:"username" binding:"required"`
 	Role     string `json:"role" binding:"required"`
@@ -102,8 +206,9 @@ func (in *CheckRole) Check() error {
 }
 
 type Token struct {
-	Username string `json:"username" binding:"required"`
-	Password string `json:"password" binding:"required"`
+	Username string   `json:"username" binding:"required"`
+	Password string   `json:"password" binding:"required"`
+	Scopes   []string `json:"scopes"` // optional, role:<name> restricts the token to the roles
 }
 
 func (in *Token) Check() error {
@@ -117,5 +222,477 @@ func (in *Token) Check() error {
 		return model.UserPwdErr
 	}
 
+	return CheckScopes(in.Scopes)
+}
+
+type VerifyMFA struct {
+	Code string `json:"code" binding:"required"`
+}
+
+func (in *VerifyMFA) Check() error {
+	in.Code = strings.TrimSpace(in.Code)
+	codeReg := regexp.MustCompile(model.MFACodeRegex)
+	if !codeReg.MatchString(in.Code) {
+		return model.MFACodeErr
+	}
+
+	return nil
+}
+
+type ResetMFA struct {
+	Username string `json:"username" binding:"required"`
+}
+
+func (in *ResetMFA) Check() error {
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	if !nameReg.MatchString(in.Username) {
+		return model.UserNameErr
+	}
+
+	return nil
+}
+
+// MFAToken takes either a totp code or a recovery code.
+type MFAToken struct {
+	MFAToken     string `json:"mfaToken" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+func (in *MFAToken) Check() error {
+	in.MFAToken = strings.TrimSpace(in.MFAToken)
+	if len(in.MFAToken) != model.MFAChallengeLength {
+		return model.MFAChallengeErr
+	}
+	in.Code = strings.TrimSpace(in.Code)
+	in.RecoveryCode = strings.ToLower(strings.TrimSpace(in.RecoveryCode))
+	if len(in.RecoveryCode) > 0 {
+		codeReg := regexp.MustCompile(model.RecoveryCodeRegex)
+		if len(in.Code) > 0 || !codeReg.MatchString(in.RecoveryCode) {
+			return model.RecoveryCodeErr
+		}
+		return nil
+	}
+	codeReg := regexp.MustCompile(model.MFACodeRegex)
+	if !codeReg.MatchString(in.Code) {
+		return model.MFACodeErr
+	}
+
+	return nil
+}
+
+type WebAuthnAttestation struct {
+	ClientDataJSON    string `json:"clientDataJSON" binding:"required"`    // base64url
+	AttestationObject string `json:"attestationObject" binding:"required"` // base64url
+}
+
+// WebAuthnRegister is the PublicKeyCredential from navigator.credentials.create.
+type WebAuthnRegister struct {
+	ID       string              `json:"id" binding:"required"`
+	Type     string              `json:"type" binding:"required"`
+	Response WebAuthnAttestation `json:"response" binding:"required"`
+
+	ClientData  []byte `json:"-"`
+	Attestation []byte `json:"-"`
+}
+
+func (in *WebAuthnRegister) Check() error {
+	var err error
+	if in.Type != "public-key" {
+		return model.WebAuthnClientDataErr
+	}
+	if in.ClientData, err = decodeBase64URL(in.Response.ClientDataJSON); err != nil {
+		return model.WebAuthnClientDataErr
+	}
+	if in.Attestation, err = decodeBase64URL(in.Response.AttestationObject); err != nil {
+		return model.WebAuthnAttestationErr
+	}
+
+	return nil
+}
+
+type WebAuthnLoginBegin struct {
+	Username string `json:"username" binding:"required"`
+}
+
+func (in *WebAuthnLoginBegin) Check() error {
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	if !nameReg.MatchString(in.Username) {
+		return model.UserNameErr
+	}
+
+	return nil
+}
+
+type WebAuthnAssertion struct {
+	ClientDataJSON    string `json:"clientDataJSON" binding:"required"`    // base64url
+	AuthenticatorData string `json:"authenticatorData" binding:"required"` // base64url
+	Signature         string `json:"signature" binding:"required"`         // base64url
+	UserHandle        string `json:"userHandle"`                           // base64url
+}
+
+// WebAuthnLogin is the PublicKeyCredential from navigator.credentials.get.
+type WebAuthnLogin struct {
+	ID       string            `json:"id" binding:"required"`
+	Type     string            `json:"type" binding:"required"`
+	Response WebAuthnAssertion `json:"response" binding:"required"`
+
+	ClientData []byte `json:"-"`
+	AuthData   []byte `json:"-"`
+	Signature  []byte `json:"-"`
+}
+
+func (in *WebAuthnLogin) Check() error {
+	var err error
+	in.ID = strings.TrimRight(in.ID, "=")
+	if in.Type != "public-key" {
+		return model.WebAuthnClientDataErr
+	}
+	if in.ClientData, err = decodeBase64URL(in.Response.ClientDataJSON); err != nil {
+		return model.WebAuthnClientDataErr
+	}
+	if in.AuthData, err = decodeBase64URL(in.Response.AuthenticatorData); err != nil {
+		return model.WebAuthnAuthDataErr
+	}
+	if in.Signature, err = decodeBase64URL(in.Response.Signature); err != nil {
+		return model.WebAuthnSignatureErr
+	}
+
+	return nil
+}
+
+// decodeBase64URL accepts base64url with or without padding.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// UpdateProfile sets non null fields, attributes are merged and null removes one.
+type UpdateProfile struct {
+	Email       *string                `json:"email"`
+	DisplayName *string                `json:"displayName"`
+	Department  *string                `json:"department"`
+	Attributes  map[string]interface{} `json:"attributes"`
+}
+
+func (in *UpdateProfile) Check() error {
+	if in.Email != nil {
+		*in.Email = strings.ToLower(strings.TrimSpace(*in.Email))
+		emailReg := regexp.MustCompile(model.EmailRegex)
+		if len(*in.Email) > 0 && !emailReg.MatchString(*in.Email) {
+			return model.ProfileEmailErr
+		}
+	}
+	if in.DisplayName != nil {
+		*in.DisplayName = strings.TrimSpace(*in.DisplayName)
+		if len(*in.DisplayName) > model.ProfileMaxLength {
+			return model.ProfileLengthErr
+		}
+	}
+	if in.Department != nil {
+		*in.Department = strings.TrimSpace(*in.Department)
+		if len(*in.Department) > model.ProfileMaxLength {
+			return model.ProfileLengthErr
+		}
+	}
+
+	return model.CheckAttributes(in.Attributes)
+}
+
+type SetProfile struct {
+	Username string `json:"username" binding:"required"`
+	UpdateProfile
+}
+
+func (in *SetProfile) Check() error {
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	if !nameReg.MatchString(in.Username) {
+		return model.UserNameErr
+	}
+
+	return in.UpdateProfile.Check()
+}
+
+type ResendVerification struct {
+	Username string `json:"username" binding:"required"`
+}
+
+func (in *ResendVerification) Check() error {
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	if !nameReg.MatchString(in.Username) {
+		return model.UserNameErr
+	}
+
+	return nil
+}
+
+const (
+	ListDefaultLimit = 20
+	ListMaxLimit     = 100
+)
+
+var (
+	ListLimitErr  = errors.New("limit only in 1-100")
+	ListCursorErr = errors.New("invalid cursor")
+	ListOrderErr  = errors.New("order only in asc, desc")
+)
+
+// ListUsers is bound from query, cursor is the next of the previous page.
+type ListUsers struct {
+	Cursor        string `form:"cursor"`
+	Limit         int    `form:"limit"`
+	Order         string `form:"order"`    // asc(default), desc by username
+	Prefix        string `form:"prefix"`   // username prefix
+	Q             string `form:"q"`        // username substring
+	Role          string `form:"role"`     // holding role
+	Disabled      *bool  `form:"disabled"` // true, false
+	CreatedAfter  int64  `form:"createdAfter"`
+	CreatedBefore int64  `form:"createdBefore"`
+
+	After string `form:"-"` // decoded cursor
+}
+
+func (in *ListUsers) Check() error {
+	if in.Limit == 0 {
+		in.Limit = ListDefaultLimit
+	}
+	if in.Limit < 0 || in.Limit > ListMaxLimit {
+		return ListLimitErr
+	}
+	if in.Order != "" && in.Order != "asc" && in.Order != "desc" {
+		return ListOrderErr
+	}
+	after, err := base64.RawURLEncoding.DecodeString(in.Cursor)
+	if err != nil {
+		return ListCursorErr
+	}
+	in.After = string(after)
+	in.Prefix = strings.ToLower(strings.TrimSpace(in.Prefix))
+	in.Q = strings.ToLower(strings.TrimSpace(in.Q))
+	in.Role = strings.ToLower(strings.TrimSpace(in.Role))
+
+	return nil
+}
+
+func (in *ListUsers) Filter() model.UserFilter {
+	return model.UserFilter{
+		Prefix:        in.Prefix,
+		Contains:      in.Q,
+		Role:          in.Role,
+		Disabled:      in.Disabled,
+		CreatedAfter:  in.CreatedAfter,
+		CreatedBefore: in.CreatedBefore,
+	}
+}
+
+func EncodeCursor(last string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(last))
+}
+
+// ListPage is bound from query, cursor is the next of the previous page.
+type ListPage struct {
+	Cursor string `form:"cursor"`
+	Limit  int    `form:"limit"`
+
+	After string `form:"-"` // decoded cursor
+}
+
+func (in *ListPage) Check() error {
+	if in.Limit == 0 {
+		in.Limit = ListDefaultLimit
+	}
+	if in.Limit < 0 || in.Limit > ListMaxLimit {
+		return ListLimitErr
+	}
+	after, err := base64.RawURLEncoding.DecodeString(in.Cursor)
+	if err != nil {
+		return ListCursorErr
+	}
+	in.After = string(after)
+
+	return nil
+}
+
+// RoleName is bound from uri.
+type RoleName struct {
+	Role string `uri:"name" binding:"required"`
+}
+
+func (in *RoleName) Check() error {
+	in.Role = strings.ToLower(strings.TrimSpace(in.Role))
+	roleReg := regexp.MustCompile(model.RoleRegex)
+	if !roleReg.MatchString(in.Role) {
+		return model.RoleNameErr
+	}
+
+	return nil
+}
+
+const (
+	ImportAtomic = "atomic"
+	ImportBatch  = "batch"
+
+	ImportDefaultBatchSize = 500
+	ImportMaxBatchSize     = 5000
+)
+
+var (
+	ImportModeErr  = errors.New("mode only in atomic, batch")
+	ImportBatchErr = errors.New("batchSize only in 1-5000, offset >= 0")
+)
+
+// Import is bound from query, the file is the request body.
+type Import struct {
+	Format    string `form:"format"` // jsonl(default), csv
+	DryRun    bool   `form:"dryRun"`
+	Mode      string `form:"mode"` // atomic(default), batch
+	Offset    int    `form:"offset"`
+	BatchSize int    `form:"batchSize"`
+}
+
+func (in *Import) Check() error {
+	if len(in.Format) == 0 {
+		in.Format = model.TransferJSONL
+	}
+	if in.Format != model.TransferJSONL && in.Format != model.TransferCSV {
+		return model.TransferFormatErr
+	}
+	if len(in.Mode) == 0 {
+		in.Mode = ImportAtomic
+	}
+	if in.Mode != ImportAtomic && in.Mode != ImportBatch {
+		return ImportModeErr
+	}
+	if in.BatchSize == 0 {
+		in.BatchSize = ImportDefaultBatchSize
+	}
+	if in.BatchSize < 0 || in.BatchSize > ImportMaxBatchSize || in.Offset < 0 {
+		return ImportBatchErr
+	}
+
+	return nil
+}
+
+func (in *Import) Options() model.ImportOptions {
+	return model.ImportOptions{
+		DryRun:    in.DryRun,
+		Atomic:    in.Mode == ImportAtomic,
+		Offset:    in.Offset,
+		BatchSize: in.BatchSize,
+	}
+}
+
+type Export struct {
+	Format string `form:"format"` // jsonl(default), csv
+}
+
+func (in *Export) Check() error {
+	if len(in.Format) == 0 {
+		in.Format = model.TransferJSONL
+	}
+	if in.Format != model.TransferJSONL && in.Format != model.TransferCSV {
+		return model.TransferFormatErr
+	}
+
+	return nil
+}
+
+type RotateKey struct {
+	Alg string `json:"alg"` // RS256, ES256, EdDSA, default the configured alg
+}
+
+func (in *RotateKey) Check() error {
+	if len(in.Alg) == 0 {
+		return nil
+	}
+
+	return model.CheckSigningAlg(in.Alg)
+}
+
+type RevokeKey struct {
+	Kid string `json:"kid" binding:"required"`
+}
+
+func (in *RevokeKey) Check() error {
+	in.Kid = strings.TrimSpace(in.Kid)
+	if len(in.Kid) == 0 {
+		return model.SigningKeyNotExistErr
+	}
+
+	return nil
+}
+
+type CreateServiceAccount struct {
+	Username    string `json:"username" binding:"required"`
+	DisplayName string `json:"displayName"`
+}
+
+func (in *CreateServiceAccount) Check() error {
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	if !nameReg.MatchString(in.Username) {
+		return model.UserNameErr
+	}
+	in.DisplayName = strings.TrimSpace(in.DisplayName)
+	if len(in.DisplayName) > model.ProfileMaxLength {
+		return model.ProfileLengthErr
+	}
+
+	return nil
+}
+
+type CreateAPIKey struct {
+	Username string   `json:"username" binding:"required"`
+	Name     string   `json:"name" binding:"required"`
+	Scopes   []string `json:"scopes"`   // role:<name> restricts the key to the roles
+	ExpireAt int64    `json:"expireAt"` // unix second, 0 never
+}
+
+func (in *CreateAPIKey) Check() error {
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	if !nameReg.MatchString(in.Username) {
+		return model.UserNameErr
+	}
+	keyNameReg := regexp.MustCompile(model.APIKeyNameRegex)
+	if !keyNameReg.MatchString(in.Name) {
+		return model.APIKeyNameErr
+	}
+
+	return CheckScopes(in.Scopes)
+}
+
+type RevokeAPIKey struct {
+	Username string `json:"username" binding:"required"`
+	ID       string `json:"id" binding:"required"`
+}
+
+func (in *RevokeAPIKey) Check() error {
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	if !nameReg.MatchString(in.Username) {
+		return model.UserNameErr
+	}
+	if len(in.ID) != model.APIKeyIDLength {
+		return model.APIKeyNotExistErr
+	}
+
+	return nil
+}
+
+type ListAPIKeys struct {
+	Username string `form:"username" binding:"required"`
+}
+
+func (in *ListAPIKeys) Check() error {
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	if !nameReg.MatchString(in.Username) {
+		return model.UserNameErr
+	}
+
 	return nil
 }
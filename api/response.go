@@ -1,5 +1,9 @@
 package api
 
+import (
+	"github.com/nieben/auth-service-sample/model"
+)
+
 type Response struct {
 	Status int64       `json:"status"`
 	Error  string      `json:"error"`
@@ -20,3 +24,209 @@ func NewFailResponse(err error, data interface{}) Response {
 		Data:   data,
 	}
 }
+
+type MFAEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`    // otpauth:// uri
+	QRCode string `json:"qrCode"` // base64 png of uri
+}
+
+// AccessToken is returned on login, see controller.LegacyTokenResponse for the former header.
+type AccessToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"` // Bearer
+	ExpiresIn    int64  `json:"expires_in"` // second
+	IssuedAt     int64  `json:"issued_at"`
+	ExpiresAt    int64  `json:"expires_at"`     // idle expiry, extended on use
+	MaxExpiresAt int64  `json:"max_expires_at"` // absolute expiry
+	Scope        string `json:"scope,omitempty"`
+	CSRFToken    string `json:"csrf_token,omitempty"` // cookie sessions, send it in header X-CSRF-Token
+}
+
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfaRequired"`
+	MFAToken    string `json:"mfaToken"`
+	ExpireAt    int64  `json:"expireAt"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"` // shown once, single use
+}
+
+type MFAStatus struct {
+	Enabled       bool `json:"enabled"`
+	RecoveryCodes int  `json:"recoveryCodes"` // remaining
+}
+
+type WebAuthnEntity struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+type WebAuthnParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type WebAuthnDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"` // base64url
+}
+
+type WebAuthnSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// WebAuthnCreation is PublicKeyCredentialCreationOptions, binary fields in base64url.
+type WebAuthnCreation struct {
+	Challenge              string               `json:"challenge"`
+	RP                     WebAuthnEntity       `json:"rp"`
+	User                   WebAuthnEntity       `json:"user"`
+	PubKeyCredParams       []WebAuthnParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                `json:"timeout"` // millisecond
+	Attestation            string               `json:"attestation"`
+	ExcludeCredentials     []WebAuthnDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection WebAuthnSelection    `json:"authenticatorSelection"`
+}
+
+// WebAuthnRequest is PublicKeyCredentialRequestOptions, binary fields in base64url.
+type WebAuthnRequest struct {
+	Challenge        string               `json:"challenge"`
+	RPID             string               `json:"rpId"`
+	AllowCredentials []WebAuthnDescriptor `json:"allowCredentials"`
+	Timeout          int64                `json:"timeout"` // millisecond
+	UserVerification string               `json:"userVerification"`
+}
+
+type Profile struct {
+	Username      string `json:"username"`
+	EmailVerified bool   `json:"emailVerified"`
+	model.Profile
+}
+
+// Introspection describes the token and its user for downstream services.
+type Introspection struct {
+	Username      string                 `json:"username"`
+	Roles         []string               `json:"roles"` // within the token's role scopes
+	Scopes        []string               `json:"scopes"`
+	CreatedAt     int64                  `json:"createdAt"`
+	ExpireAt      int64                  `json:"expireAt"` // idle expiry, extended on use
+	MaxExpireAt   int64                  `json:"maxExpireAt"`
+	Email         string                 `json:"email"`
+	EmailVerified bool                   `json:"emailVerified"`
+	DisplayName   string                 `json:"displayName"`
+	Department    string                 `json:"department"`
+	Attributes    map[string]interface{} `json:"attributes"` // exposed attributes only
+}
+
+type UserItem struct {
+	Username       string   `json:"username"`
+	Email          string   `json:"email"`
+	EmailVerified  bool     `json:"emailVerified"`
+	DisplayName    string   `json:"displayName"`
+	Department     string   `json:"department"`
+	Disabled       bool     `json:"disabled"`
+	MFAEnabled     bool     `json:"mfaEnabled"`
+	ServiceAccount bool     `json:"serviceAccount"`
+	CreatedAt      int64    `json:"createdAt"`
+	Roles          []string `json:"roles"`
+}
+
+type UserList struct {
+	Users []UserItem `json:"users"`
+	Next  string     `json:"next"` // cursor of the next page, empty at the end
+}
+
+type RoleItem struct {
+	ID          string               `json:"id"`
+	Name        string               `json:"name"`
+	Description string               `json:"description"`
+	Metadata    map[string]string    `json:"metadata"`
+	CreatedAt   int64                `json:"createdAt"`
+	Session     *model.SessionPolicy `json:"session,omitempty"`
+}
+
+type RoleList struct {
+	Roles []RoleItem `json:"roles"`
+	Next  string     `json:"next"` // cursor of the next page, empty at the end
+}
+
+// OAuthToken is the token response of /oauth/token, RFC 6749 5.1.
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"` // openid scope only
+}
+
+// OAuthError is the error response of /oauth/token, RFC 6749 5.2.
+type OAuthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func NewOAuthError(code string, err error) OAuthError {
+	return OAuthError{Error: code, ErrorDescription: err.Error()}
+}
+
+// OAuthDeviceCode is the response of /oauth/device_authorization, RFC 8628 3.2.
+type OAuthDeviceCode struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// OAuthIntrospection is the response of /oauth/introspect, RFC 7662 2.2, only active for inactive tokens.
+type OAuthIntrospection struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"` // access_token, refresh_token
+	Exp       int64    `json:"exp,omitempty"`
+	Iat       int64    `json:"iat,omitempty"`
+	Sub       string   `json:"sub,omitempty"` // user id, or client id for client credentials
+	Iss       string   `json:"iss,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+}
+
+type APIKeyCreated struct {
+	model.APIKey
+	Key string `json:"key"` // only shown once
+}
+
+type ClientCreated struct {
+	*model.Client
+	ClientSecret string `json:"clientSecret"` // only shown once, empty for public clients
+}
+
+// OIDCConfiguration is the openid connect discovery document.
+type OIDCConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+type JWKS struct {
+	Keys []model.JWK `json:"keys"`
+}
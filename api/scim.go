@@ -0,0 +1,479 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/nieben/auth-service-sample/model"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SCIM 2.0, RFC 7643 and RFC 7644
+const (
+	SCIMUserSchema       = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SCIMEnterpriseSchema = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+	SCIMGroupSchema      = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SCIMListSchema       = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SCIMPatchSchema      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SCIMErrorSchema      = "urn:ietf:params:scim:api:messages:2.0:Error"
+	SCIMConfigSchema     = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+
+	SCIMContentType = "application/scim+json"
+
+	SCIMDefaultCount = 100
+	SCIMMaxCount     = 1000
+
+	SCIMFilterRegex = `^(?i)([a-z.]+)\s+eq\s+"((?:[^"\\]|\\.)*)"$`
+)
+
+var (
+	SCIMFilterErr     = errors.New("filter only in format: <attribute> eq \"<value>\"")
+	SCIMPageErr       = errors.New("startIndex >= 1, count in 0-1000")
+	SCIMPatchOpErr    = errors.New("patch op only in add, remove, replace")
+	SCIMPatchPathErr  = errors.New("unsupported patch path")
+	SCIMPatchValueErr = errors.New("invalid patch value")
+	SCIMMutabilityErr = errors.New("userName is immutable")
+	SCIMAdminErr      = errors.New("the admin role and passwords of its members are not managed by scim")
+)
+
+type SCIMMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created,omitempty"`
+	Location     string `json:"location"`
+}
+
+type SCIMName struct {
+	Formatted string `json:"formatted,omitempty"`
+}
+
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type SCIMEnterprise struct {
+	Department string `json:"department,omitempty"`
+}
+
+type SCIMMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// SCIMUser maps onto model.User, id is the username.
+type SCIMUser struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id,omitempty"`
+	ExternalID  string          `json:"externalId,omitempty"`
+	UserName    string          `json:"userName"`
+	Name        *SCIMName       `json:"name,omitempty"`
+	DisplayName string          `json:"displayName,omitempty"`
+	Emails      []SCIMEmail     `json:"emails,omitempty"`
+	Active      *bool           `json:"active,omitempty"`
+	Password    string          `json:"password,omitempty"` // write only
+	Groups      []SCIMMember    `json:"groups,omitempty"`   // read only, roles
+	Enterprise  *SCIMEnterprise `json:"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User,omitempty"`
+	Meta        *SCIMMeta       `json:"meta,omitempty"`
+}
+
+func (in *SCIMUser) Check() error {
+	in.UserName = strings.ToLower(strings.TrimSpace(in.UserName))
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	if !nameReg.MatchString(in.UserName) {
+		return model.UserNameErr
+	}
+	if len(in.DisplayName) == 0 && in.Name != nil {
+		in.DisplayName = in.Name.Formatted
+	}
+	if in.Enterprise == nil {
+		in.Enterprise = &SCIMEnterprise{}
+	}
+	if len(in.Password) > 0 && !regexp.MustCompile(model.PwdRegex).MatchString(in.Password) {
+		return model.UserPwdErr
+	}
+	email := in.Email()
+	if len(email) > 0 && !regexp.MustCompile(model.EmailRegex).MatchString(email) {
+		return model.ProfileEmailErr
+	}
+	if len(in.DisplayName) > model.ProfileMaxLength || len(in.Enterprise.Department) > model.ProfileMaxLength {
+		return model.ProfileLengthErr
+	}
+
+	return nil
+}
+
+// Email returns the primary email, or the first one.
+func (in *SCIMUser) Email() string {
+	for _, e := range in.Emails {
+		if e.Primary {
+			return strings.ToLower(strings.TrimSpace(e.Value))
+		}
+	}
+	if len(in.Emails) > 0 {
+		return strings.ToLower(strings.TrimSpace(in.Emails[0].Value))
+	}
+
+	return ""
+}
+
+// SCIMGroup maps onto model.Role, id is the role id.
+type SCIMGroup struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []SCIMMember `json:"members"`
+	Meta        *SCIMMeta    `json:"meta,omitempty"`
+}
+
+func (in *SCIMGroup) Check() error {
+	in.DisplayName = strings.ToLower(strings.TrimSpace(in.DisplayName))
+	if !regexp.MustCompile(model.RoleRegex).MatchString(in.DisplayName) {
+		return model.RoleNameErr
+	}
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	for i := range in.Members {
+		in.Members[i].Value = strings.ToLower(strings.TrimSpace(in.Members[i].Value))
+		if !nameReg.MatchString(in.Members[i].Value) {
+			return model.UserNameErr
+		}
+	}
+
+	return nil
+}
+
+// Usernames of members.
+func (in *SCIMGroup) Usernames() []string {
+	names := make([]string, 0, len(in.Members))
+	for _, m := range in.Members {
+		names = append(names, m.Value)
+	}
+
+	return names
+}
+
+type SCIMList struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type SCIMError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+func NewSCIMError(status int, scimType string, err error) SCIMError {
+	return SCIMError{
+		Schemas:  []string{SCIMErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   err.Error(),
+	}
+}
+
+// SCIMQuery is bound from query, startIndex is 1-based.
+type SCIMQuery struct {
+	Filter     string `form:"filter"`
+	StartIndex int    `form:"startIndex"`
+	Count      *int   `form:"count"`
+
+	FilterAttr  string `form:"-"` // lower case
+	FilterValue string `form:"-"`
+}
+
+func (in *SCIMQuery) Check() error {
+	if in.StartIndex < 1 {
+		in.StartIndex = 1
+	}
+	if in.Count == nil {
+		count := SCIMDefaultCount
+		in.Count = &count
+	}
+	if *in.Count < 0 || *in.Count > SCIMMaxCount {
+		return SCIMPageErr
+	}
+	if len(in.Filter) > 0 {
+		m := regexp.MustCompile(SCIMFilterRegex).FindStringSubmatch(strings.TrimSpace(in.Filter))
+		if m == nil {
+			return SCIMFilterErr
+		}
+		value, err := strconv.Unquote(`"` + m[2] + `"`)
+		if err != nil {
+			return SCIMFilterErr
+		}
+		in.FilterAttr, in.FilterValue = strings.ToLower(m[1]), value
+	}
+
+	return nil
+}
+
+type SCIMPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value" swaggertype:"object"`
+}
+
+type SCIMPatch struct {
+	Schemas    []string      `json:"schemas"`
+	Operations []SCIMPatchOp `json:"Operations"`
+}
+
+func (in *SCIMPatch) Check() error {
+	for i := range in.Operations {
+		op := &in.Operations[i]
+		op.Op = strings.ToLower(op.Op)
+		if op.Op != "add" && op.Op != "remove" && op.Op != "replace" {
+			return SCIMPatchOpErr
+		}
+	}
+
+	return nil
+}
+
+// SCIMUserChanges are attributes set by a patch, nil is unchanged, empty is removed.
+type SCIMUserChanges struct {
+	Active      *bool
+	DisplayName *string
+	Email       *string
+	Department  *string
+	ExternalID  *string
+	Password    *string
+}
+
+// UserChanges applies operations on user attributes, userName can not be changed.
+func (in *SCIMPatch) UserChanges(username string) (*SCIMUserChanges, error) {
+	changes := &SCIMUserChanges{}
+	for _, op := range in.Operations {
+		if len(op.Path) == 0 { // value is a partial resource
+			if op.Op == "remove" {
+				return nil, SCIMPatchPathErr
+			}
+			var attrs map[string]json.RawMessage
+			if err := json.Unmarshal(op.Value, &attrs); err != nil {
+				return nil, SCIMPatchValueErr
+			}
+			for path, value := range attrs {
+				if err := changes.set(username, path, op.Op, value); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if err := changes.set(username, op.Path, op.Op, op.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, changes.check()
+}
+
+func (ch *SCIMUserChanges) set(username, path, op string, value json.RawMessage) error {
+	str := func() (*string, error) {
+		s := ""
+		if op == "remove" {
+			return &s, nil
+		}
+		if err := json.Unmarshal(value, &s); err != nil {
+			return nil, SCIMPatchValueErr
+		}
+		return &s, nil
+	}
+
+	var err error
+	switch strings.ToLower(path) {
+	case "username":
+		var s *string
+		if s, err = str(); err == nil && strings.ToLower(*s) != username {
+			err = SCIMMutabilityErr
+		}
+	case "active":
+		var active bool
+		if op == "remove" {
+			return SCIMPatchValueErr
+		}
+		if json.Unmarshal(value, &active) != nil {
+			// some clients send "True"/"False"
+			var s string
+			if json.Unmarshal(value, &s) != nil {
+				return SCIMPatchValueErr
+			}
+			if active, err = strconv.ParseBool(s); err != nil {
+				return SCIMPatchValueErr
+			}
+		}
+		ch.Active = &active
+	case "displayname", "name.formatted":
+		ch.DisplayName, err = str()
+	case "name":
+		var name SCIMName
+		if op != "remove" && json.Unmarshal(value, &name) != nil {
+			return SCIMPatchValueErr
+		}
+		ch.DisplayName = &name.Formatted
+	case "externalid":
+		ch.ExternalID, err = str()
+	case "password":
+		ch.Password, err = str()
+	case "emails":
+		user := SCIMUser{}
+		if op != "remove" && json.Unmarshal(value, &user.Emails) != nil {
+			return SCIMPatchValueErr
+		}
+		email := user.Email()
+		ch.Email = &email
+	case `emails[type eq "work"].value`, `emails[primary eq true].value`:
+		ch.Email, err = str()
+	case strings.ToLower(SCIMEnterpriseSchema) + ":department":
+		ch.Department, err = str()
+	case strings.ToLower(SCIMEnterpriseSchema):
+		ext := SCIMEnterprise{}
+		if op != "remove" && json.Unmarshal(value, &ext) != nil {
+			return SCIMPatchValueErr
+		}
+		ch.Department = &ext.Department
+	default:
+		return SCIMPatchPathErr
+	}
+
+	return err
+}
+
+func (ch *SCIMUserChanges) check() error {
+	if ch.Email != nil {
+		*ch.Email = strings.ToLower(strings.TrimSpace(*ch.Email))
+		if len(*ch.Email) > 0 && !regexp.MustCompile(model.EmailRegex).MatchString(*ch.Email) {
+			return model.ProfileEmailErr
+		}
+	}
+	if ch.Password != nil && len(*ch.Password) > 0 && !regexp.MustCompile(model.PwdRegex).MatchString(*ch.Password) {
+		return model.UserPwdErr
+	}
+	if (ch.DisplayName != nil && len(*ch.DisplayName) > model.ProfileMaxLength) ||
+		(ch.Department != nil && len(*ch.Department) > model.ProfileMaxLength) {
+		return model.ProfileLengthErr
+	}
+
+	return nil
+}
+
+// SCIMGroupChanges are set by a patch, members are replaced when Replace is set.
+type SCIMGroupChanges struct {
+	DisplayName *string
+	Replace     bool
+	Add         []string
+	Remove      []string
+}
+
+// GroupChanges applies operations on displayName and members,
+// members are removed by path members[value eq "<username>"] or with a value list.
+func (in *SCIMPatch) GroupChanges() (*SCIMGroupChanges, error) {
+	changes := &SCIMGroupChanges{Add: make([]string, 0), Remove: make([]string, 0)}
+	memberReg := regexp.MustCompile(`^(?i)members\[value eq "([^"]*)"\]$`)
+	for _, op := range in.Operations {
+		path := strings.ToLower(op.Path)
+		if len(path) == 0 {
+			if op.Op == "remove" {
+				return nil, SCIMPatchPathErr
+			}
+			group := SCIMGroup{}
+			if err := json.Unmarshal(op.Value, &group); err != nil {
+				return nil, SCIMPatchValueErr
+			}
+			if len(group.DisplayName) > 0 {
+				changes.DisplayName = &group.DisplayName
+			}
+			if group.Members != nil {
+				changes.members(op.Op, group.Usernames())
+			}
+			continue
+		}
+
+		if m := memberReg.FindStringSubmatch(op.Path); m != nil && op.Op == "remove" {
+			changes.members("remove", []string{m[1]})
+			continue
+		}
+		switch path {
+		case "displayname":
+			var name string
+			if op.Op == "remove" || json.Unmarshal(op.Value, &name) != nil {
+				return nil, SCIMPatchValueErr
+			}
+			changes.DisplayName = &name
+		case "members":
+			var members []SCIMMember
+			if len(op.Value) > 0 && json.Unmarshal(op.Value, &members) != nil {
+				return nil, SCIMPatchValueErr
+			}
+			group := SCIMGroup{Members: members}
+			if op.Op == "remove" && len(members) == 0 { // remove all
+				changes.members("replace", []string{})
+				continue
+			}
+			changes.members(op.Op, group.Usernames())
+		default:
+			return nil, SCIMPatchPathErr
+		}
+	}
+
+	if changes.DisplayName != nil {
+		*changes.DisplayName = strings.ToLower(strings.TrimSpace(*changes.DisplayName))
+		if !regexp.MustCompile(model.RoleRegex).MatchString(*changes.DisplayName) {
+			return nil, model.RoleNameErr
+		}
+	}
+	nameReg := regexp.MustCompile(model.UsernameRegex)
+	for _, list := range [][]string{changes.Add, changes.Remove} {
+		for i := range list {
+			list[i] = strings.ToLower(strings.TrimSpace(list[i]))
+			if !nameReg.MatchString(list[i]) {
+				return nil, model.UserNameErr
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+func (ch *SCIMGroupChanges) members(op string, usernames []string) {
+	switch op {
+	case "replace":
+		ch.Replace, ch.Add, ch.Remove = true, usernames, make([]string, 0)
+	case "add":
+		ch.Add = append(ch.Add, usernames...)
+	case "remove":
+		ch.Remove = append(ch.Remove, usernames...)
+	}
+}
+
+type SCIMSupported struct {
+	Supported bool `json:"supported"`
+}
+
+type SCIMFilterConfig struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+type SCIMAuthScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type SCIMServiceProviderConfig struct {
+	Schemas               []string         `json:"schemas"`
+	Patch                 SCIMSupported    `json:"patch"`
+	Bulk                  SCIMSupported    `json:"bulk"`
+	Filter                SCIMFilterConfig `json:"filter"`
+	ChangePassword        SCIMSupported    `json:"changePassword"`
+	Sort                  SCIMSupported    `json:"sort"`
+	ETag                  SCIMSupported    `json:"etag"`
+	AuthenticationSchemes []SCIMAuthScheme `json:"authenticationSchemes"`
+}
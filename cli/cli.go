@@ -0,0 +1,176 @@
+// Package cli implements admin and user commands, which call a running service over http.
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/model"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	TokenEnv = "AUTH_TOKEN"
+)
+
+var (
+	Commands = map[string]func(args []string, out io.Writer) error{
+		"import": Import,
+		"export": Export,
+		"login":  Login,
+	}
+
+	ImportFailedErr = errors.New("import finished with errors")
+)
+
+type client struct {
+	server string
+	token  string
+}
+
+func (c *client) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.server, "server", "http://127.0.0.1:8080", "service url")
+	fs.StringVar(&c.token, "token", os.Getenv(TokenEnv), "admin token, default $"+TokenEnv)
+}
+
+func (c *client) do(method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(c.server, "/")+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var response api.Response
+		json.NewDecoder(resp.Body).Decode(&response)
+		return nil, fmt.Errorf("%s: %s", resp.Status, response.Error)
+	}
+
+	return resp, nil
+}
+
+// Import uploads a file, batch mode repeats until all rows are processed.
+func Import(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	c := &client{}
+	c.flags(fs)
+	format := fs.String("format", "", "jsonl or csv, default by file extension")
+	dryRun := fs.Bool("dry-run", false, "validate only")
+	mode := fs.String("mode", api.ImportAtomic, "atomic or batch")
+	offset := fs.Int("offset", 0, "batch mode, rows to skip, to resume an import")
+	batchSize := fs.Int("batch", api.ImportDefaultBatchSize, "batch mode, rows per request")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: import [flags] <file>")
+	}
+	path := fs.Arg(0)
+	if len(*format) == 0 {
+		*format = model.TransferJSONL
+		if strings.HasSuffix(path, ".csv") {
+			*format = model.TransferCSV
+		}
+	}
+
+	failed := false
+	for next := *offset; ; {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		query := url.Values{}
+		query.Set("format", *format)
+		query.Set("dryRun", strconv.FormatBool(*dryRun))
+		query.Set("mode", *mode)
+		query.Set("offset", strconv.Itoa(next))
+		query.Set("batchSize", strconv.Itoa(*batchSize))
+		resp, err := c.do(http.MethodPost, "/admin/import", query, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		var report model.ImportReport
+		err = decodeResponse(resp, &report)
+		if err != nil {
+			return err
+		}
+		for _, e := range report.Errors {
+			fmt.Fprintf(out, "row %d: %s\n", e.Row, e.Error)
+		}
+		fmt.Fprintf(out, "rows %d-%d of %d, applied %d, errors %d\n", next+1, report.Next, report.Total, report.Applied, len(report.Errors))
+		failed = failed || len(report.Errors) > 0
+		if report.Done {
+			break
+		}
+		next = report.Next
+	}
+	if failed {
+		return ImportFailedErr
+	}
+
+	return nil
+}
+
+// Export writes all users, roles and grants to a file or stdout.
+func Export(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	c := &client{}
+	c.flags(fs)
+	format := fs.String("format", model.TransferJSONL, "jsonl or csv")
+	output := fs.String("o", "", "output file, default stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("format", *format)
+	resp, err := c.do(http.MethodGet, "/admin/export", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") { // failed
+		return decodeResponse(resp, nil)
+	}
+
+	w := out
+	if len(*output) > 0 {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = io.Copy(w, resp.Body)
+
+	return err
+}
+
+func decodeResponse(resp *http.Response, data interface{}) error {
+	defer resp.Body.Close()
+
+	response := api.Response{Data: data}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return err
+	}
+	if len(response.Error) > 0 {
+		return errors.New(response.Error)
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/model"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	ClientEnv = "AUTH_CLIENT_ID"
+)
+
+var (
+	Sleep = time.Sleep // between polls
+
+	LoginExpiredErr = errors.New("the code expired before it was approved")
+)
+
+// Login signs in with the device authorization grant, instructions go to stderr and
+// the access token to out, e.g. export AUTH_TOKEN=$(auth login -client <id>).
+func Login(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	server := fs.String("server", "http://127.0.0.1:8080", "service url")
+	clientID := fs.String("client", os.Getenv(ClientEnv), "oauth client id with the device grant, default $"+ClientEnv)
+	scope := fs.String("scope", "", "requested scopes, space separated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	base := strings.TrimRight(*server, "/")
+
+	var device api.OAuthDeviceCode
+	if err := postForm(base+"/oauth/device_authorization", url.Values{"client_id": {*clientID}, "scope": {*scope}}, &device); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Open %s and enter the code %s\nor open %s\n", device.VerificationURI, device.UserCode, device.VerificationURIComplete)
+
+	interval := time.Duration(device.Interval) * time.Second
+	for deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second); time.Now().Before(deadline); {
+		Sleep(interval)
+
+		var token api.OAuthToken
+		err := postForm(base+"/oauth/token", url.Values{
+			"grant_type":  {model.GrantDeviceCode},
+			"device_code": {device.DeviceCode},
+			"client_id":   {*clientID},
+		}, &token)
+		var oauthErr *oauthError
+		switch {
+		case err == nil:
+			fmt.Fprintln(out, token.AccessToken)
+			return nil
+		case errors.As(err, &oauthErr) && oauthErr.Code == api.OAuthAuthorizationPending:
+		case errors.As(err, &oauthErr) && oauthErr.Code == api.OAuthSlowDown:
+			interval += model.DeviceSlowDown * time.Second
+		default:
+			return err
+		}
+	}
+
+	return LoginExpiredErr
+}
+
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func postForm(uri string, values url.Values, data interface{}) error {
+	resp, err := http.PostForm(uri, values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		oauthErr := &oauthError{}
+		if err := json.NewDecoder(resp.Body).Decode(oauthErr); err != nil || len(oauthErr.Code) == 0 {
+			return fmt.Errorf("%s", resp.Status)
+		}
+		return oauthErr
+	}
+
+	return json.NewDecoder(resp.Body).Decode(data)
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/model"
+	"net/http"
+)
+
+type APIKeyController struct {
+}
+
+// @Summary create service account(admin)
+// @Description service accounts can not login, they authenticate with api keys
+// @Tags apiKey
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.CreateServiceAccount true "请求参数"
+// @Success 200 {object} api.Response{}
+// @Router /serviceAccount/create [post]
+func (a *APIKeyController) CreateServiceAccount(c *gin.Context) {
+	var in api.CreateServiceAccount
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if _, err := model.CreateServiceAccount(in.Username, in.DisplayName); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
+	}
+}
+
+// @Summary create api key(admin)
+// @Description the key is shown only once, send it in header "Authorization: ApiKey <key>"
+// @Tags apiKey
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.CreateAPIKey true "请求参数"
+// @Success 200 {object} api.Response{data=api.APIKeyCreated}
+// @Router /apiKey/create [post]
+func (a *APIKeyController) Create(c *gin.Context) {
+	var in api.CreateAPIKey
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	user := model.GetUser(in.Username)
+	if user == nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(model.UserNotExistErr, nil))
+		return
+	}
+
+	if key, secret, err := model.CreateAPIKey(user, in.Name, in.Scopes, in.ExpireAt); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		created := *key
+		created.Scopes = model.RoleScopeNames(key.Scopes)
+		c.JSON(http.StatusOK, api.NewSuccessResponse(api.APIKeyCreated{APIKey: created, Key: secret}))
+	}
+}
+
+// @Summary revoke api key(admin)
+// @Tags apiKey
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.RevokeAPIKey true "请求参数"
+// @Success 200 {object} api.Response{}
+// @Router /apiKey/revoke [post]
+func (a *APIKeyController) Revoke(c *gin.Context) {
+	var in api.RevokeAPIKey
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := model.RevokeAPIKey(in.Username, in.ID); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
+	}
+}
+
+// @Summary list api keys of a user(admin)
+// @Tags apiKey
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data query api.ListAPIKeys true "请求参数"
+// @Success 200 {object} api.Response{data=[]model.APIKey}
+// @Router /apiKeys [get]
+func (a *APIKeyController) List(c *gin.Context) {
+	var in api.ListAPIKeys
+	if err := c.ShouldBindQuery(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if model.GetUser(in.Username) == nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(model.UserNotExistErr, nil))
+		return
+	}
+
+	c.JSON(http.StatusOK, api.NewSuccessResponse(model.ListAPIKeys(in.Username)))
+}
@@ -5,6 +5,15 @@ import (
 	"github.com/nieben/auth-service-sample/api"
 	"github.com/nieben/auth-service-sample/model"
 	"net/http"
+	"strings"
+)
+
+const (
+	CSRFCookieSuffix = "_csrf" // the csrf cookie is readable by scripts, named after the token cookie
+)
+
+var (
+	LegacyTokenResponse bool // token in the response header model.TokenHeader with no data, for former clients
 )
 
 type AuthController struct {
@@ -15,8 +24,8 @@ type AuthController struct {
 // @Accept json
 // @Produce json
 // @Param data body api.Token true "请求参数"
-// @Success 200 {object} api.Response{}
-// @Header  200 {string} Token ""
+// @Success 200 {object} api.Response{data=api.AccessToken} "data is api.MFAChallenge when mfa is required"
+// @Header  200 {string} Token "legacy token response only"
 // @Router /auth/token [post]
 func (a *AuthController) Token(c *gin.Context) {
 	var in api.Token
@@ -39,10 +48,76 @@ func (a *AuthController) Token(c *gin.Context) {
 		c.JSON(http.StatusOK, api.NewFailResponse(model.UserCheckErr, nil))
 		return
 	}
+	if err := user.CanLogin(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+	scopes, err := user.BindRoleScopes(in.Scopes)
+	if err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	// second step required, see MFA
+	if user.HasMFA() {
+		challenge, err := model.NewMFAChallenge(user, scopes)
+		if err != nil {
+			c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+			return
+		}
+		c.JSON(http.StatusOK, api.NewSuccessResponse(api.MFAChallenge{
+			MFARequired: true,
+			MFAToken:    challenge.Token,
+			ExpireAt:    challenge.ExpireAt,
+		}))
+		return
+	}
+
+	issueToken(c, user, scopes)
+}
+
+// @Summary exchange mfa token and totp code(or recovery code) for token
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param data body api.MFAToken true "请求参数"
+// @Success 200 {object} api.Response{data=api.AccessToken}
+// @Header  200 {string} Token "legacy token response only"
+// @Router /auth/mfa [post]
+func (a *AuthController) MFA(c *gin.Context) {
+	var in api.MFAToken
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	challenge, err := model.GetMFAChallenge(in.MFAToken)
+	if err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+	if model.GetUser(challenge.User.Username) == nil { // user deleted
+		challenge.Remove()
+		c.JSON(http.StatusOK, api.NewFailResponse(model.UserCheckErr, nil))
+		return
+	}
+	if len(in.RecoveryCode) > 0 {
+		if !challenge.User.UseRecoveryCode(in.RecoveryCode) {
+			c.JSON(http.StatusOK, api.NewFailResponse(model.RecoveryCodeErr, nil))
+			return
+		}
+	} else if !challenge.User.CheckTOTP(in.Code) {
+		c.JSON(http.StatusOK, api.NewFailResponse(model.MFACodeErr, nil))
+		return
+	}
 
-	t := model.GenerateToken(user)
-	c.Header("token", t.Token)
-	c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
+	challenge.Remove()
+	issueToken(c, challenge.User, challenge.Scopes)
 }
 
 // @Summary logout
@@ -54,9 +129,107 @@ func (a *AuthController) Token(c *gin.Context) {
 // @Router /auth/logout [post]
 func (a *AuthController) Logout(c *gin.Context) {
 	t, _ := c.Get("token")
+	if len(model.TokenCookie) > 0 {
+		setTokenCookie(c, "", "", -1)
+	}
 	if err := t.(*model.Token).Remove(); err != nil {
 		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
 	} else {
 		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
 	}
 }
+
+// @Summary introspect token, returns user profile and exposed attributes
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Success 200 {object} api.Response{data=api.Introspection}
+// @Router /auth/introspect [post]
+func (a *AuthController) Introspect(c *gin.Context) {
+	t, _ := c.Get("token")
+	token := t.(*model.Token)
+	profile := token.User.GetProfile()
+
+	c.JSON(http.StatusOK, api.NewSuccessResponse(api.Introspection{
+		Username:      token.User.Username,
+		Roles:         token.Roles(),
+		Scopes:        model.RoleScopeNames(token.Scopes),
+		CreatedAt:     token.CreatedAt,
+		ExpireAt:      token.Expiry(),
+		MaxExpireAt:   token.MaxExpireAt,
+		Email:         profile.Email,
+		EmailVerified: token.User.IsEmailVerified(),
+		DisplayName:   profile.DisplayName,
+		Department:    profile.Department,
+		Attributes:    model.ExposedAttributes(profile.Attributes),
+	}))
+}
+
+// issueToken issues a token restricted to the scopes, full authority when there is no role scope.
+func issueToken(c *gin.Context, user *model.User, scopes []string) {
+	if err := user.CanLogin(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+	scopes, err := user.BindRoleScopes(scopes) // roles may be revoked during mfa
+	if err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	t, csrf, err := startSession(c, user, scopes)
+	if err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+	if LegacyTokenResponse {
+		c.Header(model.TokenHeader, t.Token)
+		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
+		return
+	}
+
+	c.JSON(http.StatusOK, api.NewSuccessResponse(api.AccessToken{
+		AccessToken:  t.Token,
+		TokenType:    "Bearer",
+		ExpiresIn:    t.ExpireAt - t.CreatedAt,
+		IssuedAt:     t.CreatedAt,
+		ExpiresAt:    t.ExpireAt,
+		MaxExpiresAt: t.MaxExpireAt,
+		Scope:        strings.Join(model.RoleScopeNames(t.Scopes), " "),
+		CSRFToken:    csrf,
+	}))
+}
+
+// startSession issues a token, and starts a browser session in the cookie when enabled.
+func startSession(c *gin.Context, user *model.User, scopes []string) (*model.Token, string, error) {
+	t := model.GenerateClientToken(user, "", scopes)
+	if len(model.TokenCookie) == 0 {
+		return t, "", nil
+	}
+	csrf, err := t.NewCSRFToken()
+	if err != nil {
+		t.Remove()
+		return nil, "", err
+	}
+	setTokenCookie(c, t.Token, csrf, int(t.MaxExpireAt-t.CreatedAt))
+
+	return t, csrf, nil
+}
+
+// browserSession returns the session of the cookie, set by middleware.Session.
+func browserSession(c *gin.Context) *model.Token {
+	if t, ok := c.Get("token"); ok {
+		return t.(*model.Token)
+	}
+
+	return nil
+}
+
+// setTokenCookie sets the HttpOnly token cookie and the csrf cookie of a browser session,
+// max age < 0 deletes them.
+func setTokenCookie(c *gin.Context, token, csrf string, maxAge int) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(model.TokenCookie, token, maxAge, "/", "", true, true)
+	c.SetCookie(model.TokenCookie+CSRFCookieSuffix, csrf, maxAge, "/", "", true, false)
+}
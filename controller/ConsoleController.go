@@ -0,0 +1,323 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/model"
+	"github.com/nieben/auth-service-sample/page"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	ConsolePageSize = 50
+)
+
+// ConsoleController serves the admin console, hosted pages for browser sessions of admins.
+// Forms are protected by the csrf token of the session.
+type ConsoleController struct {
+}
+
+type consoleUsersData struct {
+	Admin     string // empty when the page is not shown
+	Error     string
+	Q         string
+	Role      string
+	Disabled  string // true, false, empty for any
+	Users     []api.UserItem
+	Next      string // link of the next page
+	CSRFToken string
+}
+
+type consoleUserData struct {
+	Admin     string
+	Error     string
+	User      api.UserItem
+	Sessions  []consoleSessionItem
+	CSRFToken string
+}
+
+type consoleSessionItem struct {
+	ID        string // model.Token.SessionID
+	ClientID  string
+	CreatedAt string
+	ExpireAt  string
+	Scopes    []string
+	Current   bool // the admin's own session
+}
+
+// @Summary admin console(admin), redirects to the user search
+// @Tags console
+// @Produce html
+// @Success 302 {string} string "redirected"
+// @Router /admin/console [get]
+func (con *ConsoleController) Index(c *gin.Context) {
+	c.Redirect(http.StatusFound, api.ConsolePath+"/users")
+}
+
+// @Summary admin console(admin), user search
+// @Tags console
+// @Produce html
+// @Param q query string false "username substring"
+// @Param role query string false "holding role"
+// @Param disabled query string false "true, false"
+// @Param cursor query string false "next page"
+// @Success 200 {string} string "users"
+// @Success 302 {string} string "not signed in, redirected to login"
+// @Router /admin/console/users [get]
+func (con *ConsoleController) Users(c *gin.Context) {
+	t := consoleSession(c)
+	if t == nil {
+		return
+	}
+	data := consoleUsersData{Admin: t.User.Username, CSRFToken: t.CSRF()}
+	var in api.ListUsers
+	if err := c.ShouldBindQuery(&in); err != nil {
+		data.Error = err.Error()
+		renderPage(c, http.StatusBadRequest, page.ConsoleUsers, data)
+		return
+	}
+	if len(c.Query("disabled")) == 0 { // any, the select sends it empty
+		in.Disabled = nil
+	}
+	in.Limit = ConsolePageSize
+	if err := in.Check(); err != nil {
+		data.Error = err.Error()
+		renderPage(c, http.StatusOK, page.ConsoleUsers, data)
+		return
+	}
+
+	data.Q, data.Role, data.Disabled = in.Q, in.Role, c.Query("disabled")
+	users, last := model.ListUsers(in.Filter(), in.After, in.Limit, false)
+	data.Users = make([]api.UserItem, 0, len(users))
+	for _, user := range users {
+		data.Users = append(data.Users, userItem(user))
+	}
+	if len(last) > 0 {
+		query := url.Values{"q": {data.Q}, "role": {data.Role}, "disabled": {data.Disabled}, "cursor": {api.EncodeCursor(last)}}
+		data.Next = api.ConsolePath + "/users?" + query.Encode()
+	}
+
+	renderPage(c, http.StatusOK, page.ConsoleUsers, data)
+}
+
+// @Summary admin console(admin), roles, status and sessions of a user
+// @Tags console
+// @Produce html
+// @Param username path string true "请求参数"
+// @Success 200 {string} string "user"
+// @Success 302 {string} string "not signed in, redirected to login"
+// @Router /admin/console/users/{username} [get]
+func (con *ConsoleController) User(c *gin.Context) {
+	t := consoleSession(c)
+	if t == nil {
+		return
+	}
+	user := consoleUser(c, t)
+	if user == nil {
+		return
+	}
+
+	renderConsoleUser(c, http.StatusOK, t, user, nil)
+}
+
+// @Summary admin console(admin), grants or revokes a role
+// @Tags console
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param username path string true "请求参数"
+// @Param data formData api.ConsoleRole true "请求参数"
+// @Success 303 {string} string "done, redirected to the user"
+// @Router /admin/console/users/{username}/roles [post]
+func (con *ConsoleController) Role(c *gin.Context) {
+	t := consoleSession(c)
+	if t == nil {
+		return
+	}
+	user := consoleUser(c, t)
+	if user == nil {
+		return
+	}
+	var in api.ConsoleRole
+	if err := c.ShouldBind(&in); err != nil {
+		renderConsoleUser(c, http.StatusBadRequest, t, user, err)
+		return
+	}
+	if !t.CheckCSRFToken(in.CSRFToken) {
+		renderConsoleUser(c, http.StatusForbidden, t, user, api.PageFormErr)
+		return
+	}
+	if err := in.Check(); err != nil {
+		renderConsoleUser(c, http.StatusOK, t, user, err)
+		return
+	}
+
+	role := model.GetRole(in.Role)
+	if role == nil {
+		renderConsoleUser(c, http.StatusOK, t, user, model.RoleNotExistErr)
+		return
+	}
+	if in.Action == "add" {
+		if err := user.AddRole(role); err != nil {
+			renderConsoleUser(c, http.StatusOK, t, user, err)
+			return
+		}
+	} else {
+		user.RevokeRole(role)
+	}
+
+	redirectConsoleUser(c, user)
+}
+
+// @Summary admin console(admin), disables or enables a user
+// @Tags console
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param username path string true "请求参数"
+// @Param data formData api.ConsoleStatus true "请求参数"
+// @Success 303 {string} string "done, redirected to the user"
+// @Router /admin/console/users/{username}/status [post]
+func (con *ConsoleController) Status(c *gin.Context) {
+	t := consoleSession(c)
+	if t == nil {
+		return
+	}
+	user := consoleUser(c, t)
+	if user == nil {
+		return
+	}
+	var in api.ConsoleStatus
+	if err := c.ShouldBind(&in); err != nil {
+		renderConsoleUser(c, http.StatusBadRequest, t, user, err)
+		return
+	}
+	if !t.CheckCSRFToken(in.CSRFToken) {
+		renderConsoleUser(c, http.StatusForbidden, t, user, api.PageFormErr)
+		return
+	}
+	if err := in.Check(); err != nil {
+		renderConsoleUser(c, http.StatusOK, t, user, err)
+		return
+	}
+
+	if err := model.SetDisabled(user.Username, in.Action == "disable"); err != nil {
+		renderConsoleUser(c, http.StatusOK, t, user, err)
+		return
+	}
+
+	redirectConsoleUser(c, user)
+}
+
+// @Summary admin console(admin), signs out one or all sessions of a user
+// @Description revokeAll also revokes the user's oauth refresh tokens
+// @Tags console
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param username path string true "请求参数"
+// @Param data formData api.ConsoleSessions true "请求参数"
+// @Success 303 {string} string "done, redirected to the user"
+// @Router /admin/console/users/{username}/sessions [post]
+func (con *ConsoleController) Sessions(c *gin.Context) {
+	t := consoleSession(c)
+	if t == nil {
+		return
+	}
+	user := consoleUser(c, t)
+	if user == nil {
+		return
+	}
+	var in api.ConsoleSessions
+	if err := c.ShouldBind(&in); err != nil {
+		renderConsoleUser(c, http.StatusBadRequest, t, user, err)
+		return
+	}
+	if !t.CheckCSRFToken(in.CSRFToken) {
+		renderConsoleUser(c, http.StatusForbidden, t, user, api.PageFormErr)
+		return
+	}
+	if err := in.Check(); err != nil {
+		renderConsoleUser(c, http.StatusOK, t, user, err)
+		return
+	}
+
+	if in.Action == "revokeAll" {
+		model.RevokeUserTokens(user.Username)
+	} else if err := model.RevokeUserToken(user.Username, in.Session); err != nil {
+		renderConsoleUser(c, http.StatusOK, t, user, err)
+		return
+	}
+	if model.GetToken(t.Token) == nil { // signed out themselves
+		setTokenCookie(c, "", "", -1)
+		c.Redirect(http.StatusSeeOther, "/login?return_to="+url.QueryEscape(api.ConsolePath))
+		return
+	}
+
+	redirectConsoleUser(c, user)
+}
+
+// consoleSession returns the browser session of an admin, otherwise it redirects to login or denies the page.
+func consoleSession(c *gin.Context) *model.Token {
+	if !hostedPages(c, page.ConsoleUsers) {
+		return nil
+	}
+	t := browserSession(c)
+	if t == nil {
+		if c.Request.Method == http.MethodGet {
+			c.Redirect(http.StatusFound, "/login?return_to="+url.QueryEscape(c.Request.URL.RequestURI()))
+		} else {
+			c.Redirect(http.StatusSeeOther, "/login?return_to="+url.QueryEscape(api.ConsolePath))
+		}
+		return nil
+	}
+	if !t.CheckRole(model.AdminRole) {
+		renderPage(c, http.StatusForbidden, page.ConsoleUsers, consoleUsersData{Error: api.ConsoleAdminErr.Error()})
+		return nil
+	}
+
+	return t
+}
+
+// consoleUser returns the user of the path, or renders the search with an error.
+func consoleUser(c *gin.Context, t *model.Token) *model.User {
+	user := model.GetUser(c.Param("username"))
+	if user == nil {
+		renderPage(c, http.StatusNotFound, page.ConsoleUsers, consoleUsersData{
+			Admin:     t.User.Username,
+			Error:     model.UserNotExistErr.Error(),
+			Users:     []api.UserItem{},
+			CSRFToken: t.CSRF(),
+		})
+		return nil
+	}
+
+	return user
+}
+
+func renderConsoleUser(c *gin.Context, status int, t *model.Token, user *model.User, err error) {
+	data := consoleUserData{Admin: t.User.Username, User: userItem(user), CSRFToken: t.CSRF()}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	for _, s := range model.UserTokens(user.Username) {
+		data.Sessions = append(data.Sessions, consoleSessionItem{
+			ID:        s.SessionID(),
+			ClientID:  s.ClientID,
+			CreatedAt: consoleTime(s.CreatedAt),
+			ExpireAt:  consoleTime(s.Expiry()),
+			Scopes:    model.RoleScopeNames(s.Scopes),
+			Current:   s == t,
+		})
+	}
+
+	renderPage(c, status, page.ConsoleUser, data)
+}
+
+// redirectConsoleUser shows the user after a change, reloading the page does not post the form again.
+func redirectConsoleUser(c *gin.Context, user *model.User) {
+	c.Redirect(http.StatusSeeOther, api.ConsolePath+"/users/"+url.PathEscape(user.Username))
+}
+
+func consoleTime(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format("2006-01-02 15:04 UTC")
+}
@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/model"
+	"net/http"
+)
+
+type KeyController struct {
+}
+
+// @Summary list signing keys(admin)
+// @Description the active key first, then retired keys kept until the tokens they signed expire
+// @Tags admin
+// @Produce json
+// @Param token header string true "请求参数"
+// @Success 200 {object} api.Response{data=[]model.SigningKey}
+// @Router /admin/keys [get]
+func (k *KeyController) List(c *gin.Context) {
+	c.JSON(http.StatusOK, api.NewSuccessResponse(model.ListSigningKeys()))
+}
+
+// @Summary activate a new signing key(admin)
+// @Description the previous key is retired, and still verifies tokens it signed
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.RotateKey true "请求参数"
+// @Success 200 {object} api.Response{data=model.SigningKey}
+// @Router /admin/keys/rotate [post]
+func (k *KeyController) Rotate(c *gin.Context) {
+	var in api.RotateKey
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if key, err := model.RotateSigningKey(in.Alg); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(key))
+	}
+}
+
+// @Summary revoke a compromised signing key(admin)
+// @Description the key is removed from jwks at once, a new key is activated when it was the active one
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.RevokeKey true "请求参数"
+// @Success 200 {object} api.Response{}
+// @Router /admin/keys/revoke [post]
+func (k *KeyController) Revoke(c *gin.Context) {
+	var in api.RevokeKey
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := model.RevokeSigningKey(in.Kid); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
+	}
+}
@@ -0,0 +1,776 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/model"
+	"github.com/nieben/auth-service-sample/page"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type OAuthController struct {
+}
+
+var (
+	deviceErrors = map[error]string{
+		model.DevicePendingErr:  api.OAuthAuthorizationPending,
+		model.DeviceSlowDownErr: api.OAuthSlowDown,
+		model.DeviceDeniedErr:   api.OAuthAccessDenied,
+		model.DeviceExpiredErr:  api.OAuthExpiredToken,
+	}
+)
+
+type loginPageData struct {
+	Client    *model.Client
+	Error     string
+	Form      map[string]string // authorization request, posted back with the login
+	Scopes    []string
+	Username  string
+	CSRFToken string // double-submit, see formCSRF
+}
+
+type consentPageData struct {
+	Client    *model.Client
+	Error     string
+	Form      map[string]string // authorization request, posted back with the decision
+	Scopes    []string
+	Username  string
+	CSRFToken string
+}
+
+type devicePageData struct {
+	Client   *model.Client
+	Error    string
+	Message  string // the decision, the form is hidden
+	UserCode string
+	Username string
+}
+
+// @Summary register oauth client(admin)
+// @Tags oauth
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.CreateClient true "请求参数"
+// @Success 200 {object} api.Response{data=api.ClientCreated}
+// @Router /oauth/client/create [post]
+func (o *OAuthController) CreateClient(c *gin.Context) {
+	var in api.CreateClient
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if client, secret, err := model.CreateClient(in.Name, in.RedirectURIs, in.Grants, in.Scopes, in.Public); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(api.ClientCreated{Client: client, ClientSecret: secret}))
+	}
+}
+
+// @Summary delete oauth client and revoke its tokens(admin)
+// @Tags oauth
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.DeleteClient true "请求参数"
+// @Success 200 {object} api.Response{}
+// @Router /oauth/client/delete [post]
+func (o *OAuthController) DeleteClient(c *gin.Context) {
+	var in api.DeleteClient
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := model.DeleteClient(in.ClientID); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
+	}
+}
+
+// @Summary set the session policy of the client's tokens(admin)
+// @Tags oauth
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.SetClientSessionPolicy true "请求参数"
+// @Success 200 {object} api.Response{data=model.Client}
+// @Router /oauth/client/sessionPolicy [post]
+func (o *OAuthController) SetSessionPolicy(c *gin.Context) {
+	var in api.SetClientSessionPolicy
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if client, err := model.SetClientSessionPolicy(in.ClientID, in.Policy()); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(client))
+	}
+}
+
+// @Summary list oauth clients(admin)
+// @Tags oauth
+// @Produce json
+// @Param token header string true "请求参数"
+// @Success 200 {object} api.Response{data=[]model.Client}
+// @Router /oauth/clients [get]
+func (o *OAuthController) ListClients(c *gin.Context) {
+	c.JSON(http.StatusOK, api.NewSuccessResponse(model.ListClients()))
+}
+
+// @Summary authorization endpoint, shows the login form
+// @Description authorization code grant, RFC 6749 4.1, pkce(S256, RFC 7636) required for public clients
+// @Tags oauth
+// @Produce html
+// @Param data query api.OAuthAuthorize true "请求参数"
+// @Success 200 {string} string "login form"
+// @Success 302 {string} string "error redirected to redirect_uri"
+// @Router /oauth/authorize [get]
+func (o *OAuthController) Authorize(c *gin.Context) {
+	var in api.OAuthAuthorize
+	if err := c.ShouldBindQuery(&in); err != nil {
+		renderPage(c, http.StatusBadRequest, page.Authorize, loginPageData{Error: err.Error()})
+		return
+	}
+
+	client, ok := checkAuthorize(c, &in)
+	if !ok {
+		return
+	}
+
+	// signed in already, ask for consent only
+	if t := browserSession(c); t != nil {
+		renderPage(c, http.StatusOK, page.Consent, consentPageData{
+			Client: client, Form: authorizeForm(&in), Scopes: in.Scopes, Username: t.User.Username, CSRFToken: t.CSRF(),
+		})
+		return
+	}
+	renderPage(c, http.StatusOK, page.Authorize, loginPageData{Client: client, Form: authorizeForm(&in), Scopes: in.Scopes, CSRFToken: formCSRF(c)})
+}
+
+// @Summary authorization endpoint, logs in and redirects with the code
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param data formData api.OAuthAuthorize true "请求参数"
+// @Success 302 {string} string "redirected to redirect_uri with code and state"
+// @Router /oauth/authorize [post]
+func (o *OAuthController) Login(c *gin.Context) {
+	var in api.OAuthAuthorize
+	if err := c.ShouldBind(&in); err != nil {
+		renderPage(c, http.StatusBadRequest, page.Authorize, loginPageData{Error: err.Error()})
+		return
+	}
+
+	client, ok := checkAuthorize(c, &in)
+	if !ok {
+		return
+	}
+
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	data := loginPageData{Client: client, Form: authorizeForm(&in), Scopes: in.Scopes, Username: in.Username, CSRFToken: formCSRF(c)}
+	if !checkFormCSRF(c, in.CSRFToken) {
+		data.Error = api.PageFormErr.Error()
+		renderPage(c, http.StatusForbidden, page.Authorize, data)
+		return
+	}
+	user, err := interactiveLogin(in.Username, in.Password, in.Code)
+	if err != nil {
+		data.Error = err.Error()
+		renderPage(c, http.StatusOK, page.Authorize, data)
+		return
+	}
+	if len(model.TokenCookie) > 0 { // signed in to the service too, for the next clients
+		if _, _, err := startSession(c, user, nil); err != nil {
+			c.Error(err)
+		}
+	}
+
+	code, err := model.NewAuthorizationCode(client.ID, user, in.RedirectURI, in.Scopes, in.CodeChallenge, in.Nonce, time.Now().Unix())
+	if err != nil {
+		redirectAuthorize(c, &in, url.Values{"error": {api.OAuthServerError}})
+		return
+	}
+	redirectAuthorize(c, &in, url.Values{"code": {code.Code}})
+}
+
+// @Summary authorization endpoint, the consent of a signed in user
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param data formData api.OAuthAuthorize true "请求参数"
+// @Success 302 {string} string "redirected to redirect_uri with code and state, or access_denied"
+// @Router /oauth/consent [post]
+func (o *OAuthController) Consent(c *gin.Context) {
+	var in api.OAuthAuthorize
+	if err := c.ShouldBind(&in); err != nil {
+		renderPage(c, http.StatusBadRequest, page.Authorize, loginPageData{Error: err.Error()})
+		return
+	}
+
+	client, ok := checkAuthorize(c, &in)
+	if !ok {
+		return
+	}
+
+	t := browserSession(c)
+	if t == nil { // signed out meanwhile
+		renderPage(c, http.StatusOK, page.Authorize, loginPageData{Client: client, Form: authorizeForm(&in), Scopes: in.Scopes, CSRFToken: formCSRF(c)})
+		return
+	}
+	if !t.CheckCSRFToken(in.CSRFToken) {
+		renderPage(c, http.StatusForbidden, page.Consent, consentPageData{
+			Client: client, Form: authorizeForm(&in), Scopes: in.Scopes, Username: t.User.Username, CSRFToken: t.CSRF(), Error: api.PageFormErr.Error(),
+		})
+		return
+	}
+	if in.Action != "approve" {
+		redirectAuthorize(c, &in, url.Values{"error": {api.OAuthAccessDenied}})
+		return
+	}
+
+	code, err := model.NewAuthorizationCode(client.ID, t.User, in.RedirectURI, in.Scopes, in.CodeChallenge, in.Nonce, t.CreatedAt)
+	if err != nil {
+		redirectAuthorize(c, &in, url.Values{"error": {api.OAuthServerError}})
+		return
+	}
+	redirectAuthorize(c, &in, url.Values{"code": {code.Code}})
+}
+
+// @Summary token endpoint
+// @Description grant_type: authorization_code(with code_verifier), client_credentials, refresh_token.
+// @Description clients authenticate with basic auth or client_id and client_secret in the form, public clients with client_id only.
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param data formData api.OAuthTokenRequest true "请求参数"
+// @Success 200 {object} api.OAuthToken
+// @Failure 400 {object} api.OAuthError
+// @Failure 401 {object} api.OAuthError
+// @Router /oauth/token [post]
+func (o *OAuthController) Token(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	var in api.OAuthTokenRequest
+	if err := c.ShouldBind(&in); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidRequest, err))
+		return
+	}
+
+	client, ok := authenticateClient(c, in.ClientID, in.ClientSecret)
+	if !ok {
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		code := api.OAuthInvalidRequest
+		if err == model.ScopeErr {
+			code = api.OAuthInvalidScope
+		}
+		c.JSON(http.StatusBadRequest, api.NewOAuthError(code, err))
+		return
+	}
+	if !containsString(model.Grants, in.GrantType) {
+		c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthUnsupportedGrantType, model.ClientGrantErr))
+		return
+	}
+	if !client.AllowGrant(in.GrantType) {
+		c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthUnauthorizedClient, api.OAuthGrantErr))
+		return
+	}
+
+	switch in.GrantType {
+	case model.GrantAuthorizationCode:
+		code, err := model.RedeemAuthorizationCode(in.Code, client.ID, in.RedirectURI, in.CodeVerifier)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidGrant, err))
+			return
+		}
+		issueOAuthToken(c, client, code.User, code.Scopes, code.Nonce, code.AuthTime)
+	case model.GrantClientCredentials:
+		scopes, err := client.GrantScopes(in.Scopes)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidScope, err))
+			return
+		}
+		issueOAuthToken(c, client, nil, scopes, "", 0)
+	case model.GrantRefreshToken:
+		refresh, err := model.RedeemRefreshToken(in.RefreshToken, client.ID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidGrant, err))
+			return
+		}
+		scopes := refresh.Scopes
+		if len(in.Scopes) > 0 { // narrowing only, role scopes by their current names
+			names := model.RoleScopeNames(refresh.Scopes)
+			scopes = make([]string, 0, len(in.Scopes))
+			for _, s := range in.Scopes {
+				i := indexString(names, s)
+				if i < 0 {
+					c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidScope, model.ScopeNotAllowedErr))
+					return
+				}
+				scopes = append(scopes, refresh.Scopes[i])
+			}
+		}
+		issueOAuthToken(c, client, refresh.User, scopes, "", refresh.AuthTime)
+	case model.GrantDeviceCode:
+		device, err := model.PollDeviceCode(in.DeviceCode, client.ID)
+		if err != nil {
+			code, ok := deviceErrors[err]
+			if !ok {
+				code = api.OAuthInvalidGrant
+			}
+			c.JSON(http.StatusBadRequest, api.NewOAuthError(code, err))
+			return
+		}
+		issueOAuthToken(c, client, device.User, device.Scopes, "", device.AuthTime)
+	}
+}
+
+// @Summary device authorization endpoint, RFC 8628
+// @Description the device shows user_code and verification_uri, then polls /oauth/token with
+// @Description grant_type urn:ietf:params:oauth:grant-type:device_code and device_code, at most every interval seconds.
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param data formData api.OAuthDeviceAuthorization true "请求参数"
+// @Success 200 {object} api.OAuthDeviceCode
+// @Failure 400 {object} api.OAuthError
+// @Failure 401 {object} api.OAuthError
+// @Router /oauth/device_authorization [post]
+func (o *OAuthController) DeviceAuthorization(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	var in api.OAuthDeviceAuthorization
+	if err := c.ShouldBind(&in); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidRequest, err))
+		return
+	}
+
+	client, ok := authenticateClient(c, in.ClientID, in.ClientSecret)
+	if !ok {
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidScope, err))
+		return
+	}
+	if !client.AllowGrant(model.GrantDeviceCode) {
+		c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthUnauthorizedClient, api.OAuthGrantErr))
+		return
+	}
+	scopes, err := client.GrantScopes(in.Scopes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidScope, err))
+		return
+	}
+
+	device, err := model.NewDeviceCode(client.ID, scopes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, api.NewOAuthError(api.OAuthServerError, err))
+		return
+	}
+	userCode := model.FormatUserCode(device.UserCode)
+	uri := BaseURL + "/oauth/device"
+	c.JSON(http.StatusOK, api.OAuthDeviceCode{
+		DeviceCode:              device.DeviceCode,
+		UserCode:                userCode,
+		VerificationURI:         uri,
+		VerificationURIComplete: uri + "?user_code=" + url.QueryEscape(userCode),
+		ExpiresIn:               model.DeviceCodeLifeTime,
+		Interval:                device.Interval,
+	})
+}
+
+// @Summary device verification page, the user enters the user code and logs in
+// @Tags oauth
+// @Produce html
+// @Param data query api.OAuthDevice false "请求参数"
+// @Success 200 {string} string "verification form"
+// @Router /oauth/device [get]
+func (o *OAuthController) DevicePage(c *gin.Context) {
+	var in api.OAuthDevice
+	if err := c.ShouldBindQuery(&in); err != nil {
+		renderPage(c, http.StatusBadRequest, page.Device, devicePageData{Error: err.Error()})
+		return
+	}
+
+	data := devicePageData{UserCode: in.UserCode}
+	if len(in.UserCode) > 0 {
+		if device := model.GetDeviceCodeByUserCode(in.UserCode); device != nil {
+			data.Client = model.GetClient(device.ClientID)
+		} else {
+			data.Error = model.UserCodeErr.Error()
+		}
+	}
+	renderPage(c, http.StatusOK, page.Device, data)
+}
+
+// @Summary device verification page, approves or denies the device
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param data formData api.OAuthDevice true "请求参数"
+// @Success 200 {string} string "result page"
+// @Router /oauth/device [post]
+func (o *OAuthController) DeviceApprove(c *gin.Context) {
+	var in api.OAuthDevice
+	if err := c.ShouldBind(&in); err != nil {
+		renderPage(c, http.StatusBadRequest, page.Device, devicePageData{Error: err.Error()})
+		return
+	}
+
+	in.Username = strings.ToLower(strings.TrimSpace(in.Username))
+	data := devicePageData{UserCode: in.UserCode, Username: in.Username}
+	device := model.GetDeviceCodeByUserCode(in.UserCode)
+	if device == nil {
+		data.Error = model.UserCodeErr.Error()
+		renderPage(c, http.StatusOK, page.Device, data)
+		return
+	}
+	data.Client = model.GetClient(device.ClientID)
+
+	// denying requires the login too, so others can not deny codes
+	user, err := interactiveLogin(in.Username, in.Password, in.Code)
+	if err != nil {
+		data.Error = err.Error()
+		renderPage(c, http.StatusOK, page.Device, data)
+		return
+	}
+
+	approve := in.Action != "deny"
+	if _, err := model.DecideDeviceCode(in.UserCode, user, approve); err != nil {
+		data.Error = err.Error()
+		renderPage(c, http.StatusOK, page.Device, data)
+		return
+	}
+	data.Message = "The device is denied."
+	if approve {
+		data.Message = "The device is connected, you can return to it."
+	}
+	renderPage(c, http.StatusOK, page.Device, data)
+}
+
+// @Summary token introspection for resource servers, RFC 7662
+// @Description confidential clients only, inactive tokens are reported as {"active": false}
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param data formData api.OAuthTokenHint true "请求参数"
+// @Success 200 {object} api.OAuthIntrospection
+// @Failure 401 {object} api.OAuthError
+// @Router /oauth/introspect [post]
+func (o *OAuthController) Introspect(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	var in api.OAuthTokenHint
+	if err := c.ShouldBind(&in); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidRequest, err))
+		return
+	}
+
+	client, ok := authenticateClient(c, in.ClientID, in.ClientSecret)
+	if !ok {
+		return
+	}
+	if client.Public {
+		c.JSON(http.StatusUnauthorized, api.NewOAuthError(api.OAuthInvalidClient, api.OAuthClientAuthErr))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidRequest, err))
+		return
+	}
+
+	for _, kind := range tokenKinds(in.TokenTypeHint) {
+		if out := introspect(kind, in.Token); out.Active {
+			c.JSON(http.StatusOK, out)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, api.OAuthIntrospection{Active: false})
+}
+
+// @Summary revoke an access or refresh token of the client, RFC 7009
+// @Description revoking a refresh token also revokes the access token issued with it, unknown tokens are ignored
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param data formData api.OAuthTokenHint true "请求参数"
+// @Success 200 {string} string ""
+// @Failure 400 {object} api.OAuthError
+// @Failure 401 {object} api.OAuthError
+// @Router /oauth/revoke [post]
+func (o *OAuthController) Revoke(c *gin.Context) {
+	var in api.OAuthTokenHint
+	if err := c.ShouldBind(&in); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidRequest, err))
+		return
+	}
+
+	client, ok := authenticateClient(c, in.ClientID, in.ClientSecret)
+	if !ok {
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidRequest, err))
+		return
+	}
+
+	for _, kind := range tokenKinds(in.TokenTypeHint) {
+		var owner string
+		var revoke func()
+		if kind == api.OAuthAccessToken {
+			if t := model.GetToken(in.Token); t != nil {
+				owner, revoke = t.ClientID, func() { t.Remove() }
+			}
+		} else if r := model.GetRefreshToken(in.Token); r != nil {
+			owner, revoke = r.ClientID, func() { model.RevokeRefreshToken(in.Token) }
+		}
+		if revoke == nil {
+			continue
+		}
+		if owner != client.ID {
+			c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthUnauthorizedClient, api.OAuthTokenOwnerErr))
+			return
+		}
+		revoke()
+		break
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// tokenKinds is the lookup order, the hinted kind first.
+func tokenKinds(hint string) []string {
+	if hint == api.OAuthRefreshToken {
+		return []string{api.OAuthRefreshToken, api.OAuthAccessToken}
+	}
+
+	return []string{api.OAuthAccessToken, api.OAuthRefreshToken}
+}
+
+func introspect(kind, token string) api.OAuthIntrospection {
+	var user *model.User
+	var scopes []string
+	out := api.OAuthIntrospection{Active: true, TokenType: kind, Iss: BaseURL}
+	if kind == api.OAuthAccessToken {
+		t := model.GetToken(token)
+		if t == nil || t.Expiry() < time.Now().Unix() {
+			return api.OAuthIntrospection{}
+		}
+		user, scopes = t.User, t.Scopes
+		out.ClientID, out.Exp, out.Iat = t.ClientID, t.Expiry(), t.CreatedAt
+	} else {
+		r := model.GetRefreshToken(token)
+		if r == nil {
+			return api.OAuthIntrospection{}
+		}
+		user, scopes = r.User, r.Scopes
+		out.ClientID, out.Exp, out.Iat = r.ClientID, r.ExpireAt, r.CreatedAt
+	}
+	out.Scope = strings.Join(model.RoleScopeNames(scopes), " ")
+
+	if user == nil { // client credentials
+		out.Sub = out.ClientID
+		return out
+	}
+	if model.GetUser(user.Username) == nil || user.IsDisabled() {
+		return api.OAuthIntrospection{}
+	}
+	out.Sub, out.Username, out.Roles = user.ID, user.Username, model.ScopeRoles(user.Roles(), scopes)
+
+	return out
+}
+
+// checkAuthorize validates the authorization request, and responds with an error page or redirect.
+func checkAuthorize(c *gin.Context, in *api.OAuthAuthorize) (*model.Client, bool) {
+	client, err := in.CheckClient()
+	if err != nil { // never redirect to an unverified uri
+		renderPage(c, http.StatusBadRequest, page.Authorize, loginPageData{Error: err.Error()})
+		return nil, false
+	}
+	if code, err := in.Check(client); err != nil {
+		redirectAuthorize(c, in, url.Values{"error": {code}, "error_description": {err.Error()}})
+		return nil, false
+	}
+
+	return client, true
+}
+
+func authorizeForm(in *api.OAuthAuthorize) map[string]string {
+	return map[string]string{
+		"response_type":         in.ResponseType,
+		"client_id":             in.ClientID,
+		"redirect_uri":          in.RedirectURI,
+		"scope":                 in.Scope,
+		"state":                 in.State,
+		"code_challenge":        in.CodeChallenge,
+		"code_challenge_method": in.CodeChallengeMethod,
+		"nonce":                 in.Nonce,
+	}
+}
+
+func redirectAuthorize(c *gin.Context, in *api.OAuthAuthorize, params url.Values) {
+	u, _ := url.Parse(in.RedirectURI)
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	if len(in.State) > 0 {
+		query.Set("state", in.State)
+	}
+	u.RawQuery = query.Encode()
+
+	c.Redirect(http.StatusFound, u.String())
+}
+
+// interactiveLogin is the login step of the browser pages, same checks as /auth/token and /auth/mfa.
+func interactiveLogin(username, password, code string) (*model.User, error) {
+	user := model.GetUser(username)
+	if user == nil || !user.CheckPwd(password) {
+		return nil, model.UserCheckErr
+	}
+	if err := user.CanLogin(); err != nil {
+		return nil, err
+	}
+	if user.HasMFA() {
+		code = strings.ToLower(strings.TrimSpace(code))
+		if !user.CheckTOTP(code) && !user.UseRecoveryCode(code) {
+			return nil, model.MFACodeErr
+		}
+	}
+
+	return user, nil
+}
+
+func renderPage(c *gin.Context, status int, name string, data interface{}) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Cache-Control", "no-store")
+	c.Status(status)
+	if err := page.Render(c.Writer, name, data); err != nil {
+		c.Error(err)
+	}
+}
+
+// authenticateClient takes basic auth or form credentials, public clients send client_id only.
+func authenticateClient(c *gin.Context, clientID, clientSecret string) (*model.Client, bool) {
+	id, secret, basic := c.Request.BasicAuth()
+	if basic { // form encoded, RFC 6749 2.3.1
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = clientID, clientSecret
+	}
+
+	client := model.GetClient(id)
+	if client == nil || (client.Public && len(secret) > 0) || (!client.Public && !client.CheckSecret(secret)) {
+		if basic {
+			c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		c.JSON(http.StatusUnauthorized, api.NewOAuthError(api.OAuthInvalidClient, api.OAuthClientAuthErr))
+		return nil, false
+	}
+
+	return client, true
+}
+
+// issueOAuthToken issues an access token, a refresh token for users when the client may refresh,
+// and an id token for users with the openid scope.
+func issueOAuthToken(c *gin.Context, client *model.Client, user *model.User, scopes []string, nonce string, authTime int64) {
+	if user != nil {
+		if model.GetUser(user.Username) == nil {
+			c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidGrant, model.UserNotExistErr))
+			return
+		}
+		if err := user.CanLogin(); err != nil {
+			c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidGrant, err))
+			return
+		}
+		bound, err := user.BindRoleScopes(scopes)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, api.NewOAuthError(api.OAuthInvalidScope, err))
+			return
+		}
+		scopes = bound
+	}
+
+	// the id token first, an access token is not left behind when the response fails
+	idToken := ""
+	if user != nil && containsString(scopes, model.ScopeOpenID) {
+		var err error
+		if idToken, err = signIDToken(user, client.ID, scopes, nonce, authTime); err != nil {
+			c.JSON(http.StatusInternalServerError, api.NewOAuthError(api.OAuthServerError, err))
+			return
+		}
+	}
+
+	t := model.GenerateClientToken(user, client.ID, scopes)
+	out := api.OAuthToken{
+		AccessToken: t.Token,
+		TokenType:   "Bearer",
+		ExpiresIn:   t.ExpireAt - t.CreatedAt,
+		Scope:       strings.Join(model.RoleScopeNames(scopes), " "),
+		IDToken:     idToken,
+	}
+	if user != nil && client.AllowGrant(model.GrantRefreshToken) {
+		refresh, err := model.NewRefreshToken(client.ID, user, scopes, authTime, t.Token)
+		if err != nil {
+			t.Remove()
+			c.JSON(http.StatusInternalServerError, api.NewOAuthError(api.OAuthServerError, err))
+			return
+		}
+		out.RefreshToken = refresh.Token
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// indexString returns the index of s in list, -1 when it is not in.
+func indexString(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
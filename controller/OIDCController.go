@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/model"
+	"net/http"
+	"time"
+)
+
+const (
+	OIDCConfigurationPath = "/.well-known/openid-configuration"
+	JWKSPath              = "/jwks.json"
+	UserinfoPath          = "/userinfo"
+)
+
+var (
+	RolesClaim = "roles" // claim name of the user's roles in id tokens and userinfo
+)
+
+type OIDCController struct {
+}
+
+// @Summary openid connect discovery
+// @Tags oidc
+// @Produce json
+// @Success 200 {object} api.OIDCConfiguration
+// @Router /.well-known/openid-configuration [get]
+func (o *OIDCController) Configuration(c *gin.Context) {
+	c.JSON(http.StatusOK, api.OIDCConfiguration{
+		Issuer:                            BaseURL,
+		AuthorizationEndpoint:             BaseURL + "/oauth/authorize",
+		TokenEndpoint:                     BaseURL + "/oauth/token",
+		UserinfoEndpoint:                  BaseURL + UserinfoPath,
+		IntrospectionEndpoint:             BaseURL + "/oauth/introspect",
+		RevocationEndpoint:                BaseURL + "/oauth/revoke",
+		DeviceAuthorizationEndpoint:       BaseURL + "/oauth/device_authorization",
+		JWKSURI:                           BaseURL + JWKSPath,
+		ScopesSupported:                   model.OIDCScopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               model.Grants,
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  model.SigningAlgs,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{model.PKCEMethodS256},
+		ClaimsSupported: []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce",
+			"preferred_username", "name", "email", "email_verified", RolesClaim},
+	})
+}
+
+// @Summary public keys of id token signatures, the active and the previous key
+// @Tags oidc
+// @Produce json
+// @Success 200 {object} api.JWKS
+// @Router /jwks.json [get]
+func (o *OIDCController) JWKS(c *gin.Context) {
+	if _, err := model.ActiveSigningKey(); err != nil {
+		c.JSON(http.StatusInternalServerError, api.NewOAuthError(api.OAuthServerError, err))
+		return
+	}
+
+	c.JSON(http.StatusOK, api.JWKS{Keys: model.PublicJWKs()})
+}
+
+// @Summary claims of the token's user, requires the openid scope
+// @Tags oidc
+// @Produce json
+// @Param Authorization header string true "Bearer access token"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} api.OAuthError
+// @Failure 403 {object} api.OAuthError
+// @Router /userinfo [get]
+// @Router /userinfo [post]
+func (o *OIDCController) Userinfo(c *gin.Context) {
+	t := c.MustGet("token").(*model.Token)
+	if !containsString(t.Scopes, model.ScopeOpenID) {
+		c.Header("WWW-Authenticate", `Bearer realm="oauth", error="`+api.OAuthInsufficientScope+`"`)
+		c.JSON(http.StatusForbidden, api.NewOAuthError(api.OAuthInsufficientScope, api.OIDCScopeErr))
+		return
+	}
+
+	c.JSON(http.StatusOK, userClaims(t.User, t.Scopes))
+}
+
+// userClaims are the standard claims allowed by the scopes, and the roles.
+func userClaims(user *model.User, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub":                user.ID, // usernames are reused after deletion, ids are not
+		"preferred_username": user.Username,
+		RolesClaim:           model.ScopeRoles(user.Roles(), scopes),
+	}
+	profile := user.GetProfile()
+	if containsString(scopes, model.ScopeProfile) && len(profile.DisplayName) > 0 {
+		claims["name"] = profile.DisplayName
+	}
+	if containsString(scopes, model.ScopeEmail) && len(profile.Email) > 0 {
+		claims["email"] = profile.Email
+		claims["email_verified"] = user.IsEmailVerified()
+	}
+
+	return claims
+}
+
+func signIDToken(user *model.User, clientID string, scopes []string, nonce string, authTime int64) (string, error) {
+	ts := time.Now().Unix()
+	claims := userClaims(user, scopes)
+	claims["iss"] = BaseURL
+	claims["aud"] = clientID
+	claims["iat"] = ts
+	claims["exp"] = ts + model.IDTokenLifeTime()
+	claims["auth_time"] = authTime
+	if len(nonce) > 0 {
+		claims["nonce"] = nonce
+	}
+
+	return model.SignJWT(claims)
+}
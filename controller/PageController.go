@@ -0,0 +1,419 @@
+package controller
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/mail"
+	"github.com/nieben/auth-service-sample/model"
+	"github.com/nieben/auth-service-sample/page"
+	"net/http"
+	"net/url"
+)
+
+const (
+	FormCSRFSize = 32 // random bytes
+)
+
+// PageController serves the hosted pages, they need browser sessions(model.TokenCookie).
+// Forms are protected by the csrf token of the session, or a double-submit cookie before login.
+type PageController struct {
+}
+
+// pageData is shared by the hosted pages.
+type pageData struct {
+	Error      string
+	Message    string // the result, forms are hidden
+	Username   string
+	ReturnTo   string
+	CSRFToken  string
+	MFAToken   string
+	ResetToken string
+}
+
+type accountPageData struct {
+	Username      string
+	Profile       model.Profile
+	EmailVerified bool
+	Roles         []string
+	MFAEnabled    bool
+	CSRFToken     string
+}
+
+// @Summary hosted login page
+// @Tags page
+// @Produce html
+// @Param return_to query string false "path to return to after login"
+// @Success 200 {string} string "login form"
+// @Success 302 {string} string "signed in already"
+// @Router /login [get]
+func (p *PageController) LoginPage(c *gin.Context) {
+	if !hostedPages(c, page.Login) {
+		return
+	}
+	returnTo := api.ReturnTo(c.Query("return_to"))
+	if browserSession(c) != nil {
+		c.Redirect(http.StatusFound, returnTo)
+		return
+	}
+
+	renderPage(c, http.StatusOK, page.Login, pageData{ReturnTo: returnTo, CSRFToken: formCSRF(c)})
+}
+
+// @Summary hosted login page, signs in and redirects, or asks for the mfa code
+// @Tags page
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param data formData api.PageLogin true "请求参数"
+// @Success 303 {string} string "signed in, redirected to return_to"
+// @Success 200 {string} string "mfa prompt or login errors"
+// @Router /login [post]
+func (p *PageController) Login(c *gin.Context) {
+	if !hostedPages(c, page.Login) {
+		return
+	}
+	var in api.PageLogin
+	if err := c.ShouldBind(&in); err != nil {
+		renderPage(c, http.StatusBadRequest, page.Login, pageData{Error: err.Error(), CSRFToken: formCSRF(c)})
+		return
+	}
+
+	err := in.Check()
+	data := pageData{Username: in.Username, ReturnTo: in.ReturnTo, CSRFToken: formCSRF(c)}
+	if !checkFormCSRF(c, in.CSRFToken) {
+		data.Error = api.PageFormErr.Error()
+		renderPage(c, http.StatusForbidden, page.Login, data)
+		return
+	}
+	if err != nil {
+		data.Error = err.Error()
+		renderPage(c, http.StatusOK, page.Login, data)
+		return
+	}
+
+	user := model.GetUser(in.Username)
+	if user == nil || !user.CheckPwd(in.Password) {
+		data.Error = model.UserCheckErr.Error()
+		renderPage(c, http.StatusOK, page.Login, data)
+		return
+	}
+	if err := user.CanLogin(); err != nil {
+		data.Error = err.Error()
+		renderPage(c, http.StatusOK, page.Login, data)
+		return
+	}
+
+	// second step, see MFA
+	if user.HasMFA() {
+		challenge, err := model.NewMFAChallenge(user, nil)
+		if err != nil {
+			data.Error = err.Error()
+			renderPage(c, http.StatusOK, page.Login, data)
+			return
+		}
+		data.MFAToken = challenge.Token
+		renderPage(c, http.StatusOK, page.MFA, data)
+		return
+	}
+
+	signIn(c, user, data)
+}
+
+// @Summary hosted mfa prompt, signs in with the totp or recovery code
+// @Tags page
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param data formData api.PageMFA true "请求参数"
+// @Success 303 {string} string "signed in, redirected to return_to"
+// @Router /login/mfa [post]
+func (p *PageController) MFA(c *gin.Context) {
+	if !hostedPages(c, page.Login) {
+		return
+	}
+	var in api.PageMFA
+	if err := c.ShouldBind(&in); err != nil {
+		renderPage(c, http.StatusBadRequest, page.Login, pageData{Error: err.Error(), CSRFToken: formCSRF(c)})
+		return
+	}
+
+	data := pageData{ReturnTo: api.ReturnTo(in.ReturnTo), CSRFToken: formCSRF(c)}
+	if err := in.Check(); err != nil {
+		data.Error = err.Error()
+		renderPage(c, http.StatusOK, page.Login, data)
+		return
+	}
+	if !checkFormCSRF(c, in.CSRFToken) {
+		data.Error = api.PageFormErr.Error()
+		renderPage(c, http.StatusForbidden, page.Login, data)
+		return
+	}
+
+	challenge, err := model.GetMFAChallenge(in.MFAToken)
+	if err == nil && model.GetUser(challenge.User.Username) == nil {
+		err = model.MFAChallengeErr
+	}
+	if err != nil {
+		data.Error = err.Error()
+		renderPage(c, http.StatusOK, page.Login, data)
+		return
+	}
+	if !challenge.User.CheckTOTP(in.Code) && !challenge.User.UseRecoveryCode(in.Code) {
+		data.Error, data.MFAToken = model.MFACodeErr.Error(), in.MFAToken
+		renderPage(c, http.StatusOK, page.MFA, data)
+		return
+	}
+
+	challenge.Remove()
+	data.Username = challenge.User.Username
+	signIn(c, challenge.User, data)
+}
+
+// @Summary hosted logout page, asks to confirm
+// @Tags page
+// @Produce html
+// @Success 200 {string} string "logout form"
+// @Router /logout [get]
+func (p *PageController) LogoutPage(c *gin.Context) {
+	if !hostedPages(c, page.Logout) {
+		return
+	}
+	t := browserSession(c)
+	if t == nil {
+		renderPage(c, http.StatusOK, page.Logout, pageData{Message: "You are signed out."})
+		return
+	}
+
+	renderPage(c, http.StatusOK, page.Logout, pageData{Username: t.User.Username, CSRFToken: t.CSRF()})
+}
+
+// @Summary hosted logout page, clears the cookies and revokes the session
+// @Tags page
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param csrf_token formData string true "请求参数"
+// @Success 200 {string} string "signed out"
+// @Router /logout [post]
+func (p *PageController) Logout(c *gin.Context) {
+	if !hostedPages(c, page.Logout) {
+		return
+	}
+	t := browserSession(c)
+	if t == nil {
+		setTokenCookie(c, "", "", -1)
+		renderPage(c, http.StatusOK, page.Logout, pageData{Message: "You are signed out."})
+		return
+	}
+	if !t.CheckCSRFToken(c.PostForm("csrf_token")) {
+		renderPage(c, http.StatusForbidden, page.Logout, pageData{Error: api.PageFormErr.Error(), Username: t.User.Username, CSRFToken: t.CSRF()})
+		return
+	}
+
+	t.Remove()
+	setTokenCookie(c, "", "", -1)
+	renderPage(c, http.StatusOK, page.Logout, pageData{Message: "You are signed out."})
+}
+
+// @Summary hosted account page
+// @Tags page
+// @Produce html
+// @Success 200 {string} string "account"
+// @Success 302 {string} string "not signed in, redirected to login"
+// @Router /account [get]
+func (p *PageController) Account(c *gin.Context) {
+	if !hostedPages(c, page.Account) {
+		return
+	}
+	t := browserSession(c)
+	if t == nil {
+		c.Redirect(http.StatusFound, "/login?return_to="+url.QueryEscape(c.Request.URL.RequestURI()))
+		return
+	}
+
+	renderPage(c, http.StatusOK, page.Account, accountPageData{
+		Username:      t.User.Username,
+		Profile:       t.User.GetProfile(),
+		EmailVerified: t.User.IsEmailVerified(),
+		Roles:         t.Roles(),
+		MFAEnabled:    t.User.HasMFA(),
+		CSRFToken:     t.CSRF(),
+	})
+}
+
+// @Summary hosted password reset page, asks for the username
+// @Tags page
+// @Produce html
+// @Success 200 {string} string "form"
+// @Router /password/forgot [get]
+func (p *PageController) ForgotPage(c *gin.Context) {
+	if !hostedPages(c, page.Forgot) {
+		return
+	}
+
+	renderPage(c, http.StatusOK, page.Forgot, pageData{CSRFToken: formCSRF(c)})
+}
+
+// @Summary hosted password reset page, mails a reset link to the verified email
+// @Description the result is the same whether the account exists or not
+// @Tags page
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param data formData api.PageForgot true "请求参数"
+// @Success 200 {string} string "result"
+// @Router /password/forgot [post]
+func (p *PageController) Forgot(c *gin.Context) {
+	if !hostedPages(c, page.Forgot) {
+		return
+	}
+	var in api.PageForgot
+	if err := c.ShouldBind(&in); err != nil {
+		renderPage(c, http.StatusBadRequest, page.Forgot, pageData{Error: err.Error(), CSRFToken: formCSRF(c)})
+		return
+	}
+
+	data := pageData{Username: in.Username, CSRFToken: formCSRF(c)}
+	if !checkFormCSRF(c, in.CSRFToken) {
+		data.Error = api.PageFormErr.Error()
+		renderPage(c, http.StatusForbidden, page.Forgot, data)
+		return
+	}
+	if err := in.Check(); err != nil {
+		data.Error = err.Error()
+		renderPage(c, http.StatusOK, page.Forgot, data)
+		return
+	}
+
+	// errors are not shown, they would tell which accounts exist
+	if user := model.GetUser(in.Username); user != nil {
+		if err := sendPasswordReset(user); err != nil {
+			c.Error(err)
+		}
+	}
+	data.Message = "If the account has a verified email, a link to reset the password has been sent to it."
+	renderPage(c, http.StatusOK, page.Forgot, data)
+}
+
+// @Summary hosted password reset page, the link in the mail
+// @Tags page
+// @Produce html
+// @Param token query string true "请求参数"
+// @Success 200 {string} string "new password form"
+// @Router /password/reset [get]
+func (p *PageController) ResetPage(c *gin.Context) {
+	if !hostedPages(c, page.Reset) {
+		return
+	}
+	token := c.Query("token")
+	if _, err := model.CheckPasswordResetToken(token); err != nil {
+		renderPage(c, http.StatusOK, page.Reset, pageData{Error: err.Error()})
+		return
+	}
+
+	renderPage(c, http.StatusOK, page.Reset, pageData{ResetToken: token, CSRFToken: formCSRF(c)})
+}
+
+// @Summary hosted password reset page, sets the password and ends all sessions of the user
+// @Tags page
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param data formData api.PageReset true "请求参数"
+// @Success 200 {string} string "result"
+// @Router /password/reset [post]
+func (p *PageController) Reset(c *gin.Context) {
+	if !hostedPages(c, page.Reset) {
+		return
+	}
+	var in api.PageReset
+	if err := c.ShouldBind(&in); err != nil {
+		renderPage(c, http.StatusBadRequest, page.Reset, pageData{Error: err.Error()})
+		return
+	}
+
+	data := pageData{ResetToken: in.Token, CSRFToken: formCSRF(c)}
+	if !checkFormCSRF(c, in.CSRFToken) {
+		data.Error = api.PageFormErr.Error()
+		renderPage(c, http.StatusForbidden, page.Reset, data)
+		return
+	}
+	if err := in.Check(); err != nil {
+		data.Error = err.Error()
+		renderPage(c, http.StatusOK, page.Reset, data)
+		return
+	}
+	if _, err := model.ResetPassword(in.Token, in.Password); err != nil {
+		data.Error = err.Error()
+		if err == model.ResetTokenErr {
+			data.ResetToken = ""
+		}
+		renderPage(c, http.StatusOK, page.Reset, data)
+		return
+	}
+
+	setTokenCookie(c, "", "", -1)
+	renderPage(c, http.StatusOK, page.Reset, pageData{Message: "Your password has been changed, all sessions have been signed out."})
+}
+
+// hostedPages renders the page with an error when browser sessions are disabled.
+func hostedPages(c *gin.Context, name string) bool {
+	if len(model.TokenCookie) == 0 {
+		renderPage(c, http.StatusNotFound, name, pageData{Error: api.PageSessionErr.Error()})
+		return false
+	}
+
+	return true
+}
+
+// signIn starts the browser session and returns to the page the user came from.
+func signIn(c *gin.Context, user *model.User, data pageData) {
+	if _, _, err := startSession(c, user, nil); err != nil {
+		data.Error = err.Error()
+		renderPage(c, http.StatusOK, page.Login, data)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, data.ReturnTo)
+}
+
+// formCSRF returns the csrf cookie, set to a new random value when there is none, for the forms before login.
+func formCSRF(c *gin.Context) string {
+	if csrf, err := c.Cookie(model.TokenCookie + CSRFCookieSuffix); err == nil && len(csrf) > 0 {
+		return csrf
+	}
+
+	b := make([]byte, FormCSRFSize)
+	if _, err := rand.Read(b); err != nil {
+		c.Error(err)
+		return ""
+	}
+	csrf := base64.RawURLEncoding.EncodeToString(b)
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(model.TokenCookie+CSRFCookieSuffix, csrf, 0, "/", "", true, false)
+
+	return csrf
+}
+
+// checkFormCSRF compares the form field with the cookie, double-submit.
+func checkFormCSRF(c *gin.Context, csrf string) bool {
+	cookie, err := c.Cookie(model.TokenCookie + CSRFCookieSuffix)
+	return err == nil && len(cookie) > 0 && subtle.ConstantTimeCompare([]byte(cookie), []byte(csrf)) == 1
+}
+
+func sendPasswordReset(user *model.User) error {
+	if mail.Default == nil {
+		return mail.DisabledErr
+	}
+	token, err := user.PasswordResetToken()
+	if err != nil {
+		return err
+	}
+	if err := user.AllowResetMail(); err != nil {
+		return err
+	}
+
+	link := BaseURL + "/password/reset?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hi %s,\n\nOpen the link below to choose a new password, it expires in %d minutes.\n"+
+		"If you did not ask for it, you can ignore this mail.\n\n%s\n", user.Username, model.PasswordResetLifeTime/60, link)
+	return mail.Default.Send(user.GetProfile().Email, "Reset your password", body)
+}
@@ -10,10 +10,11 @@ import (
 type RoleController struct {
 }
 
-// @Summary create role
+// @Summary create role(admin)
 // @Tags role
 // @Accept json
 // @Produce json
+// @Param token header string true "请求参数"
 // @Param data body api.CreateRole true "请求参数"
 // @Success 200 {object} api.Response{}
 // @Router /role/create [post]
@@ -29,17 +30,18 @@ func (r *RoleController) Create(c *gin.Context) {
 		return
 	}
 
-	if err := model.CreateRole(in.Role); err != nil {
+	if err := model.CreateRole(in.Role, in.Description, in.Metadata); err != nil {
 		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
 	} else {
 		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
 	}
 }
 
-// @Summary delete role
+// @Summary delete role(admin)
 // @Tags role
 // @Accept json
 // @Produce json
+// @Param token header string true "请求参数"
 // @Param data body api.DeleteRole true "请求参数"
 // @Success 200 {object} api.Response{}
 // @Router /role/delete [post]
@@ -61,3 +63,179 @@ func (r *RoleController) Delete(c *gin.Context) {
 		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
 	}
 }
+
+// @Summary rename role or update description(admin)
+// @Tags role
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.UpdateRole true "请求参数"
+// @Success 200 {object} api.Response{data=api.RoleItem}
+// @Router /role/update [post]
+func (r *RoleController) Update(c *gin.Context) {
+	var in api.UpdateRole
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if role, err := model.UpdateRole(in.Role, in.Name, in.Description); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(roleItem(role)))
+	}
+}
+
+// @Summary set the session policy of tokens with the role(admin)
+// @Tags role
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.SetRoleSessionPolicy true "请求参数"
+// @Success 200 {object} api.Response{data=api.RoleItem}
+// @Router /role/sessionPolicy [post]
+func (r *RoleController) SetSessionPolicy(c *gin.Context) {
+	var in api.SetRoleSessionPolicy
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if role, err := model.SetRoleSessionPolicy(in.Role, in.Policy()); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(roleItem(role)))
+	}
+}
+
+// @Summary list roles(admin)
+// @Tags role
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data query api.ListPage false "请求参数"
+// @Success 200 {object} api.Response{data=api.RoleList}
+// @Router /roles [get]
+func (r *RoleController) List(c *gin.Context) {
+	var in api.ListPage
+	if err := c.ShouldBindQuery(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	roles, last := model.ListRoles(in.After, in.Limit)
+	list := api.RoleList{Roles: make([]api.RoleItem, 0, len(roles))}
+	for _, role := range roles {
+		list.Roles = append(list.Roles, roleItem(role))
+	}
+	if len(last) > 0 {
+		list.Next = api.EncodeCursor(last)
+	}
+
+	c.JSON(http.StatusOK, api.NewSuccessResponse(list))
+}
+
+// @Summary role detail(admin)
+// @Tags role
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param name path string true "role name"
+// @Success 200 {object} api.Response{data=api.RoleItem}
+// @Router /roles/{name} [get]
+func (r *RoleController) Get(c *gin.Context) {
+	var in api.RoleName
+	if err := c.ShouldBindUri(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	role := model.GetRole(in.Role)
+	if role == nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(model.RoleNotExistErr, nil))
+		return
+	}
+
+	c.JSON(http.StatusOK, api.NewSuccessResponse(roleItem(role)))
+}
+
+// @Summary users holding the role(admin)
+// @Tags role
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param name path string true "role name"
+// @Param data query api.ListPage false "请求参数"
+// @Success 200 {object} api.Response{data=api.UserList}
+// @Router /roles/{name}/members [get]
+func (r *RoleController) Members(c *gin.Context) {
+	var name api.RoleName
+	if err := c.ShouldBindUri(&name); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	var in api.ListPage
+	if err := c.ShouldBindQuery(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := name.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if model.GetRole(name.Role) == nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(model.RoleNotExistErr, nil))
+		return
+	}
+
+	users, last := model.ListUsers(model.UserFilter{Role: name.Role}, in.After, in.Limit, false)
+	list := api.UserList{Users: make([]api.UserItem, 0, len(users))}
+	for _, user := range users {
+		list.Users = append(list.Users, userItem(user))
+	}
+	if len(last) > 0 {
+		list.Next = api.EncodeCursor(last)
+	}
+
+	c.JSON(http.StatusOK, api.NewSuccessResponse(list))
+}
+
+func roleItem(role *model.Role) api.RoleItem {
+	metadata := make(map[string]string, len(role.Metadata))
+	for k, v := range role.Metadata {
+		metadata[k] = v
+	}
+	return api.RoleItem{
+		ID:          role.ID,
+		Name:        role.Name,
+		Description: role.Description,
+		Metadata:    metadata,
+		CreatedAt:   role.CreatedAt,
+		Session:     role.Session,
+	}
+}
@@ -0,0 +1,646 @@
+package controller
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/model"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type SCIMController struct {
+}
+
+const (
+	SCIMPath = "/scim/v2"
+)
+
+// @Summary scim service provider config
+// @Tags scim
+// @Produce json
+// @Param Authorization header string true "Bearer <token>"
+// @Success 200 {object} api.SCIMServiceProviderConfig
+// @Router /scim/v2/ServiceProviderConfig [get]
+func (s *SCIMController) ServiceProviderConfig(c *gin.Context) {
+	scimJSON(c, http.StatusOK, api.SCIMServiceProviderConfig{
+		Schemas: []string{api.SCIMConfigSchema},
+		Patch:   api.SCIMSupported{Supported: true},
+		Filter:  api.SCIMFilterConfig{Supported: true, MaxResults: api.SCIMMaxCount},
+		AuthenticationSchemes: []api.SCIMAuthScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "Bearer token",
+			Description: "token of the provisioning client",
+		}},
+	})
+}
+
+// @Summary list scim users
+// @Description filter: userName eq "<username>" or externalId eq "<id>"
+// @Tags scim
+// @Produce json
+// @Param Authorization header string true "Bearer <token>"
+// @Param data query api.SCIMQuery false "请求参数"
+// @Success 200 {object} api.SCIMList{Resources=[]api.SCIMUser}
+// @Router /scim/v2/Users [get]
+func (s *SCIMController) ListUsers(c *gin.Context) {
+	var in api.SCIMQuery
+	if err := c.ShouldBindQuery(&in); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		scimError(c, err)
+		return
+	}
+
+	var users []*model.User
+	total := 0
+	switch in.FilterAttr {
+	case "":
+		users, total = model.UsersPage(in.StartIndex-1, *in.Count)
+	case "username":
+		if u := model.GetUser(strings.ToLower(in.FilterValue)); u != nil {
+			users = []*model.User{u}
+		}
+		users, total = scimPage(users, in.StartIndex, *in.Count)
+	case "externalid":
+		users, total = scimPage(model.FindUsersByExternalID(in.FilterValue), in.StartIndex, *in.Count)
+	default:
+		scimError(c, api.SCIMFilterErr)
+		return
+	}
+
+	list := scimList(total, in.StartIndex)
+	for _, u := range users {
+		list.Resources = append(list.Resources, scimUser(u))
+	}
+	list.ItemsPerPage = len(list.Resources)
+	scimJSON(c, http.StatusOK, list)
+}
+
+// @Summary create scim user
+// @Description users without password can not login with password
+// @Tags scim
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer <token>"
+// @Param data body api.SCIMUser true "请求参数"
+// @Success 201 {object} api.SCIMUser
+// @Router /scim/v2/Users [post]
+func (s *SCIMController) CreateUser(c *gin.Context) {
+	var in api.SCIMUser
+	if err := c.ShouldBindJSON(&in); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		scimError(c, err)
+		return
+	}
+
+	user, err := model.ProvisionUser(in.UserName, userChanges(&in))
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+
+	c.Header("Location", scimLocation("Users", user.Username))
+	scimJSON(c, http.StatusCreated, scimUser(user))
+}
+
+// @Summary get scim user
+// @Tags scim
+// @Produce json
+// @Param Authorization header string true "Bearer <token>"
+// @Param id path string true "username"
+// @Success 200 {object} api.SCIMUser
+// @Router /scim/v2/Users/{id} [get]
+func (s *SCIMController) GetUser(c *gin.Context) {
+	user := model.GetUser(strings.ToLower(c.Param("id")))
+	if user == nil {
+		scimError(c, model.UserNotExistErr)
+		return
+	}
+
+	scimJSON(c, http.StatusOK, scimUser(user))
+}
+
+// @Summary replace scim user
+// @Description userName is immutable, password is kept when not set
+// @Tags scim
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer <token>"
+// @Param id path string true "username"
+// @Param data body api.SCIMUser true "请求参数"
+// @Success 200 {object} api.SCIMUser
+// @Router /scim/v2/Users/{id} [put]
+func (s *SCIMController) ReplaceUser(c *gin.Context) {
+	var in api.SCIMUser
+	if err := c.ShouldBindJSON(&in); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		scimError(c, err)
+		return
+	}
+
+	user := model.GetUser(strings.ToLower(c.Param("id")))
+	if user == nil {
+		scimError(c, model.UserNotExistErr)
+		return
+	}
+	if in.UserName != user.Username {
+		scimError(c, api.SCIMMutabilityErr)
+		return
+	}
+	changes := userChanges(&in)
+	if changes.Password != nil && user.CheckRole(model.AdminRole) {
+		scimError(c, api.SCIMAdminErr)
+		return
+	}
+	if err := user.Provision(changes); err != nil {
+		scimError(c, err)
+		return
+	}
+
+	scimJSON(c, http.StatusOK, scimUser(user))
+}
+
+// @Summary patch scim user
+// @Tags scim
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer <token>"
+// @Param id path string true "username"
+// @Param data body api.SCIMPatch true "请求参数"
+// @Success 200 {object} api.SCIMUser
+// @Router /scim/v2/Users/{id} [patch]
+func (s *SCIMController) PatchUser(c *gin.Context) {
+	var in api.SCIMPatch
+	if err := c.ShouldBindJSON(&in); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		scimError(c, err)
+		return
+	}
+
+	user := model.GetUser(strings.ToLower(c.Param("id")))
+	if user == nil {
+		scimError(c, model.UserNotExistErr)
+		return
+	}
+	changes, err := in.UserChanges(user.Username)
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+	if changes.Password != nil && user.CheckRole(model.AdminRole) {
+		scimError(c, api.SCIMAdminErr)
+		return
+	}
+
+	var disabled *bool
+	if changes.Active != nil {
+		d := !*changes.Active
+		disabled = &d
+	}
+	if err := user.Provision(model.UserChanges{
+		Password:    changes.Password,
+		Email:       changes.Email,
+		DisplayName: changes.DisplayName,
+		Department:  changes.Department,
+		ExternalID:  changes.ExternalID,
+		Disabled:    disabled,
+	}); err != nil {
+		scimError(c, err)
+		return
+	}
+
+	scimJSON(c, http.StatusOK, scimUser(user))
+}
+
+// @Summary delete scim user
+// @Tags scim
+// @Param Authorization header string true "Bearer <token>"
+// @Param id path string true "username"
+// @Success 204
+// @Router /scim/v2/Users/{id} [delete]
+func (s *SCIMController) DeleteUser(c *gin.Context) {
+	if err := model.DeleteUser(strings.ToLower(c.Param("id"))); err != nil {
+		scimError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary list scim groups
+// @Description filter: displayName eq "<role>"
+// @Tags scim
+// @Produce json
+// @Param Authorization header string true "Bearer <token>"
+// @Param data query api.SCIMQuery false "请求参数"
+// @Success 200 {object} api.SCIMList{Resources=[]api.SCIMGroup}
+// @Router /scim/v2/Groups [get]
+func (s *SCIMController) ListGroups(c *gin.Context) {
+	var in api.SCIMQuery
+	if err := c.ShouldBindQuery(&in); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		scimError(c, err)
+		return
+	}
+
+	var roles []*model.Role
+	total := 0
+	switch in.FilterAttr {
+	case "":
+		roles, total = model.RolesPage(in.StartIndex-1, *in.Count)
+	case "displayname":
+		if r := model.GetRole(strings.ToLower(in.FilterValue)); r != nil {
+			roles = []*model.Role{r}
+		}
+		roles, total = scimPage(roles, in.StartIndex, *in.Count)
+	default:
+		scimError(c, api.SCIMFilterErr)
+		return
+	}
+
+	list := scimList(total, in.StartIndex)
+	for _, r := range roles {
+		list.Resources = append(list.Resources, scimGroup(r))
+	}
+	list.ItemsPerPage = len(list.Resources)
+	scimJSON(c, http.StatusOK, list)
+}
+
+// @Summary create scim group
+// @Tags scim
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer <token>"
+// @Param data body api.SCIMGroup true "请求参数"
+// @Success 201 {object} api.SCIMGroup
+// @Router /scim/v2/Groups [post]
+func (s *SCIMController) CreateGroup(c *gin.Context) {
+	var in api.SCIMGroup
+	if err := c.ShouldBindJSON(&in); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		scimError(c, err)
+		return
+	}
+
+	if in.DisplayName == model.AdminRole {
+		scimError(c, api.SCIMAdminErr)
+		return
+	}
+	members, err := memberUsers(in.Usernames())
+	if err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidValue", err)
+		return
+	}
+	if err := model.CreateRole(in.DisplayName, "", nil); err != nil {
+		scimError(c, err)
+		return
+	}
+	role := model.GetRole(in.DisplayName)
+	for _, u := range members {
+		u.AddRole(role)
+	}
+
+	c.Header("Location", scimLocation("Groups", role.ID))
+	scimJSON(c, http.StatusCreated, scimGroup(role))
+}
+
+// @Summary get scim group
+// @Tags scim
+// @Produce json
+// @Param Authorization header string true "Bearer <token>"
+// @Param id path string true "role id"
+// @Success 200 {object} api.SCIMGroup
+// @Router /scim/v2/Groups/{id} [get]
+func (s *SCIMController) GetGroup(c *gin.Context) {
+	role := model.GetRoleByID(c.Param("id"))
+	if role == nil {
+		scimError(c, model.RoleNotExistErr)
+		return
+	}
+
+	scimJSON(c, http.StatusOK, scimGroup(role))
+}
+
+// @Summary replace scim group
+// @Description renames the role and replaces its members
+// @Tags scim
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer <token>"
+// @Param id path string true "role id"
+// @Param data body api.SCIMGroup true "请求参数"
+// @Success 200 {object} api.SCIMGroup
+// @Router /scim/v2/Groups/{id} [put]
+func (s *SCIMController) ReplaceGroup(c *gin.Context) {
+	var in api.SCIMGroup
+	if err := c.ShouldBindJSON(&in); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		scimError(c, err)
+		return
+	}
+
+	role := model.GetRoleByID(c.Param("id"))
+	if role == nil {
+		scimError(c, model.RoleNotExistErr)
+		return
+	}
+	role, err := updateGroup(role, &in.DisplayName, true, in.Usernames(), nil)
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+
+	scimJSON(c, http.StatusOK, scimGroup(role))
+}
+
+// @Summary patch scim group
+// @Description add, remove or replace members, replace displayName
+// @Tags scim
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer <token>"
+// @Param id path string true "role id"
+// @Param data body api.SCIMPatch true "请求参数"
+// @Success 200 {object} api.SCIMGroup
+// @Router /scim/v2/Groups/{id} [patch]
+func (s *SCIMController) PatchGroup(c *gin.Context) {
+	var in api.SCIMPatch
+	if err := c.ShouldBindJSON(&in); err != nil {
+		scimFail(c, http.StatusBadRequest, "invalidSyntax", err)
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		scimError(c, err)
+		return
+	}
+
+	role := model.GetRoleByID(c.Param("id"))
+	if role == nil {
+		scimError(c, model.RoleNotExistErr)
+		return
+	}
+	changes, err := in.GroupChanges()
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+	role, err = updateGroup(role, changes.DisplayName, changes.Replace, changes.Add, changes.Remove)
+	if err != nil {
+		scimError(c, err)
+		return
+	}
+
+	scimJSON(c, http.StatusOK, scimGroup(role))
+}
+
+// @Summary delete scim group
+// @Description deletes the role and its grants
+// @Tags scim
+// @Param Authorization header string true "Bearer <token>"
+// @Param id path string true "role id"
+// @Success 204
+// @Router /scim/v2/Groups/{id} [delete]
+func (s *SCIMController) DeleteGroup(c *gin.Context) {
+	role := model.GetRoleByID(c.Param("id"))
+	if role == nil {
+		scimError(c, model.RoleNotExistErr)
+		return
+	}
+	if role.Name == model.AdminRole {
+		scimError(c, api.SCIMAdminErr)
+		return
+	}
+	if err := model.DeleteRole(role.Name); err != nil {
+		scimError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// userChanges sets all mutable attributes, absent active means active, the password is kept when not set.
+func userChanges(in *api.SCIMUser) model.UserChanges {
+	email, disabled := in.Email(), in.Active != nil && !*in.Active
+	changes := model.UserChanges{
+		Email:       &email,
+		DisplayName: &in.DisplayName,
+		Department:  &in.Enterprise.Department,
+		ExternalID:  &in.ExternalID,
+		Disabled:    &disabled,
+	}
+	if len(in.Password) > 0 {
+		changes.Password = &in.Password
+	}
+
+	return changes
+}
+
+// updateGroup renames the role when name is set, and adds or removes members,
+// with replace the members are exactly add without remove. The admin role is not managed by scim.
+func updateGroup(role *model.Role, name *string, replace bool, add, remove []string) (*model.Role, error) {
+	if role.Name == model.AdminRole || name != nil && *name == model.AdminRole {
+		return nil, api.SCIMAdminErr
+	}
+	added, err := memberUsers(add)
+	if err != nil {
+		return nil, err
+	}
+	if name != nil && *name != role.Name {
+		if role, err = model.UpdateRole(role.Name, name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	removed := make(map[string]struct{}, len(remove))
+	for _, username := range remove {
+		removed[username] = struct{}{}
+	}
+	if replace {
+		keep := make(map[string]struct{}, len(add))
+		for _, username := range add {
+			keep[username] = struct{}{}
+		}
+		for _, username := range model.RoleMembers(role.Name) {
+			if _, ok := keep[username]; !ok {
+				removed[username] = struct{}{}
+			}
+		}
+	}
+
+	for _, u := range added {
+		if _, ok := removed[u.Username]; !ok {
+			if err := u.AddRole(role); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for username := range removed {
+		if u := model.GetUser(username); u != nil {
+			u.RevokeRole(role)
+		}
+	}
+
+	return role, nil
+}
+
+// memberUsers looks up users referenced as group members.
+func memberUsers(usernames []string) ([]*model.User, error) {
+	users := make([]*model.User, 0, len(usernames))
+	for _, username := range usernames {
+		u := model.GetUser(username)
+		if u == nil {
+			return nil, model.UserNotExistErr
+		}
+		users = append(users, u)
+	}
+
+	return users, nil
+}
+
+func scimUser(user *model.User) api.SCIMUser {
+	profile := user.GetProfile()
+	active := !user.IsDisabled()
+	u := api.SCIMUser{
+		Schemas:     []string{api.SCIMUserSchema},
+		ID:          user.Username,
+		ExternalID:  user.GetExternalID(),
+		UserName:    user.Username,
+		DisplayName: profile.DisplayName,
+		Active:      &active,
+		Groups:      make([]api.SCIMMember, 0),
+		Meta: &api.SCIMMeta{
+			ResourceType: "User",
+			Created:      time.Unix(user.CreatedAt, 0).UTC().Format(time.RFC3339),
+			Location:     scimLocation("Users", user.Username),
+		},
+	}
+	if len(profile.DisplayName) > 0 {
+		u.Name = &api.SCIMName{Formatted: profile.DisplayName}
+	}
+	if len(profile.Email) > 0 {
+		u.Emails = []api.SCIMEmail{{Value: profile.Email, Type: "work", Primary: true}}
+	}
+	if len(profile.Department) > 0 {
+		u.Schemas = append(u.Schemas, api.SCIMEnterpriseSchema)
+		u.Enterprise = &api.SCIMEnterprise{Department: profile.Department}
+	}
+	for _, name := range user.Roles() {
+		if role := model.GetRole(name); role != nil {
+			u.Groups = append(u.Groups, api.SCIMMember{
+				Value:   role.ID,
+				Display: role.Name,
+				Ref:     scimLocation("Groups", role.ID),
+			})
+		}
+	}
+
+	return u
+}
+
+func scimGroup(role *model.Role) api.SCIMGroup {
+	g := api.SCIMGroup{
+		Schemas:     []string{api.SCIMGroupSchema},
+		ID:          role.ID,
+		DisplayName: role.Name,
+		Members:     make([]api.SCIMMember, 0),
+		Meta: &api.SCIMMeta{
+			ResourceType: "Group",
+			Created:      time.Unix(role.CreatedAt, 0).UTC().Format(time.RFC3339),
+			Location:     scimLocation("Groups", role.ID),
+		},
+	}
+	for _, username := range model.RoleMembers(role.Name) {
+		g.Members = append(g.Members, api.SCIMMember{
+			Value:   username,
+			Display: username,
+			Ref:     scimLocation("Users", username),
+		})
+	}
+
+	return g
+}
+
+func scimList(total, startIndex int) api.SCIMList {
+	return api.SCIMList{
+		Schemas:      []string{api.SCIMListSchema},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		Resources:    make([]interface{}, 0),
+	}
+}
+
+// scimPage slices filtered results, startIndex is 1-based.
+func scimPage[T any](items []T, startIndex, count int) ([]T, int) {
+	start, end := startIndex-1, startIndex-1+count
+	if start > len(items) {
+		start = len(items)
+	}
+	if end > len(items) {
+		end = len(items)
+	}
+
+	return items[start:end], len(items)
+}
+
+func scimLocation(resource, id string) string {
+	return BaseURL + SCIMPath + "/" + resource + "/" + id
+}
+
+func scimJSON(c *gin.Context, status int, obj interface{}) {
+	c.Header("Content-Type", api.SCIMContentType)
+	c.JSON(status, obj)
+}
+
+func scimFail(c *gin.Context, status int, scimType string, err error) {
+	scimJSON(c, status, api.NewSCIMError(status, scimType, err))
+}
+
+// scimError maps model and request errors to scim status and type.
+func scimError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, model.UserExistErr), errors.Is(err, model.RoleExistErr):
+		scimFail(c, http.StatusConflict, "uniqueness", err)
+	case errors.Is(err, model.UserNotExistErr), errors.Is(err, model.RoleNotExistErr):
+		scimFail(c, http.StatusNotFound, "", err)
+	case errors.Is(err, api.SCIMFilterErr):
+		scimFail(c, http.StatusBadRequest, "invalidFilter", err)
+	case errors.Is(err, api.SCIMAdminErr):
+		scimFail(c, http.StatusForbidden, "", err)
+	case errors.Is(err, api.SCIMMutabilityErr):
+		scimFail(c, http.StatusBadRequest, "mutability", err)
+	case errors.Is(err, api.SCIMPatchPathErr):
+		scimFail(c, http.StatusBadRequest, "invalidPath", err)
+	default:
+		scimFail(c, http.StatusBadRequest, "invalidValue", err)
+	}
+}
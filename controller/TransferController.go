@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/model"
+	"net/http"
+)
+
+type TransferController struct {
+}
+
+const (
+	ImportMaxBody = 64 << 20 // byte
+)
+
+var (
+	transferContentTypes = map[string]string{
+		model.TransferJSONL: "application/x-ndjson",
+		model.TransferCSV:   "text/csv",
+	}
+)
+
+// @Summary import users, roles and grants(admin)
+// @Description body is the file, json lines or csv with a header row, one user, role or grant per row.
+// @Description atomic mode applies all rows or none, batch mode applies rows from offset and is resumed from next.
+// @Tags admin
+// @Accept plain
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data query api.Import false "请求参数"
+// @Success 200 {object} api.Response{data=model.ImportReport}
+// @Router /admin/import [post]
+func (t *TransferController) Import(c *gin.Context) {
+	var in api.Import
+	if err := c.ShouldBindQuery(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	records, err := model.DecodeTransfer(http.MaxBytesReader(c.Writer, c.Request.Body, ImportMaxBody), in.Format)
+	if err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	c.JSON(http.StatusOK, api.NewSuccessResponse(model.Import(records, in.Options())))
+}
+
+// @Summary export users, roles and grants(admin)
+// @Description password hashes are exported, mfa secrets and webauthn credentials are not.
+// @Tags admin
+// @Produce plain
+// @Param token header string true "请求参数"
+// @Param data query api.Export false "请求参数"
+// @Success 200 {string} string "json lines or csv"
+// @Router /admin/export [get]
+func (t *TransferController) Export(c *gin.Context) {
+	var in api.Export
+	if err := c.ShouldBindQuery(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	c.Header("Content-Type", transferContentTypes[in.Format])
+	c.Header("Content-Disposition", "attachment; filename=export."+in.Format)
+	c.Status(http.StatusOK)
+	if err := model.EncodeTransfer(c.Writer, in.Format, model.ExportRecords()); err != nil {
+		c.Error(err)
+	}
+}
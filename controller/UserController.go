@@ -1,10 +1,23 @@
 package controller
 
 import (
+	"encoding/base64"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/mail"
 	"github.com/nieben/auth-service-sample/model"
+	"github.com/skip2/go-qrcode"
 	"net/http"
+	"net/url"
+)
+
+const (
+	QRCodeSize = 256 // px
+)
+
+var (
+	BaseURL string // public url of the service, used in links
 )
 
 type UserController struct {
@@ -29,18 +42,91 @@ func (u *UserController) Create(c *gin.Context) {
 		return
 	}
 
-	if err := model.CreateUser(in.Username, in.Password); err != nil {
+	if err := model.CreateUser(in.Username, in.Password, in.Email); err != nil {
 		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
 		return
+	}
+
+	// user can ask for another mail when this one fails
+	if len(in.Email) > 0 {
+		user := model.GetUser(in.Username)
+		if err := user.AllowVerifyMail(); err == nil {
+			if err := sendVerification(user); err != nil {
+				c.Error(err)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
+}
+
+// @Summary verify email, the link sent by mail
+// @Tags user
+// @Produce json
+// @Param token query string true "请求参数"
+// @Success 200 {object} api.Response{}
+// @Router /user/verifyEmail [get]
+func (u *UserController) VerifyEmail(c *gin.Context) {
+	if _, err := model.VerifyEmail(c.Query("token")); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
 	} else {
 		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
 	}
 }
 
-// @Summary delete user
+// @Summary resend verification mail
+// @Description the response is the same whether the account exists, is verified or is rate limited
 // @Tags user
 // @Accept json
 // @Produce json
+// @Param data body api.ResendVerification true "请求参数"
+// @Success 200 {object} api.Response{}
+// @Router /user/resendVerification [post]
+func (u *UserController) ResendVerification(c *gin.Context) {
+	var in api.ResendVerification
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	// errors are not returned, they would tell which accounts exist
+	if user := model.GetUser(in.Username); user != nil {
+		err := user.AllowVerifyMail()
+		if err == nil {
+			err = sendVerification(user)
+		}
+		if err != nil {
+			c.Error(err)
+		}
+	}
+
+	c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
+}
+
+func sendVerification(user *model.User) error {
+	if mail.Default == nil {
+		return mail.DisabledErr
+	}
+	token, err := user.VerificationToken()
+	if err != nil {
+		return err
+	}
+
+	link := BaseURL + "/user/verifyEmail?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hi %s,\n\nPlease verify your email address by opening the link below, it expires in %d hours.\n\n%s\n",
+		user.Username, model.EmailVerifyLifeTime/3600, link)
+	return mail.Default.Send(user.GetProfile().Email, "Verify your email", body)
+}
+
+// @Summary delete user(admin)
+// @Tags user
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
 // @Param data body api.DeleteUser true "请求参数"
 // @Success 200 {object} api.Response{}
 // @Router /user/delete [post]
@@ -64,10 +150,65 @@ func (u *UserController) Delete(c *gin.Context) {
 	}
 }
 
-// @Summary add role to user
+// @Summary disable user(admin), login is refused and tokens are rejected
+// @Tags user
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.DisableUser true "请求参数"
+// @Success 200 {object} api.Response{}
+// @Router /user/disable [post]
+func (u *UserController) Disable(c *gin.Context) {
+	var in api.DisableUser
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := model.SetDisabled(in.Username, true); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
+	}
+}
+
+// @Summary enable user(admin)
+// @Tags user
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.EnableUser true "请求参数"
+// @Success 200 {object} api.Response{}
+// @Router /user/enable [post]
+func (u *UserController) Enable(c *gin.Context) {
+	var in api.EnableUser
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := model.SetDisabled(in.Username, false); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
+	}
+}
+
+// @Summary add role to user(admin)
 // @Tags user
 // @Accept json
 // @Produce json
+// @Param token header string true "请求参数"
 // @Param data body api.AddUserRole true "请求参数"
 // @Success 200 {object} api.Response{}
 // @Router /user/addRole [post]
@@ -128,8 +269,8 @@ func (u *UserController) CheckRole(c *gin.Context) {
 		return
 	}
 
-	user, _ := c.Get("user")
-	c.JSON(http.StatusOK, api.NewSuccessResponse(user.(*model.User).CheckRole(in.Role)))
+	t, _ := c.Get("token")
+	c.JSON(http.StatusOK, api.NewSuccessResponse(t.(*model.Token).CheckRole(in.Role)))
 }
 
 // @Summary roles
@@ -140,6 +281,253 @@ func (u *UserController) CheckRole(c *gin.Context) {
 // @Success 200 {object} api.Response{data=[]string}
 // @Router /user/roles [post]
 func (u *UserController) Roles(c *gin.Context) {
+	t, _ := c.Get("token")
+	c.JSON(http.StatusOK, api.NewSuccessResponse(t.(*model.Token).Roles()))
+}
+
+// @Summary enroll totp mfa
+// @Tags user
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Success 200 {object} api.Response{data=api.MFAEnrollment}
+// @Router /user/mfa/enroll [post]
+func (u *UserController) EnrollMFA(c *gin.Context) {
+	user, _ := c.Get("user")
+	secret, err := user.(*model.User).EnrollTOTP()
+	if err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	uri := model.TOTPURI(user.(*model.User).Username, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, QRCodeSize)
+	if err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	c.JSON(http.StatusOK, api.NewSuccessResponse(api.MFAEnrollment{
+		Secret: secret,
+		URI:    uri,
+		QRCode: base64.StdEncoding.EncodeToString(png),
+	}))
+}
+
+// @Summary verify totp mfa enrollment
+// @Tags user
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.VerifyMFA true "请求参数"
+// @Success 200 {object} api.Response{data=api.RecoveryCodes}
+// @Router /user/mfa/verify [post]
+func (u *UserController) VerifyMFA(c *gin.Context) {
+	var in api.VerifyMFA
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	user, _ := c.Get("user")
+	if err := user.(*model.User).VerifyTOTP(in.Code); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	u.RecoveryCodes(c)
+}
+
+// @Summary regenerate mfa recovery codes, old codes are invalidated
+// @Tags user
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Success 200 {object} api.Response{data=api.RecoveryCodes}
+// @Router /user/mfa/recoveryCodes [post]
+func (u *UserController) RecoveryCodes(c *gin.Context) {
+	user, _ := c.Get("user")
+	codes, err := user.(*model.User).GenerateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(api.RecoveryCodes{RecoveryCodes: codes}))
+	}
+}
+
+// @Summary mfa status
+// @Tags user
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Success 200 {object} api.Response{data=api.MFAStatus}
+// @Router /user/mfa/status [post]
+func (u *UserController) MFAStatus(c *gin.Context) {
+	user, _ := c.Get("user")
+	c.JSON(http.StatusOK, api.NewSuccessResponse(api.MFAStatus{
+		Enabled:       user.(*model.User).HasMFA(),
+		RecoveryCodes: user.(*model.User).RecoveryCodesLeft(),
+	}))
+}
+
+// @Summary reset user mfa(admin)
+// @Tags user
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.ResetMFA true "请求参数"
+// @Success 200 {object} api.Response{}
+// @Router /user/mfa/reset [post]
+func (u *UserController) ResetMFA(c *gin.Context) {
+	var in api.ResetMFA
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	user := model.GetUser(in.Username)
+	if user == nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(model.UserNotExistErr, nil))
+		return
+	}
+
+	if err := user.ResetMFA(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
+	}
+}
+
+// @Summary own profile
+// @Tags user
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Success 200 {object} api.Response{data=api.Profile}
+// @Router /user/profile [post]
+func (u *UserController) Profile(c *gin.Context) {
+	user, _ := c.Get("user")
+	c.JSON(http.StatusOK, api.NewSuccessResponse(api.Profile{
+		Username:      user.(*model.User).Username,
+		EmailVerified: user.(*model.User).IsEmailVerified(),
+		Profile:       user.(*model.User).GetProfile(),
+	}))
+}
+
+// @Summary update own profile
+// @Tags user
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.UpdateProfile true "请求参数"
+// @Success 200 {object} api.Response{}
+// @Router /user/updateProfile [post]
+func (u *UserController) UpdateProfile(c *gin.Context) {
+	var in api.UpdateProfile
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
 	user, _ := c.Get("user")
-	c.JSON(http.StatusOK, api.NewSuccessResponse(user.(*model.User).Roles()))
+	if err := user.(*model.User).UpdateProfile(in.Email, in.DisplayName, in.Department, in.Attributes, false); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
+	}
+}
+
+// @Summary update user profile(admin)
+// @Tags user
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.SetProfile true "请求参数"
+// @Success 200 {object} api.Response{}
+// @Router /user/setProfile [post]
+func (u *UserController) SetProfile(c *gin.Context) {
+	var in api.SetProfile
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	user := model.GetUser(in.Username)
+	if user == nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(model.UserNotExistErr, nil))
+		return
+	}
+
+	if err := user.UpdateProfile(in.Email, in.DisplayName, in.Department, in.Attributes, true); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(nil))
+	}
+}
+
+// @Summary list users(admin)
+// @Tags user
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data query api.ListUsers false "请求参数"
+// @Success 200 {object} api.Response{data=api.UserList}
+// @Router /users [get]
+func (u *UserController) List(c *gin.Context) {
+	var in api.ListUsers
+	if err := c.ShouldBindQuery(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	users, last := model.ListUsers(in.Filter(), in.After, in.Limit, in.Order == "desc")
+	list := api.UserList{Users: make([]api.UserItem, 0, len(users))}
+	for _, user := range users {
+		list.Users = append(list.Users, userItem(user))
+	}
+	if len(last) > 0 {
+		list.Next = api.EncodeCursor(last)
+	}
+
+	c.JSON(http.StatusOK, api.NewSuccessResponse(list))
+}
+
+func userItem(user *model.User) api.UserItem {
+	profile := user.GetProfile()
+	return api.UserItem{
+		Username:       user.Username,
+		Email:          profile.Email,
+		EmailVerified:  user.IsEmailVerified(),
+		DisplayName:    profile.DisplayName,
+		Department:     profile.Department,
+		Disabled:       user.IsDisabled(),
+		MFAEnabled:     user.HasMFA(),
+		ServiceAccount: user.IsServiceAccount(),
+		CreatedAt:      user.CreatedAt,
+		Roles:          user.Roles(),
+	}
 }
@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/model"
+	"net/http"
+)
+
+type WebAuthnController struct {
+}
+
+var (
+	webAuthnParams = []api.WebAuthnParameter{
+		{Type: "public-key", Alg: model.AlgES256},
+		{Type: "public-key", Alg: model.AlgEdDSA},
+		{Type: "public-key", Alg: model.AlgRS256},
+	}
+)
+
+// @Summary begin webauthn registration
+// @Tags webauthn
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Success 200 {object} api.Response{data=api.WebAuthnCreation}
+// @Router /webauthn/register/begin [post]
+func (w *WebAuthnController) RegisterBegin(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*model.User)
+
+	s, err := model.NewWebAuthnSession(model.WebAuthnCreate, u.Username)
+	if err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	exclude := make([]api.WebAuthnDescriptor, 0)
+	for _, cred := range u.WebAuthnCredentials() {
+		exclude = append(exclude, api.WebAuthnDescriptor{Type: "public-key", ID: cred.ID})
+	}
+	c.JSON(http.StatusOK, api.NewSuccessResponse(api.WebAuthnCreation{
+		Challenge: s.Challenge,
+		RP: api.WebAuthnEntity{
+			ID:   model.WebAuthnRPID,
+			Name: model.WebAuthnRPName,
+		},
+		User: api.WebAuthnEntity{
+			ID:          u.WebAuthnUserID(),
+			Name:        u.Username,
+			DisplayName: u.Username,
+		},
+		PubKeyCredParams:   webAuthnParams,
+		Timeout:            model.WebAuthnTimeout * 1000,
+		Attestation:        "direct",
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: api.WebAuthnSelection{
+			ResidentKey:      "discouraged",
+			UserVerification: "preferred",
+		},
+	}))
+}
+
+// @Summary finish webauthn registration
+// @Tags webauthn
+// @Accept json
+// @Produce json
+// @Param token header string true "请求参数"
+// @Param data body api.WebAuthnRegister true "请求参数"
+// @Success 200 {object} api.Response{data=string} "credential id"
+// @Router /webauthn/register/finish [post]
+func (w *WebAuthnController) RegisterFinish(c *gin.Context) {
+	var in api.WebAuthnRegister
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	user, _ := c.Get("user")
+	if cred, err := user.(*model.User).RegisterWebAuthn(in.ClientData, in.Attestation); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+	} else {
+		c.JSON(http.StatusOK, api.NewSuccessResponse(cred.ID))
+	}
+}
+
+// @Summary begin webauthn login
+// @Tags webauthn
+// @Accept json
+// @Produce json
+// @Param data body api.WebAuthnLoginBegin true "请求参数"
+// @Success 200 {object} api.Response{data=api.WebAuthnRequest}
+// @Router /webauthn/login/begin [post]
+func (w *WebAuthnController) LoginBegin(c *gin.Context) {
+	var in api.WebAuthnLoginBegin
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	user := model.GetUser(in.Username)
+	if user == nil || len(user.WebAuthnCredentials()) == 0 {
+		c.JSON(http.StatusOK, api.NewFailResponse(model.CredentialNotExistErr, nil))
+		return
+	}
+
+	s, err := model.NewWebAuthnSession(model.WebAuthnGet, user.Username)
+	if err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	allow := make([]api.WebAuthnDescriptor, 0)
+	for _, cred := range user.WebAuthnCredentials() {
+		allow = append(allow, api.WebAuthnDescriptor{Type: "public-key", ID: cred.ID})
+	}
+	c.JSON(http.StatusOK, api.NewSuccessResponse(api.WebAuthnRequest{
+		Challenge:        s.Challenge,
+		RPID:             model.WebAuthnRPID,
+		AllowCredentials: allow,
+		Timeout:          model.WebAuthnTimeout * 1000,
+		UserVerification: "preferred",
+	}))
+}
+
+// @Summary finish webauthn login
+// @Tags webauthn
+// @Accept json
+// @Produce json
+// @Param data body api.WebAuthnLogin true "请求参数"
+// @Success 200 {object} api.Response{}
+// @Header  200 {string} Token ""
+// @Router /webauthn/login/finish [post]
+func (w *WebAuthnController) LoginFinish(c *gin.Context) {
+	var in api.WebAuthnLogin
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	if err := in.Check(); err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	user, err := model.LoginWebAuthn(in.ID, in.ClientData, in.AuthData, in.Signature)
+	if err != nil {
+		c.JSON(http.StatusOK, api.NewFailResponse(err, nil))
+		return
+	}
+
+	issueToken(c, user, nil)
+}
@@ -0,0 +1,93 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	Default Sender // nil means mail disabled
+
+	From = "auth-service-sample@localhost"
+
+	DSNErr      = errors.New("mail only in format file:<dir> or smtp://[user:pwd@]host:port")
+	DisabledErr = errors.New("mail disabled")
+
+	seq int64
+)
+
+// Sender delivers plain text mails.
+type Sender interface {
+	Send(to, subject, body string) error
+}
+
+// New creates a sender from "file:<dir>" for development or "smtp://[user:pwd@]host:port".
+func New(dsn string) (Sender, error) {
+	if dir, ok := strings.CutPrefix(dsn, "file:"); ok && len(dir) > 0 {
+		return NewFileSender(dir)
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme != "smtp" || len(u.Host) == 0 {
+		return nil, DSNErr
+	}
+	s := &SMTPSender{Addr: u.Host}
+	if u.User != nil {
+		host, _, _ := net.SplitHostPort(u.Host)
+		pwd, _ := u.User.Password()
+		s.Auth = smtp.PlainAuth("", u.User.Username(), pwd, host)
+	}
+
+	return s, nil
+}
+
+func message(to, subject, body string) []byte {
+	return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n"+
+		"MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		From, to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n")))
+}
+
+// FileSender writes mails into a maildir, new mails appear in <dir>/new.
+type FileSender struct {
+	Dir string
+}
+
+func NewFileSender(dir string) (*FileSender, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &FileSender{Dir: dir}, nil
+}
+
+func (s *FileSender) Send(to, subject, body string) error {
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%d_%d.%s", time.Now().Unix(), os.Getpid(), atomic.AddInt64(&seq, 1), host)
+
+	// deliver to tmp then move, readers never see partial mails
+	tmp := filepath.Join(s.Dir, "tmp", name)
+	if err := os.WriteFile(tmp, message(to, subject, body), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(s.Dir, "new", name))
+}
+
+type SMTPSender struct {
+	Addr string
+	Auth smtp.Auth
+}
+
+func (s *SMTPSender) Send(to, subject, body string) error {
+	return smtp.SendMail(s.Addr, s.Auth, From, []string{to}, message(to, subject, body))
+}
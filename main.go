@@ -3,17 +3,57 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/cli"
+	"github.com/nieben/auth-service-sample/controller"
+	"github.com/nieben/auth-service-sample/mail"
 	"github.com/nieben/auth-service-sample/model"
+	"github.com/nieben/auth-service-sample/page"
 	"github.com/nieben/auth-service-sample/route"
+	"github.com/nieben/auth-service-sample/route/middleware"
+	"os"
+	"strings"
+	"time"
 )
 
 var (
 	port int64
+
+	pepperFile string
+	pepperID   string
+
+	attributeSchema string
+
+	mailDSN string
+
+	keyDir string
+
+	templateDir string
 )
 
 func initFlag() {
 	flag.Int64Var(&port, "p", 8080, "serve port")
-	flag.Int64Var(&model.TokenLifeTime, "tt", 7200, "token life time(second)")
+	flag.Int64Var(&model.TokenLifeTime, "tt", 7200, "token idle timeout(second), extended on use")
+	flag.Int64Var(&model.SessionMaxAge, "tm", model.SessionMaxAge, "token max age(second), since login, raised to -tt when not set")
+	flag.StringVar(&model.TokenHeader, "th", model.TokenHeader, "legacy token header, besides Authorization: Bearer, empty to disable")
+	flag.StringVar(&model.TokenCookie, "tc", "", "token cookie name, set on login and accepted when not empty")
+	flag.BoolVar(&controller.LegacyTokenResponse, "lt", false, "legacy token response, the token in the -th response header instead of the body")
+	flag.StringVar(&templateDir, "td", "", "template directory of the hosted pages, files replace the embedded ones of the same name")
+	flag.StringVar(&pepperFile, "pf", "", "password pepper key file, one id:secret per line")
+	flag.StringVar(&pepperID, "pid", "", "active password pepper key id")
+	flag.StringVar(&attributeSchema, "as", "", "user attribute schema file(json)")
+	flag.StringVar(&controller.BaseURL, "url", "", "public url of the service(default http://127.0.0.1:<port>)")
+	flag.StringVar(&mailDSN, "mail", "", "mail sender, file:<dir> or smtp://[user:pwd@]host:port")
+	flag.StringVar(&mail.From, "mf", mail.From, "mail from address")
+	flag.BoolVar(&middleware.OpenManagement, "om", false, "open management, /user/delete, /user/addRole, /role/create and /role/delete without the admin role, trusted networks only")
+	flag.BoolVar(&model.EmailVerifyRequired, "ev", false, "require email verification before login")
+	flag.Int64Var(&model.UnverifiedLifeTime, "ue", model.UnverifiedLifeTime, "delete unverified accounts after(second), 0 never")
+	flag.StringVar(&controller.RolesClaim, "rc", controller.RolesClaim, "claim name of roles in openid connect id tokens and userinfo")
+	flag.StringVar(&keyDir, "kd", "", "signing key directory, keys are encrypted with env AUTH_KEY_SECRET(default in memory)")
+	flag.StringVar(&model.SigningAlg, "ka", model.SigningAlg, "alg of new signing keys, RS256, ES256 or EdDSA")
+	flag.Int64Var(&model.SigningKeyRotation, "kr", model.SigningKeyRotation, "signing key rotation interval(second), 0 never")
+	flag.StringVar(&model.WebAuthnRPID, "rpid", "localhost", "webauthn relying party id(domain)")
+	flag.StringVar(&model.WebAuthnOrigin, "origin", "http://localhost:8080", "webauthn expected origin")
 	flag.Parse()
 
 	if port <= 0 {
@@ -22,6 +62,84 @@ func initFlag() {
 	if model.TokenLifeTime <= 0 {
 		panic(any("invalid token lifetime"))
 	}
+	tmSet := false
+	flag.Visit(func(f *flag.Flag) { tmSet = tmSet || f.Name == "tm" })
+	if !tmSet && model.SessionMaxAge < model.TokenLifeTime {
+		model.SessionMaxAge = model.TokenLifeTime
+	}
+	if err := model.DefaultSessionPolicy().Check(); err != nil {
+		panic(any(fmt.Sprintf("invalid -tt %d, -tm %d: %s", model.TokenLifeTime, model.SessionMaxAge, err)))
+	}
+	if controller.LegacyTokenResponse && len(model.TokenHeader) == 0 {
+		panic(any("legacy token response requires a token header"))
+	}
+	if len(controller.BaseURL) == 0 {
+		controller.BaseURL = fmt.Sprintf("http://127.0.0.1:%d", port)
+	}
+	if s := os.Getenv(model.SecretEnv); len(s) > 0 {
+		model.Secret = []byte(s)
+	}
+
+	if s := os.Getenv(middleware.SCIMTokenEnv); len(s) > 0 {
+		if len(s) < middleware.SCIMTokenMinLength {
+			panic(any("scim token len >= 32"))
+		}
+		middleware.SCIMToken = s
+	}
+
+	if err := model.LoadPeppers(os.Getenv(model.PepperEnv)); err != nil {
+		panic(any(err))
+	}
+	if len(pepperFile) > 0 {
+		if err := model.LoadPepperFile(pepperFile); err != nil {
+			panic(any(err))
+		}
+	}
+	if len(pepperID) > 0 {
+		if err := model.SetPepper(pepperID); err != nil {
+			panic(any(err))
+		}
+	}
+	// after the peppers, the password is hashed with the active one
+	if s := os.Getenv(model.AdminEnv); len(s) > 0 {
+		username, password, _ := strings.Cut(s, ":")
+		in := api.CreateUser{Username: username, Password: password}
+		if err := in.Check(); err != nil {
+			panic(any(fmt.Sprintf("%s: %s", model.AdminEnv, err)))
+		}
+		if err := model.BootstrapAdmin(in.Username, in.Password); err != nil {
+			panic(any(err))
+		}
+	}
+	if len(templateDir) > 0 {
+		if err := page.Load(templateDir); err != nil {
+			panic(any(err))
+		}
+	}
+	if len(attributeSchema) > 0 {
+		if err := model.LoadAttributeSchema(attributeSchema); err != nil {
+			panic(any(err))
+		}
+	}
+	if err := model.CheckSigningAlg(model.SigningAlg); err != nil {
+		panic(any(err))
+	}
+	if len(keyDir) > 0 {
+		model.SigningKeySecret = []byte(os.Getenv(model.SigningKeyEnv))
+		if err := model.LoadSigningKeys(keyDir); err != nil {
+			panic(any(err))
+		}
+	}
+	if len(mailDSN) > 0 {
+		sender, err := mail.New(mailDSN)
+		if err != nil {
+			panic(any(err))
+		}
+		mail.Default = sender
+	}
+	if model.EmailVerifyRequired && mail.Default == nil {
+		panic(any("email verification requires -mail"))
+	}
 }
 
 // @title auth service sample
@@ -30,6 +148,28 @@ func initFlag() {
 // @host 127.0.0.1
 // @schemes http
 func main() {
+	// admin commands: import, export
+	if len(os.Args) > 1 {
+		if command, ok := cli.Commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	initFlag()
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			model.ExpireUnverifiedUsers()
+			model.ExpireDeviceCodes()
+			if err := model.ScheduleSigningKeys(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}()
+
 	route.Init().Run(fmt.Sprintf(":%d", port))
 }
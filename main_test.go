@@ -2,15 +2,38 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"github.com/fxamacker/cbor/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/cli"
+	"github.com/nieben/auth-service-sample/controller"
+	"github.com/nieben/auth-service-sample/mail"
 	"github.com/nieben/auth-service-sample/model"
+	"github.com/nieben/auth-service-sample/page"
 	"github.com/nieben/auth-service-sample/route"
 	"github.com/nieben/auth-service-sample/route/middleware"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"image"
+	_ "image/png"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -34,6 +57,7 @@ func init() {
 	gin.SetMode(gin.TestMode)
 
 	router = route.Init()
+	middleware.OpenManagement = true // the flows manage users and roles without a token, see TestManagementAuth
 
 	s := "12345612345612345612345612345612"
 	invalidToken = &s
@@ -531,15 +555,15 @@ func TestFullFlow(t *testing.T) {
 			}
 
 			if c.path == "/auth/token" && c.name == "ok bob" {
-				initBobToken = w.Header().Get("token")
+				initBobToken = accessToken(w)
 			}
 
 			if c.path == "/auth/token" && c.name == "ok eve" {
-				initEveToken = w.Header().Get("token")
+				initEveToken = accessToken(w)
 			}
 
 			if c.path == "/auth/token" && c.name == "ok for testing expire" {
-				expireToken = w.Header().Get("token")
+				expireToken = accessToken(w)
 			}
 
 			fmt.Printf("Path: [%s] Case: [%s] Param: [%+v] Header [%+v] ExpectCode: [%d] ExpectErr: [%s]\n",
@@ -660,7 +684,7 @@ func BenchmarkUserRoles(b *testing.B) {
 		assert.Equal(b, c.expectErr, response.Error)
 
 		if c.path == "/auth/token" && c.name == "bob token" {
-			token = w.Header().Get("token")
+			token = accessToken(w)
 		}
 	}
 
@@ -682,3 +706,2356 @@ func BenchmarkUserRoles(b *testing.B) {
 		}
 	})
 }
+
+// same as BenchmarkUserRoles while grants of another role are added and cascaded away concurrently
+func BenchmarkUserRolesChurn(b *testing.B) {
+	model.TokenLifeTime = 7200
+
+	for _, role := range []string{"admin", "ops", "churn"} {
+		if model.GetRole(role) == nil {
+			model.CreateRole(role, "", nil)
+		}
+	}
+	if model.GetUser("carol") == nil {
+		model.CreateUser("carol", "123456", "")
+	}
+	carol := model.GetUser("carol")
+	carol.AddRole(model.GetRole("admin"))
+	carol.AddRole(model.GetRole("ops"))
+	w, _ := call("/auth/token", api.Token{Username: "carol", Password: "123456"}, "")
+	token := accessToken(w)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if role := model.GetRole("churn"); role != nil {
+					carol.AddRole(role)
+				}
+				model.DeleteRole("churn")
+				model.CreateRole("churn", "", nil)
+			}
+		}
+	}()
+
+	req := httptest.NewRequest("POST", "/user/roles", nil)
+	req.Header.Set("token", token)
+	b.SetParallelism(2500)
+	b.RunParallel(func(pb *testing.PB) {
+		pb.Next()
+		for n := 0; n < 10; n++ {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			var response api.Response
+			json.Unmarshal([]byte(w.Body.String()), &response)
+
+			assert.Equal(b, int64(0), response.Status)
+			assert.Subset(b, response.Data, []interface{}{"admin", "ops"})
+		}
+	})
+}
+
+// pepper rotation: user created with k1 is re-peppered with k2 on login
+func TestPepper(t *testing.T) {
+	assert.Nil(t, model.LoadPeppers("k1:0123456789abcdef,k2:fedcba9876543210"))
+	assert.Equal(t, model.PepperNotExistErr, model.SetPepper("k3"))
+	assert.Nil(t, model.SetPepper("k1"))
+	defer func() {
+		model.SetPepper("")
+		model.DeleteUser("pepper")
+	}()
+
+	w := post("/user/create", "POST", api.CreateUser{Username: "pepper", Password: "123456"}, nil, router)
+	var response api.Response
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, int64(0), response.Status)
+
+	user := model.GetUser("pepper")
+	assert.Equal(t, "k1", user.PepperID)
+	assert.False(t, user.CheckPwd("654321"))
+	assert.True(t, user.CheckPwd("123456"))
+	assert.Equal(t, "k1", user.PepperID)
+
+	// rotate
+	assert.Nil(t, model.SetPepper("k2"))
+	assert.False(t, user.CheckPwd("654321"))
+	assert.Equal(t, "k1", user.PepperID)
+
+	w = post("/auth/token", "POST", api.Token{Username: "pepper", Password: "123456"}, nil, router)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, int64(0), response.Status)
+	assert.Equal(t, "k2", user.PepperID)
+	assert.True(t, user.CheckPwd("123456"))
+}
+
+func call(path string, param interface{}, token string) (*httptest.ResponseRecorder, api.Response) {
+	headers := map[string]*string{}
+	if len(token) > 0 {
+		headers["token"] = &token
+	}
+	w := post(path, "POST", param, headers, router)
+	var response api.Response
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w, response
+}
+
+// without -om only admins delete users, grant roles and create or delete roles, anyone signs up
+func TestManagementAuth(t *testing.T) {
+	middleware.OpenManagement = false
+	defer func() { middleware.OpenManagement = true }()
+
+	_, response := call("/user/create", api.CreateUser{Username: "gateuser", Password: "123456"}, "")
+	assert.Equal(t, "", response.Error)
+	defer model.DeleteUser("gateuser")
+	user := login(t, "gateuser", "123456")
+	for _, token := range []string{"", user} {
+		expect := middleware.PermissionDeniedErr.Error()
+		if len(token) == 0 {
+			expect = middleware.TokenRequiredErr.Error()
+		}
+		_, response = call("/user/addRole", api.AddUserRole{Username: "gateuser", Role: model.AdminRole}, token)
+		assert.Equal(t, expect, response.Error)
+		_, response = call("/role/create", api.CreateRole{Role: "gaterole"}, token)
+		assert.Equal(t, expect, response.Error)
+		_, response = call("/role/delete", api.DeleteRole{Role: model.AdminRole}, token)
+		assert.Equal(t, expect, response.Error)
+		_, response = call("/user/delete", api.DeleteUser{Username: "gateuser"}, token)
+		assert.Equal(t, expect, response.Error)
+	}
+	assert.Equal(t, []string{}, model.GetUser("gateuser").Roles())
+	assert.Nil(t, model.GetRole("gaterole"))
+
+	// the first admin comes from AUTH_ADMIN
+	assert.Nil(t, model.BootstrapAdmin("gateadmin", "123456"))
+	defer model.DeleteUser("gateadmin")
+	admin := login(t, "gateadmin", "123456")
+	_, response = call("/role/create", api.CreateRole{Role: "gaterole"}, admin)
+	assert.Equal(t, "", response.Error)
+	_, response = call("/user/addRole", api.AddUserRole{Username: "gateuser", Role: "gaterole"}, admin)
+	assert.Equal(t, "", response.Error)
+	_, response = call("/role/delete", api.DeleteRole{Role: "gaterole"}, admin)
+	assert.Equal(t, "", response.Error)
+	_, response = call("/user/delete", api.DeleteUser{Username: "gateuser"}, admin)
+	assert.Equal(t, "", response.Error)
+}
+
+func createUser(t *testing.T, username, password string, roles ...string) {
+	_, response := call("/user/create", api.CreateUser{Username: username, Password: password}, "")
+	assert.Equal(t, "", response.Error)
+	for _, role := range roles {
+		if model.GetRole(role) == nil {
+			model.CreateRole(role, "", nil)
+		}
+		_, response = call("/user/addRole", api.AddUserRole{Username: username, Role: role}, "")
+		assert.Equal(t, "", response.Error)
+	}
+	t.Cleanup(func() { model.DeleteUser(username) })
+}
+
+// accessToken returns the token of a login response, empty when there is none.
+func accessToken(w *httptest.ResponseRecorder) string {
+	var response struct {
+		Data api.AccessToken `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response.Data.AccessToken
+}
+
+func login(t *testing.T, username, password string) string {
+	w, response := call("/auth/token", api.Token{Username: username, Password: password}, "")
+	assert.Equal(t, "", response.Error)
+	return accessToken(w)
+}
+
+// enroll, verify, two-step login with replay protection, admin reset
+func TestMFA(t *testing.T) {
+	createUser(t, "mfauser", "123456")
+	createUser(t, "mfaadmin", "123456", model.AdminRole)
+	token := login(t, "mfauser", "123456")
+
+	_, response := call("/user/mfa/verify", api.VerifyMFA{Code: "123456"}, token)
+	assert.Equal(t, model.MFANotEnrolledErr.Error(), response.Error)
+
+	_, response = call("/user/mfa/enroll", nil, token)
+	assert.Equal(t, int64(0), response.Status)
+	data := response.Data.(map[string]interface{})
+	secret := data["secret"].(string)
+	assert.Contains(t, data["uri"], "otpauth://totp/")
+	assert.Contains(t, data["uri"], "secret="+secret)
+	png, err := base64.StdEncoding.DecodeString(data["qrCode"].(string))
+	assert.Nil(t, err)
+	_, _, err = image.Decode(bytes.NewReader(png))
+	assert.Nil(t, err)
+
+	step := model.TOTPStep(time.Now())
+	code, _ := model.TOTPCode(secret, step)
+	_, response = call("/user/mfa/verify", api.VerifyMFA{Code: code}, token)
+	assert.Equal(t, int64(0), response.Status)
+	_, response = call("/user/mfa/enroll", nil, token)
+	assert.Equal(t, model.MFAEnabledErr.Error(), response.Error)
+
+	// password only yields a challenge
+	w, response := call("/auth/token", api.Token{Username: "mfauser", Password: "123456"}, "")
+	assert.Equal(t, int64(0), response.Status)
+	assert.Equal(t, "", accessToken(w))
+	challenge := response.Data.(map[string]interface{})
+	assert.Equal(t, true, challenge["mfaRequired"])
+	mfaToken := challenge["mfaToken"].(string)
+
+	// code used for enrollment can not be replayed
+	_, response = call("/auth/mfa", api.MFAToken{MFAToken: mfaToken, Code: code}, "")
+	assert.Equal(t, model.MFACodeErr.Error(), response.Error)
+
+	next, _ := model.TOTPCode(secret, step+1)
+	w, response = call("/auth/mfa", api.MFAToken{MFAToken: mfaToken, Code: next}, "")
+	assert.Equal(t, int64(0), response.Status)
+	assert.Len(t, accessToken(w), model.TokenLength)
+
+	// challenge is single use
+	_, response = call("/auth/mfa", api.MFAToken{MFAToken: mfaToken, Code: next}, "")
+	assert.Equal(t, model.MFAChallengeErr.Error(), response.Error)
+
+	// new challenges after the password do not bring new attempts
+	for i := 0; i < model.MFAUserAttempts/model.MFAChallengeAttempts; i++ {
+		_, response = call("/auth/token", api.Token{Username: "mfauser", Password: "123456"}, "")
+		mfaToken = response.Data.(map[string]interface{})["mfaToken"].(string)
+		for j := 0; j < model.MFAChallengeAttempts; j++ {
+			_, response = call("/auth/mfa", api.MFAToken{MFAToken: mfaToken, Code: "000000"}, "")
+			assert.Equal(t, model.MFACodeErr.Error(), response.Error)
+		}
+	}
+	_, response = call("/auth/token", api.Token{Username: "mfauser", Password: "123456"}, "")
+	mfaToken = response.Data.(map[string]interface{})["mfaToken"].(string)
+	_, response = call("/auth/mfa", api.MFAToken{MFAToken: mfaToken, Code: "000000"}, "")
+	assert.Equal(t, model.MFAAttemptsErr.Error(), response.Error)
+
+	// admin reset
+	_, response = call("/user/mfa/reset", api.ResetMFA{Username: "mfauser"}, token)
+	assert.Equal(t, middleware.PermissionDeniedErr.Error(), response.Error)
+	_, response = call("/user/mfa/reset", api.ResetMFA{Username: "mfauser"}, login(t, "mfaadmin", "123456"))
+	assert.Equal(t, int64(0), response.Status)
+	assert.Len(t, login(t, "mfauser", "123456"), model.TokenLength)
+}
+
+// recovery codes as second factor, single use, regenerate invalidates old set
+func TestRecoveryCodes(t *testing.T) {
+	createUser(t, "recovery", "123456")
+	token := login(t, "recovery", "123456")
+
+	_, response := call("/user/mfa/recoveryCodes", nil, token)
+	assert.Equal(t, model.MFANotEnrolledErr.Error(), response.Error)
+
+	_, response = call("/user/mfa/enroll", nil, token)
+	secret := response.Data.(map[string]interface{})["secret"].(string)
+	code, _ := model.TOTPCode(secret, model.TOTPStep(time.Now()))
+	_, response = call("/user/mfa/verify", api.VerifyMFA{Code: code}, token)
+	assert.Equal(t, int64(0), response.Status)
+	codes := response.Data.(map[string]interface{})["recoveryCodes"].([]interface{})
+	assert.Len(t, codes, model.RecoveryCodeCount)
+
+	_, response = call("/user/mfa/status", nil, token)
+	assert.Equal(t, map[string]interface{}{"enabled": true, "recoveryCodes": float64(model.RecoveryCodeCount)}, response.Data)
+
+	mfaLogin := func(recoveryCode string) (*httptest.ResponseRecorder, api.Response) {
+		_, response := call("/auth/token", api.Token{Username: "recovery", Password: "123456"}, "")
+		mfaToken := response.Data.(map[string]interface{})["mfaToken"].(string)
+		return call("/auth/mfa", api.MFAToken{MFAToken: mfaToken, RecoveryCode: recoveryCode}, "")
+	}
+
+	w, response := mfaLogin(strings.ToUpper(codes[0].(string)))
+	assert.Equal(t, int64(0), response.Status)
+	assert.Len(t, accessToken(w), model.TokenLength)
+	_, response = mfaLogin(codes[0].(string))
+	assert.Equal(t, model.RecoveryCodeErr.Error(), response.Error)
+	_, response = mfaLogin("aaaa-bbbb-cccc")
+	assert.Equal(t, model.RecoveryCodeErr.Error(), response.Error)
+
+	_, response = call("/user/mfa/status", nil, token)
+	assert.Equal(t, float64(model.RecoveryCodeCount-1), response.Data.(map[string]interface{})["recoveryCodes"])
+
+	// regenerate
+	_, response = call("/user/mfa/recoveryCodes", nil, token)
+	assert.Equal(t, int64(0), response.Status)
+	fresh := response.Data.(map[string]interface{})["recoveryCodes"].([]interface{})
+	_, response = mfaLogin(codes[1].(string))
+	assert.Equal(t, model.RecoveryCodeErr.Error(), response.Error)
+	_, response = mfaLogin(fresh[1].(string))
+	assert.Equal(t, int64(0), response.Status)
+	_, response = call("/user/mfa/status", nil, token)
+	assert.Equal(t, float64(model.RecoveryCodeCount-1), response.Data.(map[string]interface{})["recoveryCodes"])
+}
+
+// softAuthenticator produces packed self attestation and assertions with a P-256 key
+type softAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	id        []byte
+	signCount uint32
+}
+
+func newSoftAuthenticator() *softAuthenticator {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, id: id}
+}
+
+func (a *softAuthenticator) sign(authData, clientData []byte) []byte {
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, _ := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	return sig
+}
+
+func (a *softAuthenticator) authData(flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(model.WebAuthnRPID))
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	if attested {
+		x, y := make([]byte, 32), make([]byte, 32)
+		a.key.X.FillBytes(x)
+		a.key.Y.FillBytes(y)
+		key, _ := cbor.Marshal(map[int]interface{}{1: 2, 3: model.AlgES256, -1: 1, -2: x, -3: y})
+		data = append(data, make([]byte, 16)...) // aaguid
+		data = append(data, byte(len(a.id)>>8), byte(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, key...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) create(challenge, origin string) api.WebAuthnRegister {
+	clientData, _ := json.Marshal(map[string]string{"type": model.WebAuthnCreate, "challenge": challenge, "origin": origin})
+	authData := a.authData(0x41, true)
+	attestation, _ := cbor.Marshal(map[string]interface{}{
+		"fmt":      "packed",
+		"attStmt":  map[string]interface{}{"alg": model.AlgES256, "sig": a.sign(authData, clientData)},
+		"authData": authData,
+	})
+	id := base64.RawURLEncoding.EncodeToString(a.id)
+	return api.WebAuthnRegister{ID: id, Type: "public-key", Response: api.WebAuthnAttestation{
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AttestationObject: base64.RawURLEncoding.EncodeToString(attestation),
+	}}
+}
+
+func (a *softAuthenticator) get(challenge, origin string) api.WebAuthnLogin {
+	a.signCount++
+	clientData, _ := json.Marshal(map[string]string{"type": model.WebAuthnGet, "challenge": challenge, "origin": origin})
+	authData := a.authData(0x05, false)
+	return api.WebAuthnLogin{ID: base64.RawURLEncoding.EncodeToString(a.id), Type: "public-key", Response: api.WebAuthnAssertion{
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(a.sign(authData, clientData)),
+	}}
+}
+
+// registration and login ceremonies with a software authenticator
+func TestWebAuthn(t *testing.T) {
+	createUser(t, "passkey", "123456")
+	token := login(t, "passkey", "123456")
+	authenticator := newSoftAuthenticator()
+
+	_, response := call("/webauthn/login/begin", api.WebAuthnLoginBegin{Username: "passkey"}, "")
+	assert.Equal(t, model.CredentialNotExistErr.Error(), response.Error)
+
+	// register
+	_, response = call("/webauthn/register/begin", nil, token)
+	assert.Equal(t, int64(0), response.Status)
+	options := response.Data.(map[string]interface{})
+	assert.Equal(t, model.WebAuthnRPID, options["rp"].(map[string]interface{})["id"])
+	challenge := options["challenge"].(string)
+
+	_, response = call("/webauthn/register/finish", authenticator.create(challenge, "https://evil.example"), token)
+	assert.Equal(t, model.WebAuthnClientDataErr.Error(), response.Error)
+	_, response = call("/webauthn/register/finish", authenticator.create(challenge, model.WebAuthnOrigin), token)
+	assert.Equal(t, int64(0), response.Status)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(authenticator.id), response.Data)
+	_, response = call("/webauthn/register/finish", authenticator.create(challenge, model.WebAuthnOrigin), token)
+	assert.Equal(t, model.WebAuthnSessionErr.Error(), response.Error)
+
+	// login
+	begin := func() string {
+		_, response := call("/webauthn/login/begin", api.WebAuthnLoginBegin{Username: "passkey"}, "")
+		assert.Equal(t, int64(0), response.Status)
+		return response.Data.(map[string]interface{})["challenge"].(string)
+	}
+	w, response := call("/webauthn/login/finish", authenticator.get(begin(), model.WebAuthnOrigin), "")
+	assert.Equal(t, int64(0), response.Status)
+	assert.Len(t, accessToken(w), model.TokenLength)
+
+	assertion := authenticator.get(begin(), model.WebAuthnOrigin)
+	assertion.Response.Signature = base64.RawURLEncoding.EncodeToString([]byte("forged"))
+	_, response = call("/webauthn/login/finish", assertion, "")
+	assert.Equal(t, model.WebAuthnSignatureErr.Error(), response.Error)
+
+	// cloned authenticator replays an old counter
+	authenticator.signCount = 0
+	_, response = call("/webauthn/login/finish", authenticator.get(begin(), model.WebAuthnOrigin), "")
+	assert.Equal(t, model.WebAuthnSignCountErr.Error(), response.Error)
+}
+
+// disabled user: login refused, tokens rejected, grants kept after enable
+func TestDisableUser(t *testing.T) {
+	createUser(t, "disabled", "123456", "dev")
+	createUser(t, "disabler", "123456", model.AdminRole)
+	token := login(t, "disabled", "123456")
+	admin := login(t, "disabler", "123456")
+
+	_, response := call("/user/disable", api.DisableUser{Username: "disabled"}, token)
+	assert.Equal(t, middleware.PermissionDeniedErr.Error(), response.Error)
+	_, response = call("/user/disable", api.DisableUser{Username: "notexist"}, admin)
+	assert.Equal(t, model.UserNotExistErr.Error(), response.Error)
+	_, response = call("/user/disable", api.DisableUser{Username: "disabled"}, admin)
+	assert.Equal(t, int64(0), response.Status)
+
+	_, response = call("/user/roles", nil, token)
+	assert.Equal(t, model.UserDisabledErr.Error(), response.Error)
+	_, response = call("/auth/token", api.Token{Username: "disabled", Password: "123456"}, "")
+	assert.Equal(t, model.UserDisabledErr.Error(), response.Error)
+	_, response = call("/auth/token", api.Token{Username: "disabled", Password: "654321"}, "")
+	assert.Equal(t, model.UserCheckErr.Error(), response.Error)
+
+	_, response = call("/user/enable", api.EnableUser{Username: "disabled"}, admin)
+	assert.Equal(t, int64(0), response.Status)
+	_, response = call("/user/roles", nil, token)
+	assert.Equal(t, []interface{}{"dev"}, response.Data)
+	assert.Len(t, login(t, "disabled", "123456"), model.TokenLength)
+}
+
+// profile fields, schema validated attributes, exposed attributes in introspection
+func TestProfile(t *testing.T) {
+	schema := filepath.Join(t.TempDir(), "schema.json")
+	os.WriteFile(schema, []byte(`{
+		"employeeId": {"type": "string", "pattern": "^E[0-9]{6}$", "exposed": true, "adminOnly": true},
+		"costCenter": {"type": "number", "exposed": true},
+		"newsletter": {"type": "boolean"}
+	}`), 0600)
+	assert.Nil(t, model.LoadAttributeSchema(schema))
+	defer func() { model.AttributeSchema = make(map[string]*model.AttributeDef, 0) }()
+
+	createUser(t, "profile", "123456", "dev")
+	createUser(t, "profiler", "123456", model.AdminRole)
+	token := login(t, "profile", "123456")
+	admin := login(t, "profiler", "123456")
+
+	email, name := "Profile@Example.com ", "Pro File"
+	_, response := call("/user/updateProfile", api.UpdateProfile{Email: &name}, token)
+	assert.Equal(t, model.ProfileEmailErr.Error(), response.Error)
+	_, response = call("/user/updateProfile", api.UpdateProfile{Attributes: map[string]interface{}{"unknown": "x"}}, token)
+	assert.Equal(t, model.AttributeNotExistErr.Error(), response.Error)
+	_, response = call("/user/updateProfile", api.UpdateProfile{Attributes: map[string]interface{}{"costCenter": "x"}}, token)
+	assert.Equal(t, model.AttributeInvalidErr.Error(), response.Error)
+	_, response = call("/user/updateProfile", api.UpdateProfile{Attributes: map[string]interface{}{"employeeId": "E123456"}}, token)
+	assert.Equal(t, model.AttributeDeniedErr.Error(), response.Error)
+
+	_, response = call("/user/updateProfile", api.UpdateProfile{
+		Email:       &email,
+		DisplayName: &name,
+		Attributes:  map[string]interface{}{"costCenter": 42, "newsletter": true},
+	}, token)
+	assert.Equal(t, int64(0), response.Status)
+	_, response = call("/user/setProfile", api.SetProfile{Username: "profile", UpdateProfile: api.UpdateProfile{
+		Attributes: map[string]interface{}{"employeeId": "E1234"},
+	}}, admin)
+	assert.Equal(t, model.AttributeInvalidErr.Error(), response.Error)
+	_, response = call("/user/setProfile", api.SetProfile{Username: "profile", UpdateProfile: api.UpdateProfile{
+		Attributes: map[string]interface{}{"employeeId": "E123456", "costCenter": nil},
+	}}, admin)
+	assert.Equal(t, int64(0), response.Status)
+
+	_, response = call("/user/profile", nil, token)
+	assert.Equal(t, map[string]interface{}{
+		"username":      "profile",
+		"email":         "profile@example.com",
+		"emailVerified": false,
+		"displayName":   "Pro File",
+		"department":    "",
+		"attributes":    map[string]interface{}{"newsletter": true, "employeeId": "E123456"},
+	}, response.Data)
+
+	_, response = call("/auth/introspect", nil, token)
+	data := response.Data.(map[string]interface{})
+	assert.Equal(t, "profile", data["username"])
+	assert.Equal(t, []interface{}{"dev"}, data["roles"])
+	assert.Equal(t, "profile@example.com", data["email"])
+	assert.Equal(t, map[string]interface{}{"employeeId": "E123456"}, data["attributes"])
+}
+
+// verification link by mail, login blocked until verified, resend limit, stale expiry
+func TestEmailVerification(t *testing.T) {
+	dir := t.TempDir()
+	sender, err := mail.NewFileSender(dir)
+	assert.Nil(t, err)
+	mail.Default, model.EmailVerifyRequired = sender, true
+	defer func() { mail.Default, model.EmailVerifyRequired = nil, false }()
+
+	_, response := call("/user/create", api.CreateUser{Username: "verify", Password: "123456"}, "")
+	assert.Equal(t, model.EmailRequiredErr.Error(), response.Error)
+	_, response = call("/user/create", api.CreateUser{Username: "verify", Password: "123456", Email: "verify@example.com"}, "")
+	assert.Equal(t, int64(0), response.Status)
+	defer model.DeleteUser("verify")
+
+	mails, _ := os.ReadDir(filepath.Join(dir, "new"))
+	assert.Len(t, mails, 1)
+	b, _ := os.ReadFile(filepath.Join(dir, "new", mails[0].Name()))
+	assert.Contains(t, string(b), "To: verify@example.com")
+	link := regexp.MustCompile(`/user/verifyEmail\?token=\S+`).FindString(string(b))
+
+	_, response = call("/auth/token", api.Token{Username: "verify", Password: "123456"}, "")
+	assert.Equal(t, model.EmailNotVerifiedErr.Error(), response.Error)
+	// the same answer for limited, unknown and verified accounts, see the mail count
+	_, response = call("/user/resendVerification", api.ResendVerification{Username: "verify"}, "")
+	assert.Equal(t, int64(0), response.Status)
+	_, response = call("/user/resendVerification", api.ResendVerification{Username: "nobody"}, "")
+	assert.Equal(t, int64(0), response.Status)
+
+	w := post(link+"x", "GET", nil, nil, router)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, model.VerifyTokenErr.Error(), response.Error)
+	w = post(link, "GET", nil, nil, router)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, int64(0), response.Status)
+
+	token := login(t, "verify", "123456")
+	_, response = call("/auth/introspect", nil, token)
+	assert.Equal(t, true, response.Data.(map[string]interface{})["emailVerified"])
+	_, response = call("/user/resendVerification", api.ResendVerification{Username: "verify"}, "")
+	assert.Equal(t, int64(0), response.Status)
+	assert.Equal(t, model.EmailVerifiedErr, model.GetUser("verify").AllowVerifyMail())
+	mails, _ = os.ReadDir(filepath.Join(dir, "new"))
+	assert.Len(t, mails, 1)
+
+	// stale pending account
+	_, response = call("/user/create", api.CreateUser{Username: "stale", Password: "123456", Email: "stale@example.com"}, "")
+	assert.Equal(t, int64(0), response.Status)
+	assert.Len(t, model.ExpireUnverifiedUsers(), 0)
+	model.GetUser("stale").CreatedAt -= model.UnverifiedLifeTime + 1
+	assert.Equal(t, []string{"stale"}, model.ExpireUnverifiedUsers())
+	assert.Nil(t, model.GetUser("stale"))
+}
+
+// cursor pagination with filters, scanned in small batches
+func TestListUsers(t *testing.T) {
+	model.UserListBatch = 2
+	defer func() { model.UserListBatch = 256 }()
+
+	createUser(t, "lister", "123456", model.AdminRole)
+	for _, name := range []string{"listb", "lista", "listd", "listc", "listaa"} {
+		createUser(t, name, "123456")
+	}
+	call("/user/addRole", api.AddUserRole{Username: "listc", Role: "dev"}, "")
+	call("/user/addRole", api.AddUserRole{Username: "lista", Role: "dev"}, "")
+	model.SetDisabled("listd", true)
+	admin := login(t, "lister", "123456")
+
+	list := func(query string) ([]string, string) {
+		var response api.Response
+		token := admin
+		w := post("/users?"+query, "GET", nil, map[string]*string{"token": &token}, router)
+		json.Unmarshal(w.Body.Bytes(), &response)
+		assert.Equal(t, "", response.Error)
+		data := response.Data.(map[string]interface{})
+		names := make([]string, 0)
+		for _, u := range data["users"].([]interface{}) {
+			names = append(names, u.(map[string]interface{})["username"].(string))
+		}
+		return names, data["next"].(string)
+	}
+
+	names, next := list("prefix=list&limit=4")
+	assert.Equal(t, []string{"lista", "listaa", "listb", "listc"}, names)
+	names, next = list("prefix=list&limit=4&cursor=" + next)
+	assert.Equal(t, []string{"listd", "lister"}, names)
+	assert.Equal(t, "", next)
+
+	names, next = list("prefix=list&limit=2&order=desc")
+	assert.Equal(t, []string{"lister", "listd"}, names)
+	names, _ = list("prefix=list&limit=2&order=desc&cursor=" + next)
+	assert.Equal(t, []string{"listc", "listb"}, names)
+
+	names, _ = list("prefix=list&role=dev")
+	assert.Equal(t, []string{"lista", "listc"}, names)
+	names, _ = list("q=sta&disabled=false")
+	assert.Equal(t, []string{"lista", "listaa"}, names)
+	names, _ = list("prefix=list&disabled=true")
+	assert.Equal(t, []string{"listd"}, names)
+	names, _ = list("prefix=list&createdAfter=" + fmt.Sprint(time.Now().Unix()+60))
+	assert.Equal(t, []string{}, names)
+
+	var response api.Response
+	token := admin
+	w := post("/users?limit=1000", "GET", nil, map[string]*string{"token": &token}, router)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, api.ListLimitErr.Error(), response.Error)
+}
+
+func TestRoleQueries(t *testing.T) {
+	createUser(t, "roleadmin", "123456", model.AdminRole)
+	_, response := call("/role/create", api.CreateRole{
+		Role:        "auditor",
+		Description: "read only access to audit logs",
+		Metadata:    map[string]string{"owner": "security"},
+	}, "")
+	assert.Equal(t, "", response.Error)
+	t.Cleanup(func() { model.DeleteRole("auditor") })
+	_, response = call("/role/create", api.CreateRole{Role: "broken", Metadata: map[string]string{"bad key": "x"}}, "")
+	assert.Equal(t, model.RoleMetadataErr.Error(), response.Error)
+
+	for _, name := range []string{"auditc", "audita", "auditb"} {
+		createUser(t, name, "123456")
+		call("/user/addRole", api.AddUserRole{Username: name, Role: "auditor"}, "")
+	}
+	admin := login(t, "roleadmin", "123456")
+
+	get := func(path string) map[string]interface{} {
+		var response api.Response
+		token := admin
+		w := post(path, "GET", nil, map[string]*string{"token": &token}, router)
+		json.Unmarshal(w.Body.Bytes(), &response)
+		assert.Equal(t, "", response.Error, path)
+		data, _ := response.Data.(map[string]interface{})
+		return data
+	}
+
+	role := get("/roles/auditor")
+	assert.Equal(t, "read only access to audit logs", role["description"])
+	assert.Equal(t, map[string]interface{}{"owner": "security"}, role["metadata"])
+
+	names := make([]string, 0)
+	for next := ""; ; {
+		data := get("/roles?limit=1&cursor=" + next)
+		for _, r := range data["roles"].([]interface{}) {
+			names = append(names, r.(map[string]interface{})["name"].(string))
+		}
+		if next = data["next"].(string); len(next) == 0 {
+			break
+		}
+	}
+	assert.Contains(t, names, "auditor")
+	assert.Contains(t, names, model.AdminRole)
+	assert.True(t, sort.StringsAreSorted(names))
+
+	data := get("/roles/auditor/members?limit=2")
+	members := make([]string, 0)
+	for _, u := range data["users"].([]interface{}) {
+		members = append(members, u.(map[string]interface{})["username"].(string))
+	}
+	assert.Equal(t, []string{"audita", "auditb"}, members)
+	data = get("/roles/auditor/members?limit=2&cursor=" + data["next"].(string))
+	assert.Len(t, data["users"], 1)
+	assert.Equal(t, "", data["next"])
+
+	token := admin
+	w := post("/roles/nobody/members", "GET", nil, map[string]*string{"token": &token}, router)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, model.RoleNotExistErr.Error(), response.Error)
+}
+
+// deleting a role removes its grants, re-creating it does not restore them
+func TestRoleCascade(t *testing.T) {
+	createUser(t, "cascade", "123456")
+	assert.Nil(t, model.CreateRole("temp", "", nil))
+	defer model.DeleteRole("temp")
+	role := model.GetRole("temp")
+	user := model.GetUser("cascade")
+	assert.Nil(t, user.AddRole(role))
+	assert.Equal(t, []string{"temp"}, user.Roles())
+	users, _ := model.ListUsers(model.UserFilter{Role: "temp"}, "", 10, false)
+	assert.Equal(t, []*model.User{user}, users)
+
+	assert.Nil(t, model.DeleteRole("temp"))
+	assert.Equal(t, []string{}, user.Roles())
+	assert.False(t, user.CheckRole("temp"))
+	assert.Equal(t, model.RoleNotExistErr, user.AddRole(role)) // stale role
+
+	assert.Nil(t, model.CreateRole("temp", "", nil))
+	assert.False(t, user.CheckRole("temp"))
+	users, _ = model.ListUsers(model.UserFilter{Role: "temp"}, "", 10, false)
+	assert.Empty(t, users)
+
+	// deleted users leave no members behind
+	assert.Nil(t, user.AddRole(model.GetRole("temp")))
+	assert.Nil(t, model.DeleteUser("cascade"))
+	assert.Empty(t, model.RoleUsers[model.GetRole("temp").ID])
+}
+
+// grants follow the role id across renames
+func TestRoleRename(t *testing.T) {
+	createUser(t, "renamer", "123456", model.AdminRole)
+	createUser(t, "oncall", "123456", "opsteam")
+	defer model.DeleteRole("opsteam")
+	defer model.DeleteRole("sre")
+	id := model.GetRole("opsteam").ID
+	admin := login(t, "renamer", "123456")
+
+	name, description := "sre", "site reliability"
+	_, response := call("/role/update", api.UpdateRole{Role: "opsteam", Name: &name, Description: &description}, admin)
+	assert.Equal(t, "", response.Error)
+	role := response.Data.(map[string]interface{})
+	assert.Equal(t, id, role["id"])
+	assert.Equal(t, "sre", role["name"])
+	assert.Equal(t, "site reliability", role["description"])
+
+	assert.Nil(t, model.GetRole("opsteam"))
+	user := model.GetUser("oncall")
+	assert.Equal(t, []string{"sre"}, user.Roles())
+	assert.True(t, user.CheckRole("sre"))
+	assert.False(t, user.CheckRole("opsteam"))
+	users, _ := model.ListUsers(model.UserFilter{Role: "sre"}, "", 10, false)
+	assert.Equal(t, []*model.User{user}, users)
+
+	// a new role with the old name does not inherit grants
+	assert.Nil(t, model.CreateRole("opsteam", "", nil))
+	assert.False(t, user.CheckRole("opsteam"))
+
+	name = "opsteam"
+	_, response = call("/role/update", api.UpdateRole{Role: "sre", Name: &name}, admin)
+	assert.Equal(t, model.RoleExistErr.Error(), response.Error)
+	_, response = call("/role/update", api.UpdateRole{Role: "nosuch", Description: &description}, admin)
+	assert.Equal(t, model.RoleNotExistErr.Error(), response.Error)
+	_, response = call("/role/update", api.UpdateRole{Role: "sre", Description: &description}, login(t, "oncall", "123456"))
+	assert.Equal(t, middleware.PermissionDeniedErr.Error(), response.Error)
+}
+
+// dry run, atomic rollback, pre-hashed passwords, resumable csv batches through the cli
+func TestImportExport(t *testing.T) {
+	createUser(t, "importer", "123456", model.AdminRole)
+	admin := login(t, "importer", "123456")
+	t.Cleanup(func() {
+		for _, name := range []string{"impa", "impb", "impc", "impd", "impe", "impf"} {
+			model.DeleteUser(name)
+		}
+		model.DeleteRole("imported")
+	})
+
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("bcrypt-pw"), bcrypt.MinCost)
+	salt := []byte("0123456789abcdef")
+	argon2Hash := fmt.Sprintf("$argon2id$v=19$m=1024,t=1,p=1$%s$%s", base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("argon2-pw"), salt, 1, 1024, 1, 32)))
+	jsonl := strings.Join([]string{
+		`{"type":"role","role":"imported","description":"from legacy"}`,
+		`{"type":"user","username":"impa","passwordHash":"` + string(bcryptHash) + `","email":"impa@example.com","emailVerified":true}`,
+		`{"type":"user","username":"impb","passwordHash":"` + argon2Hash + `","disabled":false}`,
+		`{"type":"grant","username":"impa","role":"imported"}`,
+		`{"type":"grant","username":"impc","role":"imported"}`,
+		`{"type":"user","username":"impd","passwordHash":"plain"}`,
+		`not json`,
+	}, "\n")
+
+	importFile := func(query, body string) model.ImportReport {
+		req := httptest.NewRequest("POST", "/admin/import?"+query, strings.NewReader(body))
+		req.Header.Set("token", admin)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var report model.ImportReport
+		response := api.Response{Data: &report}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		assert.Equal(t, "", response.Error)
+		return report
+	}
+
+	report := importFile("dryRun=true", jsonl)
+	assert.Equal(t, 7, report.Total)
+	assert.Equal(t, 0, report.Applied)
+	assert.Equal(t, []model.ImportError{
+		{Row: 5, Error: model.UserNotExistErr.Error()},
+		{Row: 6, Error: model.PwdHashErr.Error()},
+		{Row: 7, Error: "invalid character 'o' in literal null (expecting 'u')"},
+	}, report.Errors)
+
+	// atomic, nothing applied with errors
+	report = importFile("mode=atomic", jsonl)
+	assert.Len(t, report.Errors, 3)
+	assert.Nil(t, model.GetUser("impa"))
+	assert.Nil(t, model.GetRole("imported"))
+
+	lines := strings.Split(jsonl, "\n")
+	report = importFile("mode=atomic", strings.Join(lines[:4], "\n"))
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, 4, report.Applied)
+	assert.True(t, model.GetUser("impa").CheckRole("imported"))
+	assert.True(t, model.GetUser("impa").IsEmailVerified())
+
+	// imported hashes login, argon2 is re-hashed with bcrypt
+	login(t, "impa", "bcrypt-pw")
+	login(t, "impb", "argon2-pw")
+	assert.True(t, strings.HasPrefix(model.GetUser("impb").Password, "$2a$"))
+	login(t, "impb", "argon2-pw")
+
+	// argon2 parameters are bounded, each login would evaluate them
+	for _, params := range []string{"m=4194304,t=1,p=1", "m=1024,t=11,p=1", "m=1024,t=1,p=17"} {
+		assert.Equal(t, model.PwdHashParamsErr, model.CheckPwdHash(strings.Replace(argon2Hash, "m=1024,t=1,p=1", params, 1)))
+	}
+	long := fmt.Sprintf("$argon2id$v=19$m=1024,t=1,p=1$%s$%s", base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(make([]byte, model.Argon2MaxKeyLen+1)))
+	assert.Equal(t, model.PwdHashParamsErr, model.CheckPwdHash(long))
+
+	// resumable batches through the cli
+	server := httptest.NewServer(router)
+	defer server.Close()
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "users.csv")
+	os.WriteFile(csvFile, []byte("type,username,password,role\n"+
+		"user,impc,123456,\n"+
+		"user,impa,123456,\n"+
+		"grant,impc,,imported\n"+
+		"user,impe,123456,\n"), 0600)
+	var out bytes.Buffer
+	err := cli.Import([]string{"-server", server.URL, "-token", admin, "-mode", "batch", "-batch", "2", csvFile}, &out)
+	assert.Equal(t, cli.ImportFailedErr, err)
+	assert.Equal(t, "row 2: user already exist\nrows 1-2 of 4, applied 1, errors 1\nrows 3-4 of 4, applied 2, errors 0\n", out.String())
+	assert.True(t, model.GetUser("impc").CheckRole("imported"))
+	assert.NotNil(t, model.GetUser("impe"))
+
+	exportFile := filepath.Join(dir, "export.jsonl")
+	assert.Nil(t, cli.Export([]string{"-server", server.URL, "-token", admin, "-o", exportFile}, &out))
+	b, _ := os.ReadFile(exportFile)
+	records, err := model.DecodeTransfer(bytes.NewReader(b), model.TransferJSONL)
+	assert.Nil(t, err)
+	found := 0
+	for _, rec := range records {
+		switch {
+		case rec.Type == model.TransferRole && rec.Role == "imported":
+			assert.Equal(t, "from legacy", rec.Description)
+			found++
+		case rec.Type == model.TransferUser && rec.Username == "impa":
+			assert.Equal(t, string(bcryptHash), rec.PasswordHash)
+			assert.Equal(t, model.GetUser("impa").ID, rec.ID)
+			found++
+		case rec.Type == model.TransferGrant && rec.Username == "impc":
+			assert.Equal(t, "imported", rec.Role)
+			found++
+		}
+	}
+	assert.Equal(t, 3, found)
+
+	// exported csv imports back into an empty dry run
+	req := httptest.NewRequest("GET", "/admin/export?format=csv", nil)
+	req.Header.Set("token", admin)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	csvRecords, err := model.DecodeTransfer(w.Body, model.TransferCSV)
+	assert.Nil(t, err)
+	assert.Equal(t, len(records), len(csvRecords))
+
+	// user ids are kept on import, and not given to another user
+	impa := model.GetUser("impa").ID
+	report = importFile("mode=atomic&dryRun=true", strings.Join([]string{
+		`{"type":"user","id":"` + impa + `","username":"impf","password":"123456"}`,
+		`{"type":"user","id":"IMPF","username":"impf","password":"123456"}`,
+	}, "\n"))
+	assert.Equal(t, []model.ImportError{
+		{Row: 1, Error: model.UserIDExistErr.Error()},
+		{Row: 2, Error: model.UserIDErr.Error()},
+	}, report.Errors)
+	id := strings.Repeat("0f", model.UserIDLength/2)
+	report = importFile("mode=atomic", `{"type":"user","id":"`+id+`","username":"impf","password":"123456"}`)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, id, model.GetUser("impf").ID)
+
+	// a username created again is another user
+	model.DeleteUser("impe")
+	createUser(t, "impe", "123456")
+	for _, rec := range records {
+		if rec.Type == model.TransferUser && rec.Username == "impe" {
+			assert.NotEqual(t, rec.ID, model.GetUser("impe").ID)
+		}
+	}
+}
+
+// scim provisioning of users and groups with bearer auth
+func TestSCIM(t *testing.T) {
+	middleware.SCIMToken = "scim-0123456789abcdef0123456789abcdef"
+	defer func() { middleware.SCIMToken = "" }()
+	t.Cleanup(func() {
+		model.DeleteUser("scima")
+		model.DeleteUser("scimb")
+		model.DeleteRole("scimops")
+		model.DeleteRole("scimsre")
+	})
+
+	scim := func(method, path string, body interface{}) (int, map[string]interface{}) {
+		bearer := "Bearer " + middleware.SCIMToken
+		w := post("/scim/v2"+path, method, body, map[string]*string{"Authorization": &bearer}, router)
+		var data map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &data)
+		if w.Code != http.StatusNoContent {
+			assert.Equal(t, api.SCIMContentType, w.Header().Get("Content-Type"))
+		}
+		return w.Code, data
+	}
+
+	w := post("/scim/v2/Users", "GET", nil, nil, router)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	code, user := scim("POST", "/Users", map[string]interface{}{
+		"schemas":                []string{api.SCIMUserSchema, api.SCIMEnterpriseSchema},
+		"userName":               "SCIMA",
+		"externalId":             "hr-1",
+		"name":                   map[string]string{"formatted": "Scim A"},
+		"emails":                 []map[string]interface{}{{"value": "scima@example.com", "primary": true}},
+		"active":                 false,
+		"password":               "123456",
+		api.SCIMEnterpriseSchema: map[string]string{"department": "R&D"},
+	})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "scima", user["id"])
+	assert.Equal(t, false, user["active"])
+	assert.Equal(t, "Scim A", user["displayName"])
+	assert.Equal(t, "R&D", model.GetUser("scima").GetProfile().Department)
+	assert.True(t, model.GetUser("scima").IsDisabled())
+
+	code, body := scim("POST", "/Users", map[string]interface{}{"userName": "scima"})
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, "uniqueness", body["scimType"])
+	code, _ = scim("POST", "/Users", map[string]interface{}{"userName": "scimb", "externalId": "hr-2"})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.False(t, model.GetUser("scimb").CheckPwd(""))
+
+	code, body = scim("GET", `/Users?filter=userName+eq+"scima"`, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(1), body["totalResults"])
+	code, body = scim("GET", `/Users?filter=externalId+eq+"hr-2"`, nil)
+	assert.Equal(t, "scimb", body["Resources"].([]interface{})[0].(map[string]interface{})["userName"])
+	code, body = scim("GET", `/Users?filter=emails+co+"x"`, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "invalidFilter", body["scimType"])
+
+	// azure style patch without path, string boolean
+	code, user = scim("PATCH", "/Users/scima", map[string]interface{}{
+		"schemas": []string{api.SCIMPatchSchema},
+		"Operations": []map[string]interface{}{
+			{"op": "Replace", "value": map[string]interface{}{"active": "True", "displayName": "Scim AA"}},
+			{"op": "replace", "path": `emails[type eq "work"].value`, "value": "new@example.com"},
+		},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, user["active"])
+	assert.Equal(t, "Scim AA", user["displayName"])
+	assert.Equal(t, "new@example.com", model.GetUser("scima").GetProfile().Email)
+	login(t, "scima", "123456")
+
+	code, body = scim("PUT", "/Users/scima", map[string]interface{}{"userName": "other"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "mutability", body["scimType"])
+
+	// groups
+	code, group := scim("POST", "/Groups", map[string]interface{}{
+		"displayName": "scimops",
+		"members":     []map[string]string{{"value": "scima"}},
+	})
+	assert.Equal(t, http.StatusCreated, code)
+	id := group["id"].(string)
+	assert.True(t, model.GetUser("scima").CheckRole("scimops"))
+	code, _ = scim("POST", "/Groups", map[string]interface{}{"displayName": "scimx", "members": []map[string]string{{"value": "nobody"}}})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, group = scim("PATCH", "/Groups/"+id, map[string]interface{}{
+		"schemas": []string{api.SCIMPatchSchema},
+		"Operations": []map[string]interface{}{
+			{"op": "add", "path": "members", "value": []map[string]string{{"value": "scimb"}}},
+			{"op": "remove", "path": `members[value eq "scima"]`},
+		},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"value": "scimb", "display": "scimb", "$ref": controller.BaseURL + "/scim/v2/Users/scimb",
+	}}, group["members"])
+
+	// rename keeps the id, members replaced
+	code, group = scim("PUT", "/Groups/"+id, map[string]interface{}{
+		"displayName": "scimsre",
+		"members":     []map[string]string{{"value": "scima"}, {"value": "scimb"}},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, id, group["id"])
+	assert.Len(t, group["members"], 2)
+	assert.True(t, model.GetUser("scimb").CheckRole("scimsre"))
+	_, user = scim("GET", "/Users/scimb", nil)
+	assert.Equal(t, "scimsre", user["groups"].([]interface{})[0].(map[string]interface{})["display"])
+
+	code, body = scim("GET", `/Groups?filter=displayName+eq+"scimsre"&count=1`, nil)
+	assert.Equal(t, float64(1), body["itemsPerPage"])
+
+	// the admin role is not managed by scim, nor the passwords of admins
+	model.CreateRole(model.AdminRole, "", nil)
+	adminID := model.GetRole(model.AdminRole).ID
+	code, _ = scim("POST", "/Groups", map[string]interface{}{"displayName": "Admin", "members": []map[string]string{{"value": "scimb"}}})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = scim("PATCH", "/Groups/"+adminID, map[string]interface{}{
+		"schemas":    []string{api.SCIMPatchSchema},
+		"Operations": []map[string]interface{}{{"op": "add", "path": "members", "value": []map[string]string{{"value": "scimb"}}}},
+	})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = scim("PUT", "/Groups/"+id, map[string]interface{}{"displayName": model.AdminRole})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = scim("DELETE", "/Groups/"+adminID, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.False(t, model.GetUser("scimb").CheckRole(model.AdminRole))
+	assert.Equal(t, "scimsre", model.GetRoleByID(id).Name)
+
+	assert.Nil(t, model.GetUser("scima").AddRole(model.GetRole(model.AdminRole)))
+	code, _ = scim("PUT", "/Users/scima", map[string]interface{}{"userName": "scima", "password": "654321"})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = scim("PATCH", "/Users/scima", map[string]interface{}{
+		"schemas":    []string{api.SCIMPatchSchema},
+		"Operations": []map[string]interface{}{{"op": "replace", "path": "password", "value": "654321"}},
+	})
+	assert.Equal(t, http.StatusForbidden, code)
+	login(t, "scima", "123456")
+
+	// replace sets every attribute at once
+	code, user = scim("PUT", "/Users/scima", map[string]interface{}{"userName": "scima", "active": false})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "", model.GetUser("scima").GetProfile().Email)
+	assert.Equal(t, "", model.GetUser("scima").GetExternalID())
+	assert.True(t, model.GetUser("scima").IsDisabled())
+
+	code, _ = scim("DELETE", "/Groups/"+id, nil)
+	assert.Equal(t, http.StatusNoContent, code)
+	assert.False(t, model.GetUser("scimb").CheckRole("scimsre"))
+	code, _ = scim("DELETE", "/Users/scimb", nil)
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = scim("GET", "/Users/scimb", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+// authorization code with pkce, refresh rotation, client credentials, client deletion
+func TestOAuth(t *testing.T) {
+	createUser(t, "oauthadmin", "123456", model.AdminRole)
+	createUser(t, "oauthuser", "123456")
+	admin := login(t, "oauthadmin", "123456")
+
+	_, response := call("/oauth/client/create", api.CreateClient{
+		Name:   "native",
+		Grants: []string{model.GrantClientCredentials},
+		Public: true,
+	}, admin)
+	assert.Equal(t, model.ClientPublicErr.Error(), response.Error)
+
+	_, response = call("/oauth/client/create", api.CreateClient{
+		Name:         "webapp",
+		RedirectURIs: []string{"https://app.example.com/cb"},
+		Grants:       []string{model.GrantAuthorizationCode, model.GrantRefreshToken, model.GrantClientCredentials},
+		Scopes:       []string{"read", "write"},
+	}, admin)
+	assert.Equal(t, "", response.Error)
+	created := response.Data.(map[string]interface{})
+	clientID, secret := created["clientId"].(string), created["clientSecret"].(string)
+	defer model.DeleteClient(clientID)
+
+	_, response = call("/oauth/client/create", api.CreateClient{
+		Name:         "spa",
+		RedirectURIs: []string{"http://localhost:3000/cb"},
+		Public:       true,
+	}, admin)
+	publicID := response.Data.(map[string]interface{})["clientId"].(string)
+	defer model.DeleteClient(publicID)
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	authorize := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {"https://app.example.com/cb"},
+		"scope":                 {"read"},
+		"state":                 {"xyz"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	csrf := "oauth-csrf-0123456789" // double-submit cookie of the login form
+	form := func(path string, values url.Values, user, pwd string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: model.TokenCookie + controller.CSRFCookieSuffix, Value: csrf})
+		if len(user) > 0 {
+			req.SetBasicAuth(user, pwd)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	oauthToken := func(w *httptest.ResponseRecorder) (api.OAuthToken, api.OAuthError) {
+		var token api.OAuthToken
+		var oauthErr api.OAuthError
+		json.Unmarshal(w.Body.Bytes(), &token)
+		json.Unmarshal(w.Body.Bytes(), &oauthErr)
+		return token, oauthErr
+	}
+	getCode := func() string {
+		values := url.Values{"username": {"oauthuser"}, "password": {"123456"}, "csrf_token": {csrf}}
+		for k, v := range authorize {
+			values[k] = v
+		}
+		w := form("/oauth/authorize", values, "", "")
+		assert.Equal(t, http.StatusFound, w.Code)
+		location, _ := url.Parse(w.Header().Get("Location"))
+		assert.Equal(t, "app.example.com", location.Host)
+		assert.Equal(t, "xyz", location.Query().Get("state"))
+		return location.Query().Get("code")
+	}
+
+	// login form, errors
+	w := post("/oauth/authorize?"+authorize.Encode(), "GET", nil, nil, router)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `<form method="post" action="/oauth/authorize">`)
+	bad := url.Values{"client_id": {clientID}, "redirect_uri": {"https://evil.example.com/cb"}, "response_type": {"code"}}
+	w = post("/oauth/authorize?"+bad.Encode(), "GET", nil, nil, router)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	bad = url.Values{"client_id": {clientID}, "response_type": {"code"}, "state": {"s"}, "code_challenge_method": {"plain"}}
+	w = post("/oauth/authorize?"+bad.Encode(), "GET", nil, nil, router)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "https://app.example.com/cb?error=invalid_request")
+	values := url.Values{"username": {"oauthuser"}, "password": {"654321"}, "csrf_token": {csrf}}
+	for k, v := range authorize {
+		values[k] = v
+	}
+	w = form("/oauth/authorize", values, "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), model.UserCheckErr.Error())
+
+	// the login form is bound to the browser, against login csrf
+	values.Set("password", "123456")
+	values.Del("csrf_token")
+	w = form("/oauth/authorize", values, "", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), api.PageFormErr.Error())
+	values.Set("csrf_token", "other")
+	w = form("/oauth/authorize", values, "", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// code exchange, single use
+	code := getCode()
+	exchange := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"https://app.example.com/cb"}, "code_verifier": {verifier}}
+	w = form("/oauth/token", exchange, clientID, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = form("/oauth/token", exchange, clientID, secret)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	token, _ := oauthToken(w)
+	assert.Equal(t, "Bearer", token.TokenType)
+	assert.Equal(t, "read", token.Scope)
+	assert.NotEmpty(t, token.RefreshToken)
+	assert.Equal(t, clientID, model.GetToken(token.AccessToken).ClientID)
+	_, response = call("/user/roles", nil, token.AccessToken)
+	assert.Equal(t, "", response.Error)
+	w = form("/oauth/token", exchange, clientID, secret)
+	_, oauthErr := oauthToken(w)
+	assert.Equal(t, api.OAuthInvalidGrant, oauthErr.Error)
+
+	exchange.Set("code", getCode())
+	exchange.Set("code_verifier", strings.Repeat("a", 43))
+	w = form("/oauth/token", exchange, clientID, secret)
+	_, oauthErr = oauthToken(w)
+	assert.Equal(t, model.PKCEErr.Error(), oauthErr.ErrorDescription)
+
+	// confidential clients may omit pkce, a code_verifier is then rejected
+	authorize.Del("code_challenge")
+	authorize.Del("code_challenge_method")
+	exchange.Set("code", getCode())
+	exchange.Set("code_verifier", verifier)
+	w = form("/oauth/token", exchange, clientID, secret)
+	_, oauthErr = oauthToken(w)
+	assert.Equal(t, model.PKCEErr.Error(), oauthErr.ErrorDescription)
+	exchange.Set("code", getCode())
+	exchange.Del("code_verifier")
+	w = form("/oauth/token", exchange, clientID, secret)
+	assert.Equal(t, http.StatusOK, w.Code)
+	authorize.Set("code_challenge", challenge)
+	authorize.Set("code_challenge_method", "S256")
+
+	// refresh rotation
+	refresh := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token.RefreshToken}, "client_id": {clientID}, "client_secret": {secret}}
+	w = form("/oauth/token", refresh, "", "")
+	refreshed, _ := oauthToken(w)
+	assert.NotEmpty(t, refreshed.AccessToken)
+	assert.NotEqual(t, token.RefreshToken, refreshed.RefreshToken)
+	w = form("/oauth/token", refresh, "", "")
+	_, oauthErr = oauthToken(w)
+	assert.Equal(t, api.OAuthInvalidGrant, oauthErr.Error)
+
+	// client credentials
+	w = form("/oauth/token", url.Values{"grant_type": {"client_credentials"}, "scope": {"admin"}}, clientID, secret)
+	_, oauthErr = oauthToken(w)
+	assert.Equal(t, api.OAuthInvalidScope, oauthErr.Error)
+	w = form("/oauth/token", url.Values{"grant_type": {"client_credentials"}}, clientID, secret)
+	machine, _ := oauthToken(w)
+	assert.Equal(t, "read write", machine.Scope)
+	assert.Empty(t, machine.RefreshToken)
+	w = post("/user/roles", "POST", nil, map[string]*string{"token": &machine.AccessToken}, router)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), middleware.ClientTokenErr.Error())
+
+	// public client, pkce without secret
+	authorize.Set("client_id", publicID)
+	authorize.Set("redirect_uri", "http://localhost:3000/cb")
+	authorize.Del("scope")
+	exchange = url.Values{"grant_type": {"authorization_code"}, "code": {""}, "redirect_uri": {"http://localhost:3000/cb"}, "code_verifier": {verifier}, "client_id": {publicID}}
+	values = url.Values{"username": {"oauthuser"}, "password": {"123456"}, "csrf_token": {csrf}}
+	for k, v := range authorize {
+		values[k] = v
+	}
+	w = form("/oauth/authorize", values, "", "")
+	location, _ := url.Parse(w.Header().Get("Location"))
+	exchange.Set("code", location.Query().Get("code"))
+	w = form("/oauth/token", exchange, "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	bad = url.Values{"client_id": {publicID}, "response_type": {"code"}, "state": {"s"}}
+	w = post("/oauth/authorize?"+bad.Encode(), "GET", nil, nil, router)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "http://localhost:3000/cb?error=invalid_request")
+	w = form("/oauth/token", url.Values{"grant_type": {"client_credentials"}, "client_id": {publicID}}, "", "")
+	_, oauthErr = oauthToken(w)
+	assert.Equal(t, api.OAuthUnauthorizedClient, oauthErr.Error)
+
+	// deleting the client revokes its tokens
+	_, response = call("/oauth/client/delete", api.DeleteClient{ClientID: clientID}, admin)
+	assert.Equal(t, "", response.Error)
+	assert.Nil(t, model.GetToken(refreshed.AccessToken))
+	assert.Nil(t, model.GetToken(machine.AccessToken))
+}
+
+// discovery, id tokens signed with published keys, userinfo, roles claim
+func TestOIDC(t *testing.T) {
+	createUser(t, "oidcadmin", "123456", model.AdminRole)
+	createUser(t, "oidcuser", "123456", "oidcviewer")
+	admin := login(t, "oidcadmin", "123456")
+	email, name := "oidcuser@example.com", "OIDC User"
+	assert.Nil(t, model.GetUser("oidcuser").UpdateProfile(&email, &name, nil, nil, true))
+
+	_, response := call("/oauth/client/create", api.CreateClient{
+		Name:         "grafana",
+		RedirectURIs: []string{"https://grafana.example.com/login/generic_oauth"},
+	}, admin)
+	created := response.Data.(map[string]interface{})
+	clientID, secret := created["clientId"].(string), created["clientSecret"].(string)
+	defer model.DeleteClient(clientID)
+
+	w := post(controller.OIDCConfigurationPath, "GET", nil, nil, router)
+	var configuration api.OIDCConfiguration
+	json.Unmarshal(w.Body.Bytes(), &configuration)
+	assert.Equal(t, controller.BaseURL, configuration.Issuer)
+	assert.Equal(t, controller.BaseURL+"/jwks.json", configuration.JWKSURI)
+	assert.Equal(t, controller.BaseURL+"/userinfo", configuration.UserinfoEndpoint)
+	assert.Contains(t, configuration.IDTokenSigningAlgValuesSupported, "RS256")
+
+	controller.RolesClaim = "groups"
+	defer func() { controller.RolesClaim = "roles" }()
+
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	values := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {"https://grafana.example.com/login/generic_oauth"},
+		"scope":                 {"openid profile email"},
+		"state":                 {"s"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+		"username":              {"oidcuser"},
+		"password":              {"123456"},
+		"csrf_token":            {"oidc-csrf"},
+	}
+	form := func(path string, values url.Values, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	w = form("/oauth/authorize", values, map[string]string{"Cookie": model.TokenCookie + controller.CSRFCookieSuffix + "=oidc-csrf"})
+	location, _ := url.Parse(w.Header().Get("Location"))
+	w = form("/oauth/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {location.Query().Get("code")},
+		"redirect_uri":  {"https://grafana.example.com/login/generic_oauth"},
+		"code_verifier": {verifier},
+		"client_id":     {clientID},
+		"client_secret": {secret},
+	}, nil)
+	var token api.OAuthToken
+	json.Unmarshal(w.Body.Bytes(), &token)
+	assert.NotEmpty(t, token.IDToken)
+
+	claims, err := model.VerifyJWT(token.IDToken)
+	assert.Nil(t, err)
+	assert.Equal(t, controller.BaseURL, claims["iss"])
+	subject := model.GetUser("oidcuser").ID
+	assert.Len(t, subject, model.UserIDLength)
+	assert.Equal(t, subject, claims["sub"])
+	assert.Equal(t, "oidcuser", claims["preferred_username"])
+	assert.Equal(t, clientID, claims["aud"])
+	assert.Equal(t, "n-0S6_WzA2Mj", claims["nonce"])
+	assert.Equal(t, name, claims["name"])
+	assert.Equal(t, email, claims["email"])
+	assert.Equal(t, []interface{}{"oidcviewer"}, claims["groups"])
+	assert.NotZero(t, claims["auth_time"])
+
+	// the signing key is published, and the previous one after rotation
+	var jwks api.JWKS
+	w = post("/jwks.json", "GET", nil, nil, router)
+	json.Unmarshal(w.Body.Bytes(), &jwks)
+	header, _ := base64.RawURLEncoding.DecodeString(strings.Split(token.IDToken, ".")[0])
+	assert.Contains(t, string(header), `"kid":"`+jwks.Keys[0].Kid+`"`)
+	_, err = model.RotateSigningKey("")
+	assert.Nil(t, err)
+	w = post("/jwks.json", "GET", nil, nil, router)
+	json.Unmarshal(w.Body.Bytes(), &jwks)
+	assert.Equal(t, 2, len(jwks.Keys))
+	_, err = model.VerifyJWT(token.IDToken)
+	assert.Nil(t, err)
+	parts := strings.Split(token.IDToken, ".")
+	_, err = model.VerifyJWT(parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"oidcadmin"}`)) + "." + parts[2])
+	assert.Equal(t, model.JWTSignatureErr, err)
+
+	// userinfo
+	bearer := "Bearer " + token.AccessToken
+	w = post("/userinfo", "GET", nil, map[string]*string{"Authorization": &bearer}, router)
+	assert.Equal(t, http.StatusOK, w.Code)
+	info := make(map[string]interface{}, 0)
+	json.Unmarshal(w.Body.Bytes(), &info)
+	assert.Equal(t, subject, info["sub"])
+	assert.Equal(t, []interface{}{"oidcviewer"}, info["groups"])
+	w = form("/userinfo", url.Values{"access_token": {token.AccessToken}}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = post("/userinfo", "GET", nil, map[string]*string{"token": &token.AccessToken}, router)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer realm="oauth"`, w.Header().Get("WWW-Authenticate"))
+	bearer = "Bearer " + strings.Repeat("0", model.TokenLength)
+	w = post("/userinfo", "GET", nil, map[string]*string{"Authorization": &bearer}, router)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+	bearer = "Bearer " + admin
+	w = post("/userinfo", "GET", nil, map[string]*string{"Authorization": &bearer}, router)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// refreshed id tokens keep auth_time, without nonce
+	w = form("/oauth/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token.RefreshToken}}, map[string]string{
+		"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(clientID+":"+secret)),
+	})
+	var refreshed api.OAuthToken
+	json.Unmarshal(w.Body.Bytes(), &refreshed)
+	claims2, err := model.VerifyJWT(refreshed.IDToken)
+	assert.Nil(t, err)
+	assert.Equal(t, claims["auth_time"], claims2["auth_time"])
+	assert.Nil(t, claims2["nonce"])
+}
+
+// rotation with each alg, revocation, scheduled rotation and pruning, encrypted key files
+func TestSigningKeys(t *testing.T) {
+	createUser(t, "keyadmin", "123456", model.AdminRole)
+	admin := login(t, "keyadmin", "123456")
+
+	_, response := call("/admin/keys/rotate", api.RotateKey{Alg: "HS256"}, admin)
+	assert.Equal(t, model.SigningAlgErr.Error(), response.Error)
+
+	signed := make(map[string]string, 0) // alg => jwt
+	kids := make(map[string]string, 0)   // alg => kid
+	for _, alg := range model.SigningAlgs {
+		_, response = call("/admin/keys/rotate", api.RotateKey{Alg: alg}, admin)
+		assert.Equal(t, "", response.Error)
+		kids[alg] = response.Data.(map[string]interface{})["kid"].(string)
+		token, err := model.SignJWT(map[string]interface{}{"sub": alg, "exp": time.Now().Unix() + 60})
+		assert.Nil(t, err)
+		signed[alg] = token
+	}
+	// retired keys still verify
+	for alg, token := range signed {
+		claims, err := model.VerifyJWT(token)
+		assert.Nil(t, err)
+		assert.Equal(t, alg, claims["sub"])
+	}
+	var jwks api.JWKS
+	w := post("/jwks.json", "GET", nil, nil, router)
+	json.Unmarshal(w.Body.Bytes(), &jwks)
+	published := make(map[string]model.JWK, 0)
+	for _, k := range jwks.Keys {
+		published[k.Kid] = k
+	}
+	assert.Equal(t, "RSA", published[kids[model.JWTAlgRS256]].Kty)
+	assert.Equal(t, "P-256", published[kids[model.JWTAlgES256]].Crv)
+	assert.Equal(t, "Ed25519", published[kids[model.JWTAlgEdDSA]].Crv)
+
+	w = post("/admin/keys", "GET", nil, map[string]*string{"token": &admin}, router)
+	var keys struct {
+		Data []model.SigningKey `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &keys)
+	assert.Equal(t, kids[model.JWTAlgEdDSA], keys.Data[0].ID)
+	assert.Zero(t, keys.Data[0].RetiredAt)
+	assert.NotZero(t, keys.Data[1].RetiredAt)
+
+	// revoke a retired key, then the active one
+	_, response = call("/admin/keys/revoke", api.RevokeKey{Kid: kids[model.JWTAlgES256]}, admin)
+	assert.Equal(t, "", response.Error)
+	_, err := model.VerifyJWT(signed[model.JWTAlgES256])
+	assert.Equal(t, model.JWTSignatureErr, err)
+	_, response = call("/admin/keys/revoke", api.RevokeKey{Kid: kids[model.JWTAlgES256]}, admin)
+	assert.Equal(t, model.SigningKeyNotExistErr.Error(), response.Error)
+	_, response = call("/admin/keys/revoke", api.RevokeKey{Kid: kids[model.JWTAlgEdDSA]}, admin)
+	assert.Equal(t, "", response.Error)
+	active, err := model.ActiveSigningKey()
+	assert.Nil(t, err)
+	assert.NotEqual(t, kids[model.JWTAlgEdDSA], active.ID)
+	assert.Equal(t, model.SigningAlg, active.Alg)
+
+	// scheduled rotation, retired keys are removed when their tokens have expired
+	active.CreatedAt -= model.SigningKeyRotation
+	assert.Nil(t, model.ScheduleSigningKeys())
+	rotated, _ := model.ActiveSigningKey()
+	assert.NotEqual(t, active.ID, rotated.ID)
+	_, err = model.VerifyJWT(signed[model.JWTAlgRS256])
+	assert.Nil(t, err)
+	retire := func(age int64) {
+		for _, k := range model.SigningKeys[1:] {
+			k.RetiredAt = time.Now().Unix() - age
+		}
+		assert.Nil(t, model.ScheduleSigningKeys())
+	}
+	kept := len(model.ListSigningKeys())
+	assert.Less(t, 1, kept)
+	retire(model.IDTokenLifeTime() + 1) // tokens of the max age are still valid
+	assert.Equal(t, kept, len(model.ListSigningKeys()))
+	model.CreateRole("longsession", "", nil)
+	defer model.DeleteRole("longsession")
+	model.SetRoleSessionPolicy("longsession", &model.SessionPolicy{IdleTimeout: 3600, MaxAge: 2 * model.SessionMaxAge})
+	assert.Equal(t, 2*model.SessionMaxAge, model.SigningKeyRetention())
+	retire(model.SessionMaxAge + 1)
+	assert.Equal(t, kept, len(model.ListSigningKeys()))
+	retire(2*model.SessionMaxAge + 1)
+	assert.Equal(t, 1, len(model.ListSigningKeys()))
+	_, err = model.VerifyJWT(signed[model.JWTAlgRS256])
+	assert.Equal(t, model.JWTSignatureErr, err)
+
+	// key files
+	dir := t.TempDir()
+	saved, savedKeys, savedSecret := model.SigningKeyDir, model.SigningKeys, model.SigningKeySecret
+	defer func() {
+		model.SigningKeyDir, model.SigningKeys, model.SigningKeySecret = saved, savedKeys, savedSecret
+	}()
+	model.SigningKeySecret = []byte("short")
+	assert.Equal(t, model.SigningKeySecretErr, model.LoadSigningKeys(dir))
+	model.SigningKeySecret = []byte("0123456789abcdef0123")
+	assert.Nil(t, model.LoadSigningKeys(dir))
+	_, err = model.RotateSigningKey(model.JWTAlgES256)
+	assert.Nil(t, err)
+	token, _ := model.SignJWT(map[string]interface{}{"sub": "persisted"})
+	_, err = model.RotateSigningKey(model.JWTAlgEdDSA)
+	assert.Nil(t, err)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Equal(t, 2, len(files))
+	content, _ := os.ReadFile(files[0])
+	assert.NotContains(t, string(content), "PRIVATE KEY")
+
+	model.SigningKeys = nil
+	assert.Nil(t, model.LoadSigningKeys(dir))
+	assert.Equal(t, 2, len(model.ListSigningKeys()))
+	assert.Equal(t, model.JWTAlgEdDSA, model.ListSigningKeys()[0].Alg)
+	claims, err := model.VerifyJWT(token)
+	assert.Nil(t, err)
+	assert.Equal(t, "persisted", claims["sub"])
+	model.SigningKeySecret = []byte("fedcba9876543210fedc")
+	assert.ErrorIs(t, model.LoadSigningKeys(dir), model.SigningKeyDecryptErr)
+}
+
+// rfc 7662 introspection and rfc 7009 revocation, authenticated by client credentials
+func TestOAuthIntrospection(t *testing.T) {
+	createUser(t, "introuser", "123456", "introrole")
+	user := model.GetUser("introuser")
+	gateway, gatewaySecret, _ := model.CreateClient("gateway", nil, []string{model.GrantClientCredentials}, nil, false)
+	app, appSecret, _ := model.CreateClient("app", []string{"https://app.example.com/cb"}, []string{model.GrantAuthorizationCode, model.GrantRefreshToken}, []string{"read"}, false)
+	spa, _, _ := model.CreateClient("spa", []string{"https://spa.example.com/cb"}, nil, nil, true)
+	defer model.DeleteClient(gateway.ID)
+	defer model.DeleteClient(app.ID)
+	defer model.DeleteClient(spa.ID)
+
+	access := model.GenerateClientToken(user, app.ID, []string{"read"})
+	refresh, err := model.NewRefreshToken(app.ID, user, []string{"read"}, time.Now().Unix(), access.Token)
+	assert.Nil(t, err)
+
+	form := func(path string, values url.Values, id, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(id) > 0 {
+			req.SetBasicAuth(id, secret)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	introspect := func(token, hint string) api.OAuthIntrospection {
+		w := form("/oauth/introspect", url.Values{"token": {token}, "token_type_hint": {hint}}, gateway.ID, gatewaySecret)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var out api.OAuthIntrospection
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return out
+	}
+
+	out := introspect(access.Token, "")
+	assert.True(t, out.Active)
+	assert.Equal(t, model.GetUser("introuser").ID, out.Sub)
+	assert.Equal(t, "introuser", out.Username)
+	assert.Equal(t, app.ID, out.ClientID)
+	assert.Equal(t, "read", out.Scope)
+	assert.Equal(t, api.OAuthAccessToken, out.TokenType)
+	assert.Equal(t, access.ExpireAt, out.Exp)
+	assert.Equal(t, []string{"introrole"}, out.Roles)
+
+	out = introspect(refresh.Token, api.OAuthRefreshToken)
+	assert.True(t, out.Active)
+	assert.Equal(t, api.OAuthRefreshToken, out.TokenType)
+	out = introspect(refresh.Token, "")
+	assert.Equal(t, api.OAuthRefreshToken, out.TokenType)
+
+	out = introspect(login(t, "introuser", "123456"), "")
+	assert.True(t, out.Active)
+	assert.Empty(t, out.ClientID)
+
+	w := form("/oauth/introspect", url.Values{"token": {"unknown"}}, gateway.ID, gatewaySecret)
+	assert.Equal(t, `{"active":false}`, w.Body.String())
+	assert.Nil(t, model.SetDisabled("introuser", true))
+	assert.False(t, introspect(access.Token, "").Active)
+	assert.Nil(t, model.SetDisabled("introuser", false))
+
+	// only confidential clients may introspect
+	w = form("/oauth/introspect", url.Values{"token": {access.Token}}, "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = form("/oauth/introspect", url.Values{"token": {access.Token}, "client_id": {spa.ID}}, "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// revocation, by the client the token was issued to
+	w = form("/oauth/revoke", url.Values{"token": {refresh.Token}}, gateway.ID, gatewaySecret)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), api.OAuthUnauthorizedClient)
+	w = form("/oauth/revoke", url.Values{"token": {"unknown"}}, app.ID, appSecret)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = form("/oauth/revoke", url.Values{"token": {refresh.Token}, "token_type_hint": {api.OAuthRefreshToken}}, app.ID, appSecret)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, introspect(refresh.Token, api.OAuthRefreshToken).Active)
+	assert.False(t, introspect(access.Token, "").Active)
+
+	machine := model.GenerateClientToken(nil, gateway.ID, nil)
+	out = introspect(machine.Token, "")
+	assert.True(t, out.Active)
+	assert.Equal(t, gateway.ID, out.Sub)
+	w = form("/oauth/revoke", url.Values{"token": {machine.Token}, "client_id": {gateway.ID}, "client_secret": {gatewaySecret}}, "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, model.GetToken(machine.Token))
+}
+
+// rfc 8628 device authorization grant, polling errors, approval page and the cli
+func TestDeviceGrant(t *testing.T) {
+	createUser(t, "deviceadmin", "123456", model.AdminRole)
+	createUser(t, "deviceuser", "123456")
+	admin := login(t, "deviceadmin", "123456")
+
+	_, response := call("/oauth/client/create", api.CreateClient{
+		Name:   "deploy-cli",
+		Grants: []string{model.GrantDeviceCode, model.GrantRefreshToken},
+		Public: true,
+	}, admin)
+	assert.Equal(t, "", response.Error)
+	clientID := response.Data.(map[string]interface{})["clientId"].(string)
+	defer model.DeleteClient(clientID)
+	other, _, _ := model.CreateClient("web", []string{"https://web.example.com/cb"}, nil, nil, true)
+	defer model.DeleteClient(other.ID)
+
+	form := func(path string, values url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	authorize := func() api.OAuthDeviceCode {
+		w := form("/oauth/device_authorization", url.Values{"client_id": {clientID}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		var device api.OAuthDeviceCode
+		json.Unmarshal(w.Body.Bytes(), &device)
+		return device
+	}
+	poll := func(deviceCode string) (api.OAuthToken, api.OAuthError) {
+		w := form("/oauth/token", url.Values{"grant_type": {model.GrantDeviceCode}, "device_code": {deviceCode}, "client_id": {clientID}})
+		var token api.OAuthToken
+		var oauthErr api.OAuthError
+		json.Unmarshal(w.Body.Bytes(), &token)
+		json.Unmarshal(w.Body.Bytes(), &oauthErr)
+		return token, oauthErr
+	}
+	waited := func(deviceCode string) { // as if the interval has passed
+		model.DeviceCodes[deviceCode].LastPoll = 0
+	}
+
+	w := form("/oauth/device_authorization", url.Values{"client_id": {other.ID}})
+	assert.Contains(t, w.Body.String(), api.OAuthUnauthorizedClient)
+
+	device := authorize()
+	assert.Regexp(t, `^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$`, device.UserCode)
+	assert.Equal(t, controller.BaseURL+"/oauth/device", device.VerificationURI)
+	assert.Equal(t, int64(model.DeviceInterval), device.Interval)
+	_, oauthErr := poll(device.DeviceCode)
+	assert.Equal(t, api.OAuthAuthorizationPending, oauthErr.Error)
+	_, oauthErr = poll(device.DeviceCode)
+	assert.Equal(t, api.OAuthSlowDown, oauthErr.Error)
+	assert.Equal(t, int64(model.DeviceInterval+model.DeviceSlowDown), model.DeviceCodes[device.DeviceCode].Interval)
+
+	// verification page
+	w = post("/oauth/device?user_code="+url.QueryEscape(device.UserCode), "GET", nil, nil, router)
+	assert.Contains(t, w.Body.String(), "Connect deploy-cli")
+	w = post("/oauth/device?user_code=BBBB-BBBB", "GET", nil, nil, router)
+	assert.Contains(t, w.Body.String(), model.UserCodeErr.Error())
+	userCode := strings.ToLower(strings.ReplaceAll(device.UserCode, "-", ""))
+	w = form("/oauth/device", url.Values{"user_code": {userCode}, "username": {"deviceuser"}, "password": {"654321"}})
+	assert.Contains(t, w.Body.String(), model.UserCheckErr.Error())
+	w = form("/oauth/device", url.Values{"user_code": {userCode}, "username": {"deviceuser"}, "password": {"123456"}, "action": {"approve"}})
+	assert.Contains(t, w.Body.String(), "The device is connected")
+	w = form("/oauth/device", url.Values{"user_code": {userCode}, "username": {"deviceuser"}, "password": {"123456"}, "action": {"deny"}})
+	assert.Contains(t, w.Body.String(), model.UserCodeDecidedErr.Error())
+
+	waited(device.DeviceCode)
+	token, _ := poll(device.DeviceCode)
+	assert.NotEmpty(t, token.AccessToken)
+	assert.NotEmpty(t, token.RefreshToken)
+	assert.Equal(t, "deviceuser", model.GetToken(token.AccessToken).User.Username)
+	_, oauthErr = poll(device.DeviceCode)
+	assert.Equal(t, api.OAuthInvalidGrant, oauthErr.Error)
+
+	// denied
+	device = authorize()
+	w = form("/oauth/device", url.Values{"user_code": {device.UserCode}, "username": {"deviceuser"}, "password": {"123456"}, "action": {"deny"}})
+	assert.Contains(t, w.Body.String(), "The device is denied")
+	_, oauthErr = poll(device.DeviceCode)
+	assert.Equal(t, api.OAuthAccessDenied, oauthErr.Error)
+
+	// abandoned codes are swept after their lifetime
+	device = authorize()
+	kept := authorize()
+	model.DeviceCodes[device.DeviceCode].ExpireAt = time.Now().Unix() - 1
+	assert.Equal(t, 1, model.ExpireDeviceCodes())
+	assert.Nil(t, model.DeviceCodes[device.DeviceCode])
+	assert.Nil(t, model.GetDeviceCodeByUserCode(device.UserCode))
+	assert.NotNil(t, model.GetDeviceCodeByUserCode(kept.UserCode))
+	_, oauthErr = poll(device.DeviceCode)
+	assert.Equal(t, api.OAuthInvalidGrant, oauthErr.Error)
+	delete(model.DeviceCodes, kept.DeviceCode)
+	delete(model.UserCodes, model.NormalizeUserCode(kept.UserCode))
+
+	// cli, approved while it waits
+	server := httptest.NewServer(router)
+	defer server.Close()
+	defer func() { cli.Sleep = time.Sleep }()
+	cli.Sleep = func(time.Duration) {
+		for _, d := range model.DeviceCodes {
+			if d.ClientID == clientID {
+				model.DecideDeviceCode(d.UserCode, model.GetUser("deviceuser"), true)
+			}
+		}
+	}
+	var out bytes.Buffer
+	assert.Nil(t, cli.Login([]string{"-server", server.URL, "-client", clientID}, &out))
+	cliToken := model.GetToken(strings.TrimSpace(out.String()))
+	assert.NotNil(t, cliToken)
+	assert.Equal(t, clientID, cliToken.ClientID)
+}
+
+// role scopes restrict tokens to a subset of the user's roles
+func TestScopedTokens(t *testing.T) {
+	createUser(t, "scopeuser", "123456", "scopea", "scopeb", model.AdminRole)
+	scoped := func(scopes ...string) (string, api.Response) {
+		w, response := call("/auth/token", api.Token{Username: "scopeuser", Password: "123456", Scopes: scopes}, "")
+		return accessToken(w), response
+	}
+
+	_, response := scoped("role:ab")
+	assert.Equal(t, model.RoleScopeErr.Error(), response.Error)
+	_, response = scoped("role:scopec")
+	assert.Equal(t, model.RoleScopeNotHeldErr.Error(), response.Error)
+	_, response = scoped("role:scopea", "bad scope")
+	assert.Equal(t, model.ScopeErr.Error(), response.Error)
+
+	full := login(t, "scopeuser", "123456")
+	_, response = call("/user/roles", nil, full)
+	assert.Equal(t, []interface{}{model.AdminRole, "scopea", "scopeb"}, response.Data)
+
+	token, response := scoped("role:scopea", "ci")
+	assert.Equal(t, "", response.Error)
+	assert.Equal(t, []string{"role:#" + model.GetRole("scopea").ID, "ci"}, model.GetToken(token).Scopes)
+	_, response = call("/user/roles", nil, token)
+	assert.Equal(t, []interface{}{"scopea"}, response.Data)
+	_, response = call("/user/checkRole", api.CheckRole{Role: "scopea"}, token)
+	assert.Equal(t, true, response.Data)
+	_, response = call("/user/checkRole", api.CheckRole{Role: "scopeb"}, token)
+	assert.Equal(t, false, response.Data)
+	_, response = call("/auth/introspect", nil, token)
+	assert.Equal(t, []interface{}{"scopea"}, response.Data.(map[string]interface{})["roles"])
+
+	// admin endpoints need the admin role within the scopes
+	w := post("/users", "GET", nil, map[string]*string{"token": &token}, router)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = post("/users", "GET", nil, map[string]*string{"token": &full}, router)
+	assert.Equal(t, http.StatusOK, w.Code)
+	adminToken, _ := scoped(model.RoleScope(model.AdminRole))
+	w = post("/users", "GET", nil, map[string]*string{"token": &adminToken}, router)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// scopes are bound to role ids, a renamed role stays in
+	name := "scoped"
+	_, err := model.UpdateRole("scopea", &name, nil)
+	assert.Nil(t, err)
+	_, response = call("/user/roles", nil, token)
+	assert.Equal(t, []interface{}{"scoped"}, response.Data)
+	_, response = call("/auth/introspect", nil, token)
+	assert.Equal(t, []interface{}{"role:scoped", "ci"}, response.Data.(map[string]interface{})["scopes"])
+	_, response = call("/user/roles", nil, full)
+	assert.Equal(t, []interface{}{model.AdminRole, "scopeb", "scoped"}, response.Data)
+
+	// a role deleted and created again under the same name is another role
+	assert.Nil(t, model.DeleteRole("scoped"))
+	assert.Nil(t, model.CreateRole("scoped", "", nil))
+	assert.Nil(t, model.GetUser("scopeuser").AddRole(model.GetRole("scoped")))
+	_, response = call("/user/roles", nil, token)
+	assert.Equal(t, []interface{}{}, response.Data)
+	_, response = call("/user/checkRole", api.CheckRole{Role: "scoped"}, token)
+	assert.Equal(t, false, response.Data)
+}
+
+// service accounts authenticate with api keys only
+func TestAPIKeys(t *testing.T) {
+	createUser(t, "apikeyadmin", "123456", model.AdminRole)
+	admin := login(t, "apikeyadmin", "123456")
+	assert.Nil(t, model.CreateRole("apikeyrole", "", nil))
+
+	_, response := call("/serviceAccount/create", api.CreateServiceAccount{Username: "ciaccount", DisplayName: "CI"}, admin)
+	assert.Equal(t, "", response.Error)
+	_, response = call("/serviceAccount/create", api.CreateServiceAccount{Username: "ciaccount"}, admin)
+	assert.Equal(t, model.UserExistErr.Error(), response.Error)
+	account := model.GetUser("ciaccount")
+	assert.Equal(t, model.ServiceAccountLoginErr, account.CanLogin())
+	_, response = call("/auth/token", api.Token{Username: "ciaccount", Password: "123456"}, "")
+	assert.Equal(t, model.UserCheckErr.Error(), response.Error)
+	assert.Nil(t, account.AddRole(model.GetRole("apikeyrole")))
+
+	_, response = call("/apiKey/create", api.CreateAPIKey{Username: "ciaccount", Name: "deploy", Scopes: []string{"role:" + model.AdminRole}}, admin)
+	assert.Equal(t, model.RoleScopeNotHeldErr.Error(), response.Error)
+	_, response = call("/apiKey/create", api.CreateAPIKey{Username: "ciaccount", Name: "deploy", ExpireAt: time.Now().Unix() - 1}, admin)
+	assert.Equal(t, model.APIKeyExpireErr.Error(), response.Error)
+	_, response = call("/apiKey/create", api.CreateAPIKey{Username: "ciaccount", Name: "deploy key"}, admin)
+	assert.Equal(t, model.APIKeyNameErr.Error(), response.Error)
+	_, response = call("/apiKey/create", api.CreateAPIKey{Username: "ciaccount", Name: "deploy", Scopes: []string{"role:apikeyrole"}}, admin)
+	assert.Equal(t, "", response.Error)
+	created := response.Data.(map[string]interface{})
+	key, id := created["key"].(string), created["id"].(string)
+	assert.True(t, strings.HasPrefix(key, "ak_"+id+"_"))
+	_, response = call("/apiKey/create", api.CreateAPIKey{Username: "ciaccount", Name: "deploy"}, admin)
+	assert.Equal(t, model.APIKeyExistErr.Error(), response.Error)
+	_, response = call("/apiKey/create", api.CreateAPIKey{Username: "ciaccount", Name: "backup", ExpireAt: time.Now().Unix() + 3600}, admin)
+	assert.Equal(t, "", response.Error)
+	backup := response.Data.(map[string]interface{})["key"].(string)
+
+	withKey := func(path, key string) *httptest.ResponseRecorder {
+		authorization := "ApiKey " + key
+		return post(path, "POST", nil, map[string]*string{"Authorization": &authorization}, router)
+	}
+	w := withKey("/user/roles", key)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"data":["apikeyrole"]`)
+	w = withKey("/user/roles", key[:len(key)-1]+"x")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), model.APIKeyInvalidErr.Error())
+	w = withKey("/user/roles", "ak_unknown")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// listed without secrets, with last use
+	w = post("/apiKeys?username=ciaccount", "GET", nil, map[string]*string{"token": &admin}, router)
+	assert.NotContains(t, w.Body.String(), "secret")
+	var keys struct {
+		Data []model.APIKey `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &keys)
+	assert.Equal(t, 2, len(keys.Data))
+	for _, k := range keys.Data {
+		assert.Equal(t, k.Name == "deploy", k.LastUsedAt > 0)
+	}
+
+	// expiry, disabled principal, revocation, deletion
+	model.APIKeys[id].ExpireAt = time.Now().Unix() - 1
+	w = withKey("/user/roles", key)
+	assert.Contains(t, w.Body.String(), model.APIKeyExpiredErr.Error())
+	model.APIKeys[id].ExpireAt = 0
+	assert.Nil(t, model.SetDisabled("ciaccount", true))
+	w = withKey("/user/roles", key)
+	assert.Contains(t, w.Body.String(), model.UserDisabledErr.Error())
+	assert.Nil(t, model.SetDisabled("ciaccount", false))
+	_, response = call("/apiKey/revoke", api.RevokeAPIKey{Username: "ciaccount", ID: id}, admin)
+	assert.Equal(t, "", response.Error)
+	w = withKey("/user/roles", key)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	_, response = call("/apiKey/revoke", api.RevokeAPIKey{Username: "ciaccount", ID: id}, admin)
+	assert.Equal(t, model.APIKeyNotExistErr.Error(), response.Error)
+	w = withKey("/user/roles", backup)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, model.DeleteUser("ciaccount"))
+	assert.Equal(t, 0, len(model.ListAPIKeys("ciaccount")))
+	w = withKey("/user/roles", backup)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+// tokens in the body, sent by bearer, legacy header or cookie
+func TestTokenTransport(t *testing.T) {
+	createUser(t, "transportuser", "123456", "transportrole")
+
+	w, response := call("/auth/token", api.Token{Username: "transportuser", Password: "123456", Scopes: []string{"role:transportrole"}}, "")
+	assert.Equal(t, "", response.Error)
+	assert.Equal(t, "", w.Header().Get("token"))
+	data := response.Data.(map[string]interface{})
+	assert.Equal(t, "Bearer", data["token_type"])
+	assert.Equal(t, float64(model.TokenLifeTime), data["expires_in"])
+	assert.Equal(t, data["expires_in"], data["expires_at"].(float64)-data["issued_at"].(float64))
+	assert.Equal(t, "role:transportrole", data["scope"])
+	token := accessToken(w)
+	assert.Len(t, token, model.TokenLength)
+
+	roles := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/user/roles", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusOK, roles(map[string]string{"Authorization": "Bearer " + token}).Code)
+	assert.Equal(t, http.StatusOK, roles(map[string]string{"Authorization": "bearer " + token}).Code)
+	assert.Equal(t, http.StatusOK, roles(map[string]string{"token": token}).Code)
+	assert.Equal(t, http.StatusUnauthorized, roles(map[string]string{"Authorization": "Bearer " + token[1:] + "x"}).Code)
+	assert.Equal(t, http.StatusUnauthorized, roles(map[string]string{"Cookie": "auth_token=" + token}).Code) // cookie disabled
+
+	// configurable legacy header
+	model.TokenHeader = "X-Auth-Token"
+	t.Cleanup(func() { model.TokenHeader = "Token" })
+	w = roles(map[string]string{"token": token})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), middleware.TokenRequiredErr.Error())
+	assert.Equal(t, http.StatusOK, roles(map[string]string{"X-Auth-Token": token}).Code)
+
+	// legacy response
+	controller.LegacyTokenResponse = true
+	t.Cleanup(func() { controller.LegacyTokenResponse = false })
+	w, response = call("/auth/token", api.Token{Username: "transportuser", Password: "123456"}, "")
+	assert.Equal(t, "", response.Error)
+	assert.Nil(t, response.Data)
+	assert.Len(t, w.Header().Get("X-Auth-Token"), model.TokenLength)
+	controller.LegacyTokenResponse = false
+
+	// cookie
+	model.TokenCookie = "auth_token"
+	t.Cleanup(func() { model.TokenCookie = "" })
+	w, _ = call("/auth/token", api.Token{Username: "transportuser", Password: "123456"}, "")
+	cookie := w.Header().Get("Set-Cookie")
+	assert.Contains(t, cookie, "auth_token="+accessToken(w))
+	assert.Contains(t, cookie, "HttpOnly")
+	assert.Contains(t, cookie, "Secure")
+	assert.Contains(t, cookie, "SameSite=Strict")
+	assert.Contains(t, cookie, fmt.Sprintf("Max-Age=%d", model.SessionMaxAge)) // the session, idle expiry is checked by the service
+	var login struct {
+		Data api.AccessToken `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &login)
+	sent := map[string]string{"Cookie": "auth_token=" + login.Data.AccessToken, middleware.CSRFHeader: login.Data.CSRFToken}
+	assert.Equal(t, http.StatusOK, roles(sent).Code)
+
+	req := httptest.NewRequest("POST", "/auth/logout", nil)
+	req.Header.Set("Cookie", sent["Cookie"])
+	req.Header.Set(middleware.CSRFHeader, sent[middleware.CSRFHeader])
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Set-Cookie"), "auth_token=;")
+	assert.Contains(t, w.Header().Get("Set-Cookie"), "Max-Age=0")
+	assert.Equal(t, http.StatusUnauthorized, roles(sent).Code)
+}
+
+// idle expiry slides on use up to the max age, policies per role and client
+func TestSessionExpiry(t *testing.T) {
+	createUser(t, "sessionadmin", "123456", model.AdminRole)
+	createUser(t, "sessionuser", "123456", "sessionrole", "sessionroley")
+	admin := login(t, "sessionadmin", "123456")
+
+	w, response := call("/auth/token", api.Token{Username: "sessionuser", Password: "123456"}, "")
+	assert.Equal(t, "", response.Error)
+	data := response.Data.(map[string]interface{})
+	assert.Equal(t, float64(model.TokenLifeTime), data["expires_at"].(float64)-data["issued_at"].(float64))
+	assert.Equal(t, float64(model.SessionMaxAge), data["max_expires_at"].(float64)-data["issued_at"].(float64))
+	token := model.GetToken(accessToken(w))
+
+	// extended on use
+	token.ExpireAt = time.Now().Unix() + 1
+	_, response = call("/user/roles", nil, token.Token)
+	assert.Equal(t, "", response.Error)
+	assert.GreaterOrEqual(t, token.ExpireAt, time.Now().Unix()+model.TokenLifeTime-1)
+
+	// not beyond the max age
+	token.ExpireAt, token.MaxExpireAt = time.Now().Unix()+1, time.Now().Unix()+2
+	_, response = call("/user/roles", nil, token.Token)
+	assert.Equal(t, "", response.Error)
+	assert.Equal(t, token.MaxExpireAt, token.ExpireAt)
+	token.ExpireAt, token.MaxExpireAt = time.Now().Unix()-1, time.Now().Unix()-1
+	_, response = call("/user/roles", nil, token.Token)
+	assert.Equal(t, middleware.TokenExpiredErr.Error(), response.Error)
+
+	// role policies, the strictest applies
+	_, response = call("/role/sessionPolicy", api.SetRoleSessionPolicy{Role: "sessionrole", IdleTimeout: 600, MaxAge: 300}, admin)
+	assert.Equal(t, model.SessionPolicyErr.Error(), response.Error)
+	_, response = call("/role/sessionPolicy", api.SetRoleSessionPolicy{Role: "sessionnorole", IdleTimeout: 600, MaxAge: 3600}, admin)
+	assert.Equal(t, model.RoleNotExistErr.Error(), response.Error)
+	_, response = call("/role/sessionPolicy", api.SetRoleSessionPolicy{Role: "sessionrole", IdleTimeout: 600, MaxAge: 3600}, admin)
+	assert.Equal(t, "", response.Error)
+	assert.Equal(t, map[string]interface{}{"idleTimeout": float64(600), "maxAge": float64(3600)}, response.Data.(map[string]interface{})["session"])
+	_, response = call("/role/sessionPolicy", api.SetRoleSessionPolicy{Role: "sessionroley", IdleTimeout: 900, MaxAge: 7200}, admin)
+	assert.Equal(t, "", response.Error)
+
+	w, _ = call("/auth/token", api.Token{Username: "sessionuser", Password: "123456"}, "")
+	token = model.GetToken(accessToken(w))
+	assert.Equal(t, int64(600), token.IdleTimeout)
+	assert.Equal(t, int64(3600), token.MaxExpireAt-token.CreatedAt)
+	w, _ = call("/auth/token", api.Token{Username: "sessionuser", Password: "123456", Scopes: []string{"role:sessionroley"}}, "")
+	scoped := model.GetToken(accessToken(w))
+	assert.Equal(t, int64(900), scoped.IdleTimeout)
+	assert.Equal(t, int64(7200), scoped.MaxExpireAt-scoped.CreatedAt)
+
+	// writes are coalesced
+	token.ExpireAt -= model.SessionTouchPrecision / 3
+	expireAt := token.ExpireAt
+	_, response = call("/user/roles", nil, token.Token)
+	assert.Equal(t, "", response.Error)
+	assert.Equal(t, expireAt, token.ExpireAt)
+	token.ExpireAt -= model.SessionTouchPrecision
+	_, response = call("/user/roles", nil, token.Token)
+	assert.Equal(t, "", response.Error)
+	assert.GreaterOrEqual(t, token.ExpireAt, time.Now().Unix()+599)
+
+	// client policy overrides roles
+	client, _, _ := model.CreateClient("sessionclient", nil, []string{model.GrantClientCredentials}, nil, false)
+	t.Cleanup(func() { model.DeleteClient(client.ID) })
+	_, response = call("/oauth/client/sessionPolicy", api.SetClientSessionPolicy{ClientID: client.ID, IdleTimeout: 60, MaxAge: 60}, admin)
+	assert.Equal(t, "", response.Error)
+	clientToken := model.GenerateClientToken(model.GetUser("sessionuser"), client.ID, nil)
+	assert.Equal(t, int64(60), clientToken.IdleTimeout)
+	assert.Equal(t, clientToken.ExpireAt, clientToken.MaxExpireAt)
+
+	// reset to the default
+	_, response = call("/role/sessionPolicy", api.SetRoleSessionPolicy{Role: "sessionrole"}, admin)
+	assert.Equal(t, "", response.Error)
+	_, response = call("/role/sessionPolicy", api.SetRoleSessionPolicy{Role: "sessionroley"}, admin)
+	assert.Equal(t, "", response.Error)
+	assert.Nil(t, model.GetRole("sessionroley").Session)
+	_, response = call("/oauth/client/sessionPolicy", api.SetClientSessionPolicy{ClientID: client.ID}, admin)
+	assert.Equal(t, "", response.Error)
+	w, _ = call("/auth/token", api.Token{Username: "sessionuser", Password: "123456"}, "")
+	assert.Equal(t, model.TokenLifeTime, model.GetToken(accessToken(w)).IdleTimeout)
+	assert.Equal(t, model.TokenLifeTime, model.GenerateClientToken(nil, client.ID, nil).IdleTimeout)
+}
+
+// requests of one session touch it in parallel, run with -race
+func TestSessionTouchParallel(t *testing.T) {
+	createUser(t, "touchuser", "123456")
+	w, _ := call("/auth/token", api.Token{Username: "touchuser", Password: "123456"}, "")
+	token := model.GetToken(accessToken(w))
+	token.ExpireAt = time.Now().Unix() + 1
+
+	// the expiry moves each second, keep requesting across a few
+	deadline := time.Now().Add(2500 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				_, response := call("/user/roles", nil, token.Token)
+				assert.Equal(t, "", response.Error)
+				_, response = call("/auth/introspect", nil, token.Token)
+				assert.Equal(t, "", response.Error)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.GreaterOrEqual(t, token.Expiry(), time.Now().Unix()+model.TokenLifeTime-1)
+}
+
+// browser sessions in cookies, state-changing requests need the csrf token
+func TestCookieSession(t *testing.T) {
+	createUser(t, "cookieuser", "123456", model.AdminRole)
+	bearer := login(t, "cookieuser", "123456") // issued without cookie, has no csrf token
+	model.TokenCookie = "session"
+	t.Cleanup(func() { model.TokenCookie = "" })
+
+	w, response := call("/auth/token", api.Token{Username: "cookieuser", Password: "123456"}, "")
+	assert.Equal(t, "", response.Error)
+	csrf := response.Data.(map[string]interface{})["csrf_token"].(string)
+	assert.NotEmpty(t, csrf)
+	cookies := w.Result().Cookies()
+	assert.Equal(t, 2, len(cookies))
+	assert.Equal(t, "session", cookies[0].Name)
+	assert.Equal(t, accessToken(w), cookies[0].Value)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.True(t, cookies[0].Secure)
+	assert.Equal(t, http.SameSiteStrictMode, cookies[0].SameSite)
+	assert.Equal(t, "session"+controller.CSRFCookieSuffix, cookies[1].Name)
+	assert.Equal(t, csrf, cookies[1].Value)
+	assert.False(t, cookies[1].HttpOnly)
+	assert.True(t, cookies[1].Secure)
+	session := cookies[0].Value
+
+	send := func(method, path, token, csrf string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: token})
+		if len(csrf) > 0 {
+			req.Header.Set(middleware.CSRFHeader, csrf)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	w = send("POST", "/user/roles", session, "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), middleware.CSRFTokenErr.Error())
+	assert.Equal(t, http.StatusForbidden, send("POST", "/user/roles", session, csrf[1:]+"x").Code)
+	assert.Equal(t, http.StatusOK, send("POST", "/user/roles", session, csrf).Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/roles", session, "").Code) // safe method
+	assert.Equal(t, http.StatusForbidden, send("POST", "/user/roles", bearer, csrf).Code)
+
+	// headers are not sent by browsers on their own, no csrf token needed
+	_, response = call("/user/roles", nil, session)
+	assert.Equal(t, "", response.Error)
+	_, response = call("/user/roles", nil, bearer)
+	assert.Equal(t, "", response.Error)
+
+	// logout needs the csrf token too, then clears the cookies and revokes the session
+	assert.Equal(t, http.StatusForbidden, send("POST", "/auth/logout", session, "").Code)
+	assert.NotNil(t, model.GetToken(session))
+	w = send("POST", "/auth/logout", session, csrf)
+	assert.Equal(t, http.StatusOK, w.Code)
+	for _, cookie := range w.Result().Cookies() {
+		assert.Equal(t, "", cookie.Value)
+		assert.Equal(t, -1, cookie.MaxAge)
+	}
+	assert.Equal(t, 2, len(w.Result().Cookies()))
+	assert.Nil(t, model.GetToken(session))
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/roles", session, "").Code)
+}
+
+// browser posts forms and keeps the cookies in jar.
+func browser(jar map[string]string) func(method, path string, values url.Values) *httptest.ResponseRecorder {
+	return func(method, path string, values url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(values.Encode()))
+		if method == "POST" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		for name, value := range jar {
+			req.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.MaxAge < 0 {
+				delete(jar, cookie.Name)
+			} else {
+				jar[cookie.Name] = cookie.Value
+			}
+		}
+		return w
+	}
+}
+
+// hidden returns the value of a hidden form field of the page, the first of the name.
+func hidden(w *httptest.ResponseRecorder, name string) string {
+	m := regexp.MustCompile(`name="` + name + `" value="([^"]*)"`).FindStringSubmatch(w.Body.String())
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// hosted login, mfa, account, logout, password reset and consent pages, with a theme
+func TestHostedPages(t *testing.T) {
+	w := post("/login", "GET", nil, nil, router)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), api.PageSessionErr.Error())
+
+	model.TokenCookie = "hosted"
+	t.Cleanup(func() { model.TokenCookie = "" })
+	createUser(t, "hosteduser", "123456", "hostedrole")
+
+	jar := map[string]string{}
+	browse := browser(jar)
+
+	// login
+	w = browse("GET", "/login?return_to=//evil.example.com", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, api.PageDefaultReturnTo, hidden(w, "return_to"))
+	csrf := hidden(w, "csrf_token")
+	assert.Equal(t, jar["hosted"+controller.CSRFCookieSuffix], csrf)
+	w = browse("POST", "/login", url.Values{"username": {"hosteduser"}, "password": {"123456"}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), api.PageFormErr.Error())
+	w = browse("POST", "/login", url.Values{"username": {"hosteduser"}, "password": {"654321"}, "csrf_token": {csrf}})
+	assert.Contains(t, w.Body.String(), model.UserCheckErr.Error())
+	w = browse("POST", "/login", url.Values{"username": {"HostedUser"}, "password": {"123456"}, "csrf_token": {csrf}, "return_to": {"/account"}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/account", w.Header().Get("Location"))
+	session := model.GetToken(jar["hosted"])
+	assert.NotNil(t, session)
+	assert.Equal(t, session.CSRFToken, jar["hosted"+controller.CSRFCookieSuffix])
+
+	w = browse("GET", "/account", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<code>hostedrole</code>")
+	w = browse("GET", "/login", nil)
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	// consent with the session
+	client, _, _ := model.CreateClient("hostedapp", []string{"https://hosted.example.com/cb"}, []string{model.GrantAuthorizationCode}, nil, false)
+	t.Cleanup(func() { model.DeleteClient(client.ID) })
+	authorize := url.Values{"response_type": {"code"}, "client_id": {client.ID}, "scope": {"openid"}, "state": {"s1"},
+		"code_challenge": {strings.Repeat("c", 43)}, "code_challenge_method": {"S256"}}
+	w = browse("GET", "/oauth/authorize?"+authorize.Encode(), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Authorize hostedapp")
+	assert.Contains(t, w.Body.String(), `action="/oauth/consent"`)
+	consent := func(action, csrf string) *httptest.ResponseRecorder {
+		values := url.Values{"action": {action}, "csrf_token": {csrf}}
+		for k, v := range authorize {
+			values[k] = v
+		}
+		return browse("POST", "/oauth/consent", values)
+	}
+	assert.Equal(t, http.StatusForbidden, consent("approve", "").Code)
+	w = consent("deny", session.CSRFToken)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "error=access_denied")
+	w = consent("approve", session.CSRFToken)
+	assert.Equal(t, http.StatusFound, w.Code)
+	location, _ := url.Parse(w.Header().Get("Location"))
+	assert.Equal(t, "s1", location.Query().Get("state"))
+	code := model.AuthorizationCodes[location.Query().Get("code")]
+	assert.Equal(t, "hosteduser", code.User.Username)
+	assert.Equal(t, session.CreatedAt, code.AuthTime)
+
+	// logout
+	w = browse("GET", "/logout", nil)
+	assert.Equal(t, session.CSRFToken, hidden(w, "csrf_token"))
+	w = browse("POST", "/logout", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = browse("POST", "/logout", url.Values{"csrf_token": {session.CSRFToken}})
+	assert.Contains(t, w.Body.String(), "You are signed out.")
+	assert.Empty(t, jar["hosted"])
+	assert.Nil(t, model.GetToken(session.Token))
+	w = browse("GET", "/account", nil)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/login?return_to=%2Faccount", w.Header().Get("Location"))
+
+	// without a session, the oauth login starts one
+	w = browse("GET", "/oauth/authorize?"+authorize.Encode(), nil)
+	assert.Contains(t, w.Body.String(), `action="/oauth/authorize"`)
+	values := url.Values{"username": {"hosteduser"}, "password": {"123456"}, "csrf_token": {hidden(w, "csrf_token")}}
+	for k, v := range authorize {
+		values[k] = v
+	}
+	w = browse("POST", "/oauth/authorize", values)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.NotNil(t, model.GetToken(jar["hosted"]))
+
+	// mfa prompt
+	user := model.GetUser("hosteduser")
+	secret, _ := user.EnrollTOTP()
+	step := model.TOTPStep(time.Now())
+	code0, _ := model.TOTPCode(secret, step)
+	assert.Nil(t, user.VerifyTOTP(code0))
+	jar = map[string]string{}
+	browse = browser(jar)
+	w = browse("GET", "/login", nil)
+	csrf = hidden(w, "csrf_token")
+	w = browse("POST", "/login", url.Values{"username": {"hosteduser"}, "password": {"123456"}, "csrf_token": {csrf}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	mfaToken := hidden(w, "mfa_token")
+	assert.Len(t, mfaToken, model.MFAChallengeLength)
+	assert.Empty(t, jar["hosted"])
+	w = browse("POST", "/login/mfa", url.Values{"mfa_token": {mfaToken}, "code": {code0}, "csrf_token": {csrf}})
+	assert.Contains(t, w.Body.String(), model.MFACodeErr.Error()) // replayed
+	code1, _ := model.TOTPCode(secret, step+1)
+	w = browse("POST", "/login/mfa", url.Values{"mfa_token": {mfaToken}, "code": {code1}, "csrf_token": {csrf}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.NotNil(t, model.GetToken(jar["hosted"]))
+	signedIn := jar["hosted"]
+
+	// password reset
+	dir := t.TempDir()
+	sender, _ := mail.NewFileSender(dir)
+	mail.Default = sender
+	t.Cleanup(func() { mail.Default = nil })
+	email := "hosteduser@example.com"
+	assert.Nil(t, user.UpdateProfile(&email, nil, nil, nil, true))
+	w = browse("GET", "/password/forgot", nil)
+	csrf = hidden(w, "csrf_token")
+	w = browse("POST", "/password/forgot", url.Values{"username": {"hosteduser"}, "csrf_token": {csrf}})
+	assert.Contains(t, w.Body.String(), "If the account has a verified email")
+	mails, _ := os.ReadDir(filepath.Join(dir, "new"))
+	assert.Len(t, mails, 0) // not verified
+	user.EmailVerified = true
+	w = browse("POST", "/password/forgot", url.Values{"username": {"nobody"}, "csrf_token": {csrf}})
+	assert.Contains(t, w.Body.String(), "If the account has a verified email")
+	w = browse("POST", "/password/forgot", url.Values{"username": {"hosteduser"}, "csrf_token": {csrf}})
+	assert.Contains(t, w.Body.String(), "If the account has a verified email")
+	mails, _ = os.ReadDir(filepath.Join(dir, "new"))
+	assert.Len(t, mails, 1)
+	b, _ := os.ReadFile(filepath.Join(dir, "new", mails[0].Name()))
+	assert.Contains(t, string(b), "To: hosteduser@example.com")
+	link := regexp.MustCompile(`/password/reset\?token=\S+`).FindString(string(b))
+
+	w = browse("GET", link+"x", nil)
+	assert.Contains(t, w.Body.String(), model.ResetTokenErr.Error())
+	w = browse("GET", link, nil)
+	token := hidden(w, "token")
+	assert.NotEmpty(t, token)
+	w = browse("POST", "/password/reset", url.Values{"token": {token}, "password": {"abcdef"}, "confirm": {"abcdeg"}, "csrf_token": {csrf}})
+	assert.Contains(t, w.Body.String(), api.PasswordRepeatErr.Error())
+	w = browse("POST", "/password/reset", url.Values{"token": {token}, "password": {"abcdef"}, "confirm": {"abcdef"}, "csrf_token": {csrf}})
+	assert.Contains(t, w.Body.String(), "Your password has been changed")
+	assert.Nil(t, model.GetToken(signedIn))
+	assert.False(t, user.CheckPwd("123456"))
+	assert.True(t, user.CheckPwd("abcdef"))
+	assert.Empty(t, jar["hosted"])
+	w = browse("GET", link, nil)
+	assert.Contains(t, w.Body.String(), model.ResetTokenErr.Error()) // single use
+
+	// theme
+	theme := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(theme, page.Layout), []byte(`<html><body class="themed">{{template "content" .}}</body></html>`), 0600))
+	assert.Nil(t, page.Load(theme))
+	t.Cleanup(func() { page.Load("") })
+	w = browse("GET", "/login", nil)
+	assert.Contains(t, w.Body.String(), `<body class="themed">`)
+	assert.Contains(t, w.Body.String(), `action="/login"`)
+	assert.Nil(t, os.WriteFile(filepath.Join(theme, page.Login), []byte(`{{define "content"}}{{.Missing`), 0600))
+	assert.NotNil(t, page.Load(theme))
+	w = browse("GET", "/login", nil)
+	assert.Contains(t, w.Body.String(), `<body class="themed">`) // kept the last loaded pages
+}
+
+// admin console: user search, role grants, disabling and sessions
+func TestAdminConsole(t *testing.T) {
+	model.TokenCookie = "console"
+	t.Cleanup(func() { model.TokenCookie = "" })
+	createUser(t, "consoleadmin", "123456", model.AdminRole)
+	createUser(t, "consoleuser", "123456", "consolerole")
+	createUser(t, "consoleplain", "123456")
+	model.CreateRole("consoleextra", "", nil)
+	t.Cleanup(func() { model.DeleteRole("consoleextra") })
+
+	signIn := func(username string) func(method, path string, values url.Values) *httptest.ResponseRecorder {
+		browse := browser(map[string]string{})
+		w := browse("GET", "/login", nil)
+		w = browse("POST", "/login", url.Values{"username": {username}, "password": {"123456"}, "csrf_token": {hidden(w, "csrf_token")}})
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		return browse
+	}
+
+	// admins only
+	w := browser(map[string]string{})("GET", "/admin/console/users?q=console", nil)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/login?return_to=%2Fadmin%2Fconsole%2Fusers%3Fq%3Dconsole", w.Header().Get("Location"))
+	w = signIn("consoleplain")("GET", "/admin/console/users", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), api.ConsoleAdminErr.Error())
+	assert.NotContains(t, w.Body.String(), "consoleuser")
+
+	browse := signIn("consoleadmin")
+	w = browse("GET", "/admin/console", nil)
+	assert.Equal(t, "/admin/console/users", w.Header().Get("Location"))
+
+	// search
+	w = browse("GET", "/admin/console/users?q=console", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	for _, username := range []string{"consoleadmin", "consoleuser", "consoleplain"} {
+		assert.Contains(t, w.Body.String(), `href="/admin/console/users/`+username+`"`)
+	}
+	w = browse("GET", "/admin/console/users?q=console&role=consolerole&disabled=", nil)
+	assert.Contains(t, w.Body.String(), `href="/admin/console/users/consoleuser"`)
+	assert.NotContains(t, w.Body.String(), `href="/admin/console/users/consoleplain"`)
+	w = browse("GET", "/admin/console/users?q=console&disabled=true", nil)
+	assert.Contains(t, w.Body.String(), "No users found.")
+	w = browse("GET", "/admin/console/users/nobody", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), model.UserNotExistErr.Error())
+
+	// sessions are listed without the tokens
+	token1, token2 := login(t, "consoleuser", "123456"), login(t, "consoleuser", "123456")
+	w = browse("GET", "/admin/console/users/consoleuser", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<code>consolerole</code>")
+	assert.Contains(t, w.Body.String(), model.GetToken(token1).SessionID())
+	assert.Contains(t, w.Body.String(), model.GetToken(token2).SessionID())
+	assert.NotContains(t, w.Body.String(), token1)
+	csrf := hidden(w, "csrf_token")
+	assert.NotEmpty(t, csrf)
+	user := model.GetUser("consoleuser")
+
+	// roles
+	w = browse("POST", "/admin/console/users/consoleuser/roles", url.Values{"role": {"consoleextra"}, "action": {"add"}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.False(t, user.CheckRole("consoleextra"))
+	w = browse("POST", "/admin/console/users/consoleuser/roles", url.Values{"role": {"consoleextra"}, "action": {"add"}, "csrf_token": {csrf}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/admin/console/users/consoleuser", w.Header().Get("Location"))
+	assert.True(t, user.CheckRole("consoleextra"))
+	w = browse("POST", "/admin/console/users/consoleuser/roles", url.Values{"role": {"nosuchrole"}, "action": {"add"}, "csrf_token": {csrf}})
+	assert.Contains(t, w.Body.String(), model.RoleNotExistErr.Error())
+	w = browse("POST", "/admin/console/users/consoleuser/roles", url.Values{"role": {"consolerole"}, "action": {"revoke"}, "csrf_token": {csrf}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.False(t, user.CheckRole("consolerole"))
+
+	// status
+	w = browse("POST", "/admin/console/users/consoleuser/status", url.Values{"action": {"disable"}, "csrf_token": {csrf}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.True(t, user.IsDisabled())
+	_, response := call("/user/roles", nil, token1)
+	assert.Equal(t, model.UserDisabledErr.Error(), response.Error)
+	w = browse("GET", "/admin/console/users?q=console&disabled=true", nil)
+	assert.Contains(t, w.Body.String(), `href="/admin/console/users/consoleuser"`)
+	w = browse("POST", "/admin/console/users/consoleuser/status", url.Values{"action": {"enable"}, "csrf_token": {csrf}})
+	assert.False(t, user.IsDisabled())
+	w = browse("POST", "/admin/console/users/consoleuser/status", url.Values{"action": {"remove"}, "csrf_token": {csrf}})
+	assert.Contains(t, w.Body.String(), api.ConsoleActionErr.Error())
+
+	// sessions
+	w = browse("POST", "/admin/console/users/consoleuser/sessions", url.Values{"action": {"revoke"}, "session": {"0123456789abcdef"}, "csrf_token": {csrf}})
+	assert.Contains(t, w.Body.String(), model.TokenNotExistErr.Error())
+	w = browse("POST", "/admin/console/users/consoleuser/sessions", url.Values{"action": {"revoke"}, "session": {model.GetToken(token1).SessionID()}, "csrf_token": {csrf}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Nil(t, model.GetToken(token1))
+	assert.NotNil(t, model.GetToken(token2))
+	login(t, "consoleuser", "123456")
+	assert.Len(t, model.UserTokens("consoleuser"), 2)
+	w = browse("POST", "/admin/console/users/consoleuser/sessions", url.Values{"action": {"revokeAll"}, "csrf_token": {csrf}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Len(t, model.UserTokens("consoleuser"), 0)
+
+	// the admin's own sessions
+	w = browse("GET", "/admin/console/users/consoleadmin", nil)
+	assert.Contains(t, w.Body.String(), "(this session)")
+	w = browse("POST", "/admin/console/users/consoleadmin/sessions", url.Values{"action": {"revokeAll"}, "csrf_token": {csrf}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/login?return_to=%2Fadmin%2Fconsole", w.Header().Get("Location"))
+	w = browse("GET", "/admin/console/users", nil)
+	assert.Equal(t, http.StatusFound, w.Code)
+}
@@ -0,0 +1,214 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	APIKeyPrefix        = "ak"
+	APIKeyIDLength      = 16 // hex
+	APIKeySecretSize    = 32 // random bytes
+	APIKeyNameRegex     = `^[a-zA-Z0-9_.\-]{1,32}$`
+	APIKeyMaxPerUser    = 20
+	APIKeyUsedPrecision = 60 // second, last used is written at most once per minute
+)
+
+var (
+	APIKeys = make(map[string]*APIKey, 0) // key id => key
+
+	akLock sync.RWMutex // APIKeys lock
+
+	APIKeyNameErr          = errors.New("api key name only contains alphabet, number and _.-, len 1-32")
+	APIKeyExistErr         = errors.New("api key name already exist")
+	APIKeyNotExistErr      = errors.New("api key not exist")
+	APIKeyLimitErr         = errors.New("at most 20 api keys per user")
+	APIKeyInvalidErr       = errors.New("invalid api key")
+	APIKeyExpiredErr       = errors.New("api key expired")
+	APIKeyExpireErr        = errors.New("api key expiry must be in the future")
+	ServiceAccountLoginErr = errors.New("service accounts can not login, use an api key")
+)
+
+// APIKey authenticates a principal without login, the key is ak_<id>_<secret>
+// and only the sha256 of the secret is stored.
+type APIKey struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Username   string   `json:"username"`
+	SecretHash string   `json:"-"`
+	Scopes     []string `json:"scopes"` // role scopes restrict the key like tokens, bound to role ids
+	CreatedAt  int64    `json:"createdAt"`
+	ExpireAt   int64    `json:"expireAt"` // 0 never
+	LastUsedAt int64    `json:"lastUsedAt"`
+}
+
+// CreateServiceAccount creates a principal without password, which authenticates with api keys only.
+func CreateServiceAccount(username, displayName string) (*User, error) {
+	id, err := newUserID()
+	if err != nil {
+		return nil, err
+	}
+	u := &User{
+		ID:             id,
+		Username:       username,
+		CreatedAt:      time.Now().Unix(),
+		ServiceAccount: true,
+	}
+	u.DisplayName = displayName
+
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	if _, ok := Users[username]; ok {
+		return nil, UserExistErr
+	}
+	Users[u.Username] = u
+	indexUser(u)
+
+	return u, nil
+}
+
+func (u *User) IsServiceAccount() bool {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	return u.ServiceAccount
+}
+
+// CreateAPIKey returns the key and its secret form, which is shown only once.
+func CreateAPIKey(user *User, name string, scopes []string, expireAt int64) (*APIKey, string, error) {
+	ts := time.Now().Unix()
+	if expireAt != 0 && expireAt <= ts {
+		return nil, "", APIKeyExpireErr
+	}
+	scopes, err := user.BindRoleScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	id := make([]byte, APIKeyIDLength/2)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	secret := make([]byte, APIKeySecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	k := &APIKey{
+		ID:        fmt.Sprintf("%x", id),
+		Name:      name,
+		Username:  user.Username,
+		Scopes:    scopes,
+		CreatedAt: ts,
+		ExpireAt:  expireAt,
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	k.SecretHash = hashSecret(encoded)
+
+	akLock.Lock()
+	defer akLock.Unlock()
+
+	count := 0
+	for _, other := range APIKeys {
+		if other.Username == k.Username {
+			if other.Name == k.Name {
+				return nil, "", APIKeyExistErr
+			}
+			count++
+		}
+	}
+	if count >= APIKeyMaxPerUser {
+		return nil, "", APIKeyLimitErr
+	}
+	APIKeys[k.ID] = k
+
+	return k, APIKeyPrefix + "_" + k.ID + "_" + encoded, nil
+}
+
+// ListAPIKeys of the user, oldest first.
+func ListAPIKeys(username string) []APIKey {
+	akLock.RLock()
+	defer akLock.RUnlock()
+
+	keys := make([]APIKey, 0)
+	for _, k := range APIKeys {
+		if k.Username == username {
+			key := *k
+			key.Scopes = RoleScopeNames(k.Scopes)
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt < keys[j].CreatedAt || keys[i].CreatedAt == keys[j].CreatedAt && keys[i].Name < keys[j].Name
+	})
+
+	return keys
+}
+
+func RevokeAPIKey(username, id string) error {
+	akLock.Lock()
+	defer akLock.Unlock()
+
+	if k, ok := APIKeys[id]; !ok || k.Username != username {
+		return APIKeyNotExistErr
+	}
+	delete(APIKeys, id)
+
+	return nil
+}
+
+// AuthenticateAPIKey checks the key and records its use.
+func AuthenticateAPIKey(key string) (*APIKey, error) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != APIKeyPrefix {
+		return nil, APIKeyInvalidErr
+	}
+
+	akLock.RLock()
+	k, ok := APIKeys[parts[1]]
+	akLock.RUnlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(hashSecret(parts[2])), []byte(k.SecretHash)) != 1 {
+		return nil, APIKeyInvalidErr
+	}
+	ts := time.Now().Unix()
+	if k.ExpireAt != 0 && k.ExpireAt < ts {
+		return nil, APIKeyExpiredErr
+	}
+
+	akLock.Lock()
+	if ts-k.LastUsedAt >= APIKeyUsedPrecision {
+		k.LastUsedAt = ts
+	}
+	used := *k
+	akLock.Unlock()
+
+	return &used, nil
+}
+
+// Token is the request scoped token of the key, it is not stored.
+func (k *APIKey) Token(user *User) *Token {
+	return &Token{
+		User:      user,
+		CreatedAt: k.CreatedAt,
+		ExpireAt:  k.ExpireAt,
+		Scopes:    k.Scopes,
+		APIKeyID:  k.ID,
+	}
+}
+
+func deleteAPIKeys(username string) {
+	akLock.Lock()
+	defer akLock.Unlock()
+
+	for id, k := range APIKeys {
+		if k.Username == username {
+			delete(APIKeys, id)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ClientIDLength      = 32
+	ClientSecretSize    = 32 // random bytes
+	ClientNameMaxLength = 64
+	ClientMaxRedirects  = 10
+
+	ScopeRegex = `^[a-zA-Z0-9_:.\-]{1,64}$`
+
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+	GrantRefreshToken      = "refresh_token"
+	GrantDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code" // RFC 8628
+
+	ScopeOpenID  = "openid" // openid connect, an id token is issued
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+var (
+	Clients = make(map[string]*Client, 0)
+
+	cLock sync.RWMutex // Clients lock
+
+	Grants = []string{GrantAuthorizationCode, GrantClientCredentials, GrantRefreshToken, GrantDeviceCode}
+
+	OIDCScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail} // allowed for all clients
+
+	ClientNotExistErr  = errors.New("client not exist")
+	ClientNameErr      = errors.New("client name len 1-64")
+	ClientGrantErr     = errors.New("grant only in authorization_code, client_credentials, refresh_token, " + GrantDeviceCode)
+	ClientRedirectErr  = errors.New("redirect uri must be absolute without fragment, at most 10")
+	ClientPublicErr    = errors.New("public clients can not use client_credentials")
+	ScopeErr           = errors.New("scope only contains alphabet, number and _:.-, len 1-64")
+	ScopeNotAllowedErr = errors.New("scope not allowed for the client")
+)
+
+// Client is registered by admin. Confidential clients authenticate with a secret,
+// public clients(native and browser apps) can not keep one and rely on pkce.
+type Client struct {
+	ID           string   `json:"clientId"`
+	SecretHash   string   `json:"-"` // sha256, secrets are random and long
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirectUris"`
+	Grants       []string `json:"grants"`
+	Scopes       []string `json:"scopes"` // allowed scopes, all of them when not requested
+	Public       bool     `json:"public"`
+	CreatedAt    int64    `json:"createdAt"`
+
+	Session *SessionPolicy `json:"session,omitempty"` // nil for the default
+}
+
+// CreateClient returns the client and its secret, the secret is shown only once.
+func CreateClient(name string, redirectURIs, grants, scopes []string, public bool) (*Client, string, error) {
+	id := make([]byte, ClientIDLength/2)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	c := &Client{
+		ID:           fmt.Sprintf("%x", id),
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Grants:       grants,
+		Scopes:       scopes,
+		Public:       public,
+		CreatedAt:    time.Now().Unix(),
+	}
+
+	secret := ""
+	if !public {
+		b := make([]byte, ClientSecretSize)
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", err
+		}
+		secret = base64.RawURLEncoding.EncodeToString(b)
+		c.SecretHash = hashSecret(secret)
+	}
+
+	cLock.Lock()
+	Clients[c.ID] = c
+	cLock.Unlock()
+
+	return c, secret, nil
+}
+
+func GetClient(id string) *Client {
+	cLock.RLock()
+	defer cLock.RUnlock()
+
+	return Clients[id]
+}
+
+// DeleteClient revokes its refresh tokens and access tokens.
+func DeleteClient(id string) error {
+	cLock.Lock()
+
+	if _, ok := Clients[id]; !ok {
+		cLock.Unlock()
+		return ClientNotExistErr
+	}
+	delete(Clients, id)
+	cLock.Unlock()
+
+	// revoke tokens of the client
+	oLock.Lock()
+	for token, r := range RefreshTokens {
+		if r.ClientID == id {
+			delete(RefreshTokens, token)
+		}
+	}
+	oLock.Unlock()
+	tLock.Lock()
+	for token, t := range Tokens {
+		if t.ClientID == id {
+			delete(Tokens, token)
+		}
+	}
+	tLock.Unlock()
+
+	return nil
+}
+
+func ListClients() []*Client {
+	cLock.RLock()
+	defer cLock.RUnlock()
+
+	clients := make([]*Client, 0, len(Clients))
+	for _, c := range Clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].CreatedAt < clients[j].CreatedAt })
+
+	return clients
+}
+
+// CheckSecret compares in constant time, public clients have no secret.
+func (c *Client) CheckSecret(secret string) bool {
+	if c.Public {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(c.SecretHash)) == 1
+}
+
+func (c *Client) AllowGrant(grant string) bool {
+	return containsString(c.Grants, grant)
+}
+
+// AllowRedirect matches registered redirect uris exactly.
+func (c *Client) AllowRedirect(uri string) bool {
+	return containsString(c.RedirectURIs, uri)
+}
+
+// GrantScopes returns the requested scopes when all are allowed or openid connect scopes,
+// or all allowed scopes when none is requested.
+func (c *Client) GrantScopes(requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return append([]string{}, c.Scopes...), nil
+	}
+	for _, s := range requested {
+		if !containsString(c.Scopes, s) && !containsString(OIDCScopes, s) {
+			return nil, ScopeNotAllowedErr
+		}
+	}
+
+	return requested, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return fmt.Sprintf("%x", sum)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
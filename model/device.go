@@ -0,0 +1,197 @@
+package model
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	DeviceCodeLifeTime = 600 // second
+	DeviceInterval     = 5   // second, minimum polling interval
+	DeviceSlowDown     = 5   // second, added to the interval when polled too fast, RFC 8628 3.5
+
+	UserCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ" // no vowels and look-alikes, RFC 8628 6.1
+	UserCodeLength   = 8
+)
+
+var (
+	DeviceCodes = make(map[string]*DeviceCode, 0) // device code => device code
+	UserCodes   = make(map[string]string, 0)      // user code => device code
+
+	DeviceCodeErr      = errors.New("invalid device code")
+	DevicePendingErr   = errors.New("authorization pending")
+	DeviceSlowDownErr  = errors.New("polling too fast, slow down")
+	DeviceDeniedErr    = errors.New("authorization denied by the user")
+	DeviceExpiredErr   = errors.New("device code expired")
+	UserCodeErr        = errors.New("invalid or expired user code")
+	UserCodeDecidedErr = errors.New("user code already approved or denied")
+)
+
+// DeviceCode is issued to a device(RFC 8628), the user approves it with the user code in a browser.
+type DeviceCode struct {
+	DeviceCode string
+	UserCode   string
+	ClientID   string
+	Scopes     []string
+	User       *User // set when approved
+	Denied     bool
+	AuthTime   int64 // when the user approved
+	Interval   int64
+	LastPoll   int64
+	ExpireAt   int64
+}
+
+func NewDeviceCode(clientID string, scopes []string) (*DeviceCode, error) {
+	code, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	d := &DeviceCode{
+		DeviceCode: code,
+		ClientID:   clientID,
+		Scopes:     scopes,
+		Interval:   DeviceInterval,
+		ExpireAt:   time.Now().Unix() + DeviceCodeLifeTime,
+	}
+
+	oLock.Lock()
+	defer oLock.Unlock()
+
+	for {
+		userCode, err := randomUserCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := UserCodes[userCode]; !ok {
+			d.UserCode = userCode
+			break
+		}
+	}
+	DeviceCodes[d.DeviceCode] = d
+	UserCodes[d.UserCode] = d.DeviceCode
+
+	return d, nil
+}
+
+// ExpireDeviceCodes removes the codes past their lifetime, which the device stopped polling for.
+func ExpireDeviceCodes() int {
+	ts := time.Now().Unix()
+	removed := 0
+
+	oLock.Lock()
+	defer oLock.Unlock()
+
+	for code, d := range DeviceCodes {
+		if d.ExpireAt < ts {
+			delete(DeviceCodes, code)
+			delete(UserCodes, d.UserCode)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// FormatUserCode shows the code as XXXX-XXXX.
+func FormatUserCode(userCode string) string {
+	return userCode[:UserCodeLength/2] + "-" + userCode[UserCodeLength/2:]
+}
+
+// NormalizeUserCode accepts any case, dashes and spaces.
+func NormalizeUserCode(userCode string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(userCode))
+}
+
+// GetDeviceCodeByUserCode returns nil for unknown and expired user codes.
+func GetDeviceCodeByUserCode(userCode string) *DeviceCode {
+	oLock.Lock()
+	defer oLock.Unlock()
+
+	d, ok := DeviceCodes[UserCodes[NormalizeUserCode(userCode)]]
+	if !ok || d.ExpireAt < time.Now().Unix() {
+		return nil
+	}
+
+	return d
+}
+
+// DecideDeviceCode approves the device for the user, or denies it.
+func DecideDeviceCode(userCode string, user *User, approve bool) (*DeviceCode, error) {
+	oLock.Lock()
+	defer oLock.Unlock()
+
+	d, ok := DeviceCodes[UserCodes[NormalizeUserCode(userCode)]]
+	if !ok || d.ExpireAt < time.Now().Unix() {
+		return nil, UserCodeErr
+	}
+	if d.decided() {
+		return nil, UserCodeDecidedErr
+	}
+	if approve {
+		d.User, d.AuthTime = user, time.Now().Unix()
+	} else {
+		d.Denied = true
+	}
+
+	return d, nil
+}
+
+// PollDeviceCode returns the approved device code once, and pending, slow down, denied or
+// expired errors before that. Polling faster than the interval increases it.
+func PollDeviceCode(deviceCode, clientID string) (*DeviceCode, error) {
+	oLock.Lock()
+	defer oLock.Unlock()
+
+	d, ok := DeviceCodes[deviceCode]
+	if !ok || d.ClientID != clientID {
+		return nil, DeviceCodeErr
+	}
+	ts := time.Now().Unix()
+	if d.ExpireAt < ts {
+		delete(DeviceCodes, d.DeviceCode)
+		delete(UserCodes, d.UserCode)
+		return nil, DeviceExpiredErr
+	}
+	if ts-d.LastPoll < d.Interval {
+		d.LastPoll = ts
+		d.Interval += DeviceSlowDown
+		return nil, DeviceSlowDownErr
+	}
+	d.LastPoll = ts
+	if !d.decided() {
+		return nil, DevicePendingErr
+	}
+
+	delete(DeviceCodes, d.DeviceCode)
+	delete(UserCodes, d.UserCode)
+	if d.Denied {
+		return nil, DeviceDeniedErr
+	}
+
+	return d, nil
+}
+
+func (d *DeviceCode) decided() bool {
+	return d.User != nil || d.Denied
+}
+
+func randomUserCode() (string, error) {
+	b := make([]byte, UserCodeLength)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(UserCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = UserCodeAlphabet[n.Int64()]
+	}
+
+	return string(b), nil
+}
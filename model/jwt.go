@@ -0,0 +1,85 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	JWTFormatErr    = errors.New("malformed jwt")
+	JWTSignatureErr = errors.New("invalid jwt signature")
+	JWTExpiredErr   = errors.New("jwt expired")
+)
+
+// IDTokenLifeTime is the lifetime of id tokens, the token idle timeout(-tt).
+func IDTokenLifeTime() int64 {
+	return TokenLifeTime
+}
+
+// SignJWT signs the claims with the active key.
+func SignJWT(claims map[string]interface{}) (string, error) {
+	k, err := ActiveSigningKey()
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"alg": k.Alg, "typ": "JWT", "kid": k.ID})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := k.sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// VerifyJWT checks the signature with any published key and the exp claim.
+func VerifyJWT(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, JWTFormatErr
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(b, &header) != nil {
+		return nil, JWTFormatErr
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, JWTFormatErr
+	}
+
+	kLock.RLock()
+	var key *SigningKey
+	for _, k := range SigningKeys {
+		if k.ID == header.Kid {
+			key = k
+		}
+	}
+	kLock.RUnlock()
+	// the alg of the key, never the one in the header alone
+	if key == nil || key.Alg != header.Alg || !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return nil, JWTSignatureErr
+	}
+
+	claims := make(map[string]interface{}, 0)
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(b, &claims) != nil {
+		return nil, JWTFormatErr
+	}
+	if exp, ok := claims["exp"].(float64); ok && int64(exp) < time.Now().Unix() {
+		return nil, JWTExpiredErr
+	}
+
+	return claims, nil
+}
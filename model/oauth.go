@@ -0,0 +1,189 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	AuthorizationCodeLifeTime = 60 // second
+
+	PKCEMethodS256     = "S256"
+	PKCEVerifierRegex  = `^[A-Za-z0-9\-._~]{43,128}$`
+	PKCEChallengeRegex = `^[A-Za-z0-9\-_]{43}$` // base64url sha256
+
+	OAuthTokenSize = 32 // random bytes of codes and refresh tokens
+)
+
+var (
+	RefreshTokenLifeTime int64 = 2592000 // second
+
+	AuthorizationCodes = make(map[string]*AuthorizationCode, 0)
+	RefreshTokens      = make(map[string]*RefreshToken, 0)
+
+	oLock sync.Mutex // AuthorizationCodes, RefreshTokens, DeviceCodes and UserCodes lock
+
+	AuthorizationCodeErr = errors.New("invalid or expired authorization code")
+	PKCEErr              = errors.New("code_verifier does not match code_challenge")
+	RefreshTokenErr      = errors.New("invalid or expired refresh token")
+)
+
+// AuthorizationCode is issued after the user logs in at /oauth/authorize, exchanged once for tokens.
+type AuthorizationCode struct {
+	Code          string
+	ClientID      string
+	User          *User
+	RedirectURI   string
+	Scopes        []string
+	CodeChallenge string // S256 only, empty without pkce(confidential clients)
+	Nonce         string // openid connect, returned in the id token
+	AuthTime      int64  // when the user logged in
+	ExpireAt      int64
+}
+
+// RefreshToken is rotated on every use.
+type RefreshToken struct {
+	Token       string
+	ClientID    string
+	User        *User
+	Scopes      []string
+	AuthTime    int64  // of the login the refresh token chain started with
+	AccessToken string // issued with it, revoked with it
+	CreatedAt   int64
+	ExpireAt    int64
+}
+
+// NewAuthorizationCode is issued after the user logged in at authTime, now or when the browser session started.
+func NewAuthorizationCode(clientID string, user *User, redirectURI string, scopes []string, challenge, nonce string, authTime int64) (*AuthorizationCode, error) {
+	code, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	ts := time.Now().Unix()
+	a := &AuthorizationCode{
+		Code:          code,
+		ClientID:      clientID,
+		User:          user,
+		RedirectURI:   redirectURI,
+		Scopes:        scopes,
+		CodeChallenge: challenge,
+		Nonce:         nonce,
+		AuthTime:      authTime,
+		ExpireAt:      ts + AuthorizationCodeLifeTime,
+	}
+
+	oLock.Lock()
+	AuthorizationCodes[a.Code] = a
+	oLock.Unlock()
+
+	return a, nil
+}
+
+// RedeemAuthorizationCode removes the code whether it matches or not, codes are single use.
+func RedeemAuthorizationCode(code, clientID, redirectURI, verifier string) (*AuthorizationCode, error) {
+	oLock.Lock()
+	a, ok := AuthorizationCodes[code]
+	delete(AuthorizationCodes, code)
+	oLock.Unlock()
+
+	if !ok || a.ExpireAt < time.Now().Unix() || a.ClientID != clientID || a.RedirectURI != redirectURI {
+		return nil, AuthorizationCodeErr
+	}
+	// a verifier without challenge is rejected too, against downgrade
+	if len(a.CodeChallenge) == 0 && len(verifier) > 0 {
+		return nil, PKCEErr
+	}
+	if len(a.CodeChallenge) > 0 {
+		sum := sha256.Sum256([]byte(verifier))
+		if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(a.CodeChallenge)) != 1 {
+			return nil, PKCEErr
+		}
+	}
+
+	return a, nil
+}
+
+func NewRefreshToken(clientID string, user *User, scopes []string, authTime int64, accessToken string) (*RefreshToken, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	ts := time.Now().Unix()
+	r := &RefreshToken{
+		Token:       token,
+		ClientID:    clientID,
+		User:        user,
+		Scopes:      scopes,
+		AuthTime:    authTime,
+		AccessToken: accessToken,
+		CreatedAt:   ts,
+		ExpireAt:    ts + RefreshTokenLifeTime,
+	}
+
+	oLock.Lock()
+	RefreshTokens[r.Token] = r
+	oLock.Unlock()
+
+	return r, nil
+}
+
+// RedeemRefreshToken removes the refresh token, a new one is issued with the access token.
+func RedeemRefreshToken(token, clientID string) (*RefreshToken, error) {
+	oLock.Lock()
+	defer oLock.Unlock()
+
+	r, ok := RefreshTokens[token]
+	if !ok || r.ClientID != clientID {
+		return nil, RefreshTokenErr
+	}
+	delete(RefreshTokens, token)
+	if r.ExpireAt < time.Now().Unix() {
+		return nil, RefreshTokenErr
+	}
+
+	return r, nil
+}
+
+// GetRefreshToken returns nil for unknown and expired refresh tokens.
+func GetRefreshToken(token string) *RefreshToken {
+	oLock.Lock()
+	defer oLock.Unlock()
+
+	r, ok := RefreshTokens[token]
+	if !ok || r.ExpireAt < time.Now().Unix() {
+		return nil
+	}
+
+	return r
+}
+
+// RevokeRefreshToken removes the refresh token and the access token issued with it, RFC 7009 2.1.
+func RevokeRefreshToken(token string) error {
+	oLock.Lock()
+	r, ok := RefreshTokens[token]
+	delete(RefreshTokens, token)
+	oLock.Unlock()
+
+	if !ok {
+		return RefreshTokenErr
+	}
+	if t := GetToken(r.AccessToken); t != nil {
+		t.Remove()
+	}
+
+	return nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, OAuthTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
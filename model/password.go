@@ -0,0 +1,100 @@
+package model
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	Argon2Prefix = "$argon2id$"
+
+	// bounds of imported argon2 parameters, evaluated on every login until re-hashed
+	Argon2MaxMemory  = 1 << 20 // KiB, 1 GiB
+	Argon2MaxTime    = 10
+	Argon2MaxThreads = 16
+	Argon2MinKeyLen  = 16
+	Argon2MaxKeyLen  = 64
+)
+
+var (
+	PwdHashErr       = errors.New("password hash only in bcrypt or argon2id(PHC string) format")
+	PwdHashParamsErr = errors.New("argon2 parameters out of range, m <= 1048576, t <= 10, p <= 16, key 16-64 bytes")
+)
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// CheckPwdHash validates a pre-hashed password, imported from other systems.
+func CheckPwdHash(hash string) error {
+	if strings.HasPrefix(hash, Argon2Prefix) {
+		if _, err := parseArgon2(hash); err != nil {
+			return err
+		}
+		return nil
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return PwdHashErr
+	}
+
+	return nil
+}
+
+// comparePwd compares a peppered password with a bcrypt or argon2id hash.
+func comparePwd(hash string, password []byte) bool {
+	if !strings.HasPrefix(hash, Argon2Prefix) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil
+	}
+
+	p, err := parseArgon2(hash)
+	if err != nil {
+		return false
+	}
+	key := argon2.IDKey(password, p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	return subtle.ConstantTimeCompare(key, p.key) == 1
+}
+
+// parseArgon2 parses $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>, base64 without padding.
+func parseArgon2(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, PwdHashErr
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, PwdHashErr
+	}
+	p := &argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return nil, PwdHashErr
+	}
+	if p.time == 0 || p.threads == 0 {
+		return nil, PwdHashErr
+	}
+	if p.memory > Argon2MaxMemory || p.time > Argon2MaxTime || p.threads > Argon2MaxThreads {
+		return nil, PwdHashParamsErr
+	}
+
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, PwdHashErr
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, PwdHashErr
+	}
+	if len(p.key) < Argon2MinKeyLen || len(p.key) > Argon2MaxKeyLen {
+		return nil, PwdHashParamsErr
+	}
+
+	return p, nil
+}
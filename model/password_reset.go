@@ -0,0 +1,113 @@
+package model
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	PasswordResetLifeTime int64 = 3600 // reset link life time(second)
+
+	ResetTokenErr       = errors.New("invalid or expired password reset link")
+	ResetRateLimitedErr = errors.New("too many password reset mails, try later")
+	ResetNoPasswordErr  = errors.New("the account has no password to reset")
+)
+
+// PasswordResetToken signs the username and the current password hash, the link is
+// single use as the password changes, and earlier links expire with it.
+func (u *User) PasswordResetToken() (string, error) {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	if len(u.Email) == 0 || !u.EmailVerified {
+		return "", EmailNotVerifiedErr
+	}
+	if len(u.Password) == 0 {
+		return "", ResetNoPasswordErr
+	}
+	exp := time.Now().Unix() + PasswordResetLifeTime
+
+	return signValue(fmt.Sprintf("reset|%s|%s|%d", u.Username, passwordFingerprint(u.Password), exp)), nil
+}
+
+// CheckPasswordResetToken returns the user of a valid link.
+func CheckPasswordResetToken(token string) (*User, error) {
+	u, _, err := parseResetToken(token)
+	return u, err
+}
+
+// ResetPassword sets the password of a valid link and ends all sessions of the user.
+func ResetPassword(token, password string) (*User, error) {
+	u, fingerprint, err := parseResetToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.CanLogin(); err != nil {
+		return nil, err
+	}
+	pepperID := activePepper()
+	hash, err := hashPwd(password, pepperID)
+	if err != nil {
+		return nil, err
+	}
+
+	uLock.Lock()
+	if passwordFingerprint(u.Password) != fingerprint { // used meanwhile
+		uLock.Unlock()
+		return nil, ResetTokenErr
+	}
+	u.Password, u.PepperID = hash, pepperID
+	uLock.Unlock()
+	RevokeUserTokens(u.Username)
+
+	return u, nil
+}
+
+func parseResetToken(token string) (*User, string, error) {
+	value, ok := verifyValue(token)
+	if !ok {
+		return nil, "", ResetTokenErr
+	}
+	parts := strings.Split(value, "|")
+	if len(parts) != 4 || parts[0] != "reset" {
+		return nil, "", ResetTokenErr
+	}
+	exp, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil || exp < time.Now().Unix() {
+		return nil, "", ResetTokenErr
+	}
+
+	u := GetUser(parts[1])
+	if u == nil {
+		return nil, "", ResetTokenErr
+	}
+	uLock.RLock()
+	defer uLock.RUnlock()
+	if passwordFingerprint(u.Password) != parts[2] {
+		return nil, "", ResetTokenErr
+	}
+
+	return u, parts[2], nil
+}
+
+// AllowResetMail records a password reset mail, rate limited per user like verification mails.
+func (u *User) AllowResetMail() error {
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	var ok bool
+	if u.ResetMails, ok = allowMail(u.ResetMails); !ok {
+		return ResetRateLimitedErr
+	}
+
+	return nil
+}
+
+func passwordFingerprint(hash string) string {
+	sum := sha256.Sum256([]byte(hash))
+	return fmt.Sprintf("%x", sum[:8])
+}
@@ -0,0 +1,110 @@
+package model
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	PepperEnv       = "AUTH_PEPPER"
+	PepperMinLength = 16
+)
+
+var (
+	Peppers = make(map[string][]byte, 0) // key id => secret
+
+	PepperID string // active key id, empty means no pepper
+
+	pLock sync.RWMutex // Peppers lock
+
+	PepperFormatErr   = errors.New("pepper only in format id:secret, secret len >= 16")
+	PepperNotExistErr = errors.New("pepper not exist")
+)
+
+// LoadPeppers parses keys in format "id:secret", separated by comma or new line.
+// The first key loaded becomes active when there is no active one.
+func LoadPeppers(s string) error {
+	pLock.Lock()
+	defer pLock.Unlock()
+
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, secret, ok := strings.Cut(line, ":")
+		if !ok || len(id) == 0 || len(secret) < PepperMinLength {
+			return PepperFormatErr
+		}
+		Peppers[id] = []byte(secret)
+		if len(PepperID) == 0 {
+			PepperID = id
+		}
+	}
+
+	return nil
+}
+
+func LoadPepperFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return LoadPeppers(strings.Join(lines, "\n"))
+}
+
+// SetPepper switches the active key, existing hashes are re-peppered lazily on login.
+func SetPepper(id string) error {
+	pLock.Lock()
+	defer pLock.Unlock()
+
+	if _, ok := Peppers[id]; !ok && len(id) > 0 {
+		return PepperNotExistErr
+	}
+	PepperID = id
+
+	return nil
+}
+
+func activePepper() string {
+	pLock.RLock()
+	defer pLock.RUnlock()
+
+	return PepperID
+}
+
+// pepper returns HMAC-SHA256(secret, password) encoded for bcrypt (72 bytes limit),
+// or the password itself with an empty key id.
+func pepper(password, id string) ([]byte, error) {
+	if len(id) == 0 {
+		return []byte(password), nil
+	}
+
+	pLock.RLock()
+	secret, ok := Peppers[id]
+	pLock.RUnlock()
+	if !ok {
+		return nil, PepperNotExistErr
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil))), nil
+}
@@ -0,0 +1,184 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"sync"
+)
+
+const (
+	EmailRegex       = `^[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}$`
+	ProfileMaxLength = 64
+
+	AttributeString = "string"
+	AttributeNumber = "number"
+	AttributeBool   = "boolean"
+)
+
+var (
+	AttributeSchema = make(map[string]*AttributeDef, 0) // attribute name => definition
+
+	asLock sync.RWMutex // AttributeSchema lock
+
+	ProfileEmailErr      = errors.New("invalid email")
+	ProfileLengthErr     = errors.New("displayName and department len <= 64")
+	AttributeSchemaErr   = errors.New("invalid attribute schema")
+	AttributeNotExistErr = errors.New("attribute not defined in schema")
+	AttributeInvalidErr  = errors.New("attribute does not match schema")
+	AttributeDeniedErr   = errors.New("attribute can only be set by admin")
+)
+
+// Profile is embedded in User.
+type Profile struct {
+	Email       string                 `json:"email"`
+	DisplayName string                 `json:"displayName"`
+	Department  string                 `json:"department"`
+	Attributes  map[string]interface{} `json:"attributes"` // validated by AttributeSchema
+}
+
+type AttributeDef struct {
+	Type      string `json:"type"`      // string, number, boolean
+	Pattern   string `json:"pattern"`   // regex for string
+	MaxLength int    `json:"maxLength"` // for string, 0 means ProfileMaxLength
+	Exposed   bool   `json:"exposed"`   // included in token introspection
+	AdminOnly bool   `json:"adminOnly"` // can not be set by the user
+
+	pattern *regexp.Regexp
+}
+
+// LoadAttributeSchema reads a json object of attribute name => AttributeDef.
+func LoadAttributeSchema(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	schema := make(map[string]*AttributeDef, 0)
+	if err := json.Unmarshal(b, &schema); err != nil {
+		return err
+	}
+	for _, def := range schema {
+		if def == nil || (def.Type != AttributeString && def.Type != AttributeNumber && def.Type != AttributeBool) {
+			return AttributeSchemaErr
+		}
+		if len(def.Pattern) > 0 {
+			if def.pattern, err = regexp.Compile(def.Pattern); err != nil {
+				return AttributeSchemaErr
+			}
+		}
+		if def.MaxLength <= 0 {
+			def.MaxLength = ProfileMaxLength
+		}
+	}
+
+	asLock.Lock()
+	AttributeSchema = schema
+	asLock.Unlock()
+
+	return nil
+}
+
+// CheckAttributes validates values against the schema, nil value means removing.
+func CheckAttributes(attrs map[string]interface{}) error {
+	asLock.RLock()
+	defer asLock.RUnlock()
+
+	for name, v := range attrs {
+		def, ok := AttributeSchema[name]
+		if !ok {
+			return AttributeNotExistErr
+		}
+		if v == nil {
+			continue
+		}
+		switch def.Type {
+		case AttributeString:
+			s, ok := v.(string)
+			if !ok || len(s) > def.MaxLength || (def.pattern != nil && !def.pattern.MatchString(s)) {
+				return AttributeInvalidErr
+			}
+		case AttributeNumber:
+			if _, ok := v.(float64); !ok {
+				return AttributeInvalidErr
+			}
+		case AttributeBool:
+			if _, ok := v.(bool); !ok {
+				return AttributeInvalidErr
+			}
+		}
+	}
+
+	return nil
+}
+
+// ExposedAttributes filters attributes which can be shared with other services.
+func ExposedAttributes(attrs map[string]interface{}) map[string]interface{} {
+	asLock.RLock()
+	defer asLock.RUnlock()
+
+	exposed := make(map[string]interface{}, 0)
+	for name, v := range attrs {
+		if def, ok := AttributeSchema[name]; ok && def.Exposed {
+			exposed[name] = v
+		}
+	}
+
+	return exposed
+}
+
+func (u *User) GetProfile() Profile {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	p := u.Profile
+	p.Attributes = make(map[string]interface{}, len(u.Attributes))
+	for k, v := range u.Attributes {
+		p.Attributes[k] = v
+	}
+
+	return p
+}
+
+// UpdateProfile sets non nil fields and merges attributes, admin can set admin only attributes.
+func (u *User) UpdateProfile(email, displayName, department *string, attrs map[string]interface{}, admin bool) error {
+	if err := CheckAttributes(attrs); err != nil {
+		return err
+	}
+	if !admin {
+		asLock.RLock()
+		for name := range attrs {
+			if def := AttributeSchema[name]; def != nil && def.AdminOnly {
+				asLock.RUnlock()
+				return AttributeDeniedErr
+			}
+		}
+		asLock.RUnlock()
+	}
+
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	if email != nil && *email != u.Email {
+		u.Email = *email
+		u.EmailVerified = false
+	}
+	if displayName != nil {
+		u.DisplayName = *displayName
+	}
+	if department != nil {
+		u.Department = *department
+	}
+	if u.Attributes == nil {
+		u.Attributes = make(map[string]interface{}, 0)
+	}
+	for k, v := range attrs {
+		if v == nil {
+			delete(u.Attributes, k)
+		} else {
+			u.Attributes[k] = v
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	RecoveryCodeCount  = 10
+	RecoveryCodeLength = 12 // base32 chars, shown in groups of 4
+	RecoveryCodeRegex  = `^[a-z2-7]{4}-?[a-z2-7]{4}-?[a-z2-7]{4}$`
+
+	recoveryCodeAlphabet = "abcdefghijklmnopqrstuvwxyz234567"
+)
+
+var (
+	RecoveryCodeErr = errors.New("invalid recovery code")
+)
+
+// GenerateRecoveryCodes replaces the user's codes, only hashes are kept.
+func (u *User) GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	hashes := make([]string, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, RecoveryCodeLength)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		for j := range b {
+			b[j] = recoveryCodeAlphabet[b[j]%32]
+		}
+		code := string(b)
+		codes = append(codes, code[0:4]+"-"+code[4:8]+"-"+code[8:12])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	if !u.MFAEnabled {
+		return nil, MFANotEnrolledErr
+	}
+	u.RecoveryCodes = hashes
+
+	return codes, nil
+}
+
+// UseRecoveryCode consumes a code, each code is accepted once.
+func (u *User) UseRecoveryCode(code string) bool {
+	hash := hashRecoveryCode(code)
+
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	if !u.MFAEnabled {
+		return false
+	}
+	for i, h := range u.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (u *User) RecoveryCodesLeft() int {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	return len(u.RecoveryCodes)
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(code)), "-", "")
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(code)))
+}
@@ -1,26 +1,51 @@
 package model
 
 import (
+	"crypto/rand"
 	"errors"
+	"fmt"
+	"regexp"
+	"sort"
 	"sync"
+	"time"
 )
 
 const (
-	RoleRegex = `^[a-zA-Z]{3,15}$`
+	RoleRegex            = `^[a-zA-Z]{3,15}$`
+	RoleMetadataKeyRegex = `^[a-zA-Z][a-zA-Z0-9_.-]{0,31}$`
+
+	RoleDescriptionMaxLength = 256
+	RoleMetadataMaxKeys      = 16
+	RoleMetadataMaxLength    = 256 // value length
+
+	RoleIDLength = 16
+
+	AdminRole = "admin"      // role required by admin endpoints
+	AdminEnv  = "AUTH_ADMIN" // username:password of the first admin, see BootstrapAdmin
 )
 
 var (
-	Roles = make(map[string]*Role, 0)
+	Roles   = make(map[string]*Role, 0) // name => role
+	RoleIDs = make(map[string]*Role, 0) // id => role, grants are keyed by id
 
-	rLock sync.RWMutex
+	rLock sync.RWMutex // Roles and RoleIDs lock
 
 	RoleNameErr     = errors.New("role only contains alphabet, len 3-15")
 	RoleExistErr    = errors.New("role already exist")
 	RoleNotExistErr = errors.New("role not exist")
+
+	RoleDescriptionErr = errors.New("role description len <= 256")
+	RoleMetadataErr    = errors.New("role metadata at most 16 keys, key in format [a-zA-Z][a-zA-Z0-9_.-]{0,31}, value len <= 256")
 )
 
+// Role is replaced instead of modified on update, it is safe to read without lock.
 type Role struct {
-	Name string `json:"name" binding:"required"`
+	ID          string            `json:"id"` // stable across renames
+	Name        string            `json:"name" binding:"required"`
+	Description string            `json:"description"`
+	Metadata    map[string]string `json:"metadata"`
+	CreatedAt   int64             `json:"createdAt"`
+	Session     *SessionPolicy    `json:"session,omitempty"` // nil for the default
 }
 
 func GetRole(role string) *Role {
@@ -31,7 +56,19 @@ func GetRole(role string) *Role {
 	return Roles[role]
 }
 
-func CreateRole(role string) error {
+func GetRoleByID(id string) *Role {
+	rLock.RLock()
+	defer rLock.RUnlock()
+
+	return RoleIDs[id]
+}
+
+func CreateRole(role, description string, metadata map[string]string) error {
+	b := make([]byte, RoleIDLength/2)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
 	rLock.Lock()
 	defer rLock.Unlock()
 
@@ -39,9 +76,14 @@ func CreateRole(role string) error {
 		return RoleExistErr
 	} else {
 		r := &Role{
-			Name: role,
+			ID:          fmt.Sprintf("%x", b),
+			Name:        role,
+			Description: description,
+			Metadata:    metadata,
+			CreatedAt:   time.Now().Unix(),
 		}
 		Roles[r.Name] = r
+		RoleIDs[r.ID] = r
 
 		return nil
 	}
@@ -51,11 +93,108 @@ func DeleteRole(role string) error {
 	rLock.Lock()
 	defer rLock.Unlock()
 
-	if _, ok := Roles[role]; !ok {
+	if r, ok := Roles[role]; !ok {
 		return RoleNotExistErr
 	} else {
 		delete(Roles, role)
+		delete(RoleIDs, r.ID)
+
+		// cascade grants
+		urLock.Lock()
+		for username := range RoleUsers[r.ID] {
+			delete(UserRoles[username], r.ID)
+		}
+		delete(RoleUsers, r.ID)
+		urLock.Unlock()
 
 		return nil
 	}
 }
+
+func CheckRoleMetadata(metadata map[string]string) error {
+	if len(metadata) > RoleMetadataMaxKeys {
+		return RoleMetadataErr
+	}
+	keyReg := regexp.MustCompile(RoleMetadataKeyRegex)
+	for k, v := range metadata {
+		if !keyReg.MatchString(k) || len(v) > RoleMetadataMaxLength {
+			return RoleMetadataErr
+		}
+	}
+
+	return nil
+}
+
+// UpdateRole renames a role or changes its description, nil keeps the field.
+// Grants are keyed by id and kept across renames.
+func UpdateRole(role string, name, description *string) (*Role, error) {
+	rLock.Lock()
+	defer rLock.Unlock()
+
+	r, ok := Roles[role]
+	if !ok {
+		return nil, RoleNotExistErr
+	}
+	updated := *r
+	if name != nil && *name != r.Name {
+		if _, ok := Roles[*name]; ok {
+			return nil, RoleExistErr
+		}
+		updated.Name = *name
+	}
+	if description != nil {
+		updated.Description = *description
+	}
+
+	delete(Roles, r.Name)
+	Roles[updated.Name] = &updated
+	RoleIDs[updated.ID] = &updated
+
+	return &updated, nil
+}
+
+// ListRoles returns up to limit roles ordered by name after cursor(the last name of the previous page),
+// and the cursor of the next page, empty when there is none.
+func ListRoles(cursor string, limit int) ([]*Role, string) {
+	rLock.RLock()
+	defer rLock.RUnlock()
+
+	names := make([]string, 0, len(Roles))
+	for name := range Roles {
+		if name > cursor {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	next := ""
+	if len(names) > limit {
+		names = names[:limit]
+		next = names[limit-1]
+	}
+	roles := make([]*Role, 0, len(names))
+	for _, name := range names {
+		roles = append(roles, Roles[name])
+	}
+
+	return roles, next
+}
+
+// RolesPage returns roles by offset(0-based) ordered by name, and the number of roles.
+func RolesPage(offset, count int) ([]*Role, int) {
+	rLock.RLock()
+	defer rLock.RUnlock()
+
+	names := make([]string, 0, len(Roles))
+	for name := range Roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	roles := make([]*Role, 0, count)
+	for i := offset; i < offset+count && i < len(names); i++ {
+		roles = append(roles, Roles[names[i]])
+	}
+
+	return roles, len(names)
+}
@@ -0,0 +1,118 @@
+package model
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	RoleScopePrefix   = "role:"  // role:<name> restricts the token to the named roles
+	RoleIDScopePrefix = "role:#" // role:#<id>, role scopes of issued tokens and api keys, see BindRoleScopes
+)
+
+var (
+	RoleScopeErr        = errors.New("role scope only in role:<role name>")
+	RoleScopeNotHeldErr = errors.New("role scope of a role the user does not hold")
+)
+
+func RoleScope(role string) string {
+	return RoleScopePrefix + role
+}
+
+// BindRoleScopes checks the role scopes name roles the user holds, and replaces the names with the role ids
+// at issue time, so the scopes keep to the roles they were issued for: a renamed role stays in, a role deleted
+// and created again with the same name is another role. Bound scopes are checked the same way and kept.
+func (u *User) BindRoleScopes(scopes []string) ([]string, error) {
+	roleReg := regexp.MustCompile(RoleRegex)
+	bound := make([]string, 0, len(scopes))
+	for _, s := range scopes {
+		var role *Role
+		if id, ok := strings.CutPrefix(s, RoleIDScopePrefix); ok {
+			role = GetRoleByID(id)
+		} else if name, ok := strings.CutPrefix(s, RoleScopePrefix); ok {
+			if !roleReg.MatchString(name) {
+				return nil, RoleScopeErr
+			}
+			role = GetRole(name)
+		} else {
+			bound = append(bound, s)
+			continue
+		}
+		if role == nil || !u.hasRoleID(role.ID) {
+			return nil, RoleScopeNotHeldErr
+		}
+		bound = append(bound, RoleIDScopePrefix+role.ID)
+	}
+
+	return bound, nil
+}
+
+func (u *User) hasRoleID(id string) bool {
+	urLock.RLock()
+	defer urLock.RUnlock()
+
+	_, ok := UserRoles[u.Username][id]
+	return ok
+}
+
+// RoleScopeNames shows bound role scopes with the current role names, scopes of deleted roles keep the id.
+func RoleScopeNames(scopes []string) []string {
+	names := make([]string, len(scopes))
+
+	rLock.RLock()
+	for i, s := range scopes {
+		names[i] = s
+		if id, ok := strings.CutPrefix(s, RoleIDScopePrefix); ok {
+			if r, ok := RoleIDs[id]; ok {
+				names[i] = RoleScope(r.Name)
+			}
+		}
+	}
+	rLock.RUnlock()
+
+	return names
+}
+
+// ScopeRoles keeps the roles allowed by the role scopes, or all roles when there is no role scope.
+// Bound scopes allow the roles by id, whatever their current name, unbound ones by name.
+func ScopeRoles(roles, scopes []string) []string {
+	restricted := false
+	allowed := make(map[string]struct{}, 0)
+
+	rLock.RLock()
+	for _, s := range scopes {
+		if id, ok := strings.CutPrefix(s, RoleIDScopePrefix); ok {
+			restricted = true
+			if r, ok := RoleIDs[id]; ok {
+				allowed[r.Name] = struct{}{}
+			}
+		} else if role, ok := strings.CutPrefix(s, RoleScopePrefix); ok {
+			restricted = true
+			allowed[role] = struct{}{}
+		}
+	}
+	rLock.RUnlock()
+	if !restricted {
+		return roles
+	}
+
+	scoped := make([]string, 0, len(roles))
+	for _, r := range roles {
+		if _, ok := allowed[r]; ok {
+			scoped = append(scoped, r)
+		}
+	}
+
+	return scoped
+}
+
+// CheckRole answers within the token's role scopes.
+func (t *Token) CheckRole(role string) bool {
+	return len(ScopeRoles([]string{role}, t.Scopes)) == 1 && t.User.CheckRole(role)
+}
+
+// Roles are the user's roles within the token's role scopes.
+func (t *Token) Roles() []string {
+	return ScopeRoles(t.User.Roles(), t.Scopes)
+}
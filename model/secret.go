@@ -0,0 +1,51 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"strings"
+)
+
+const (
+	SecretEnv = "AUTH_SECRET"
+)
+
+var (
+	Secret []byte // signs links sent by mail, random per process when not configured
+)
+
+func init() {
+	Secret = make([]byte, 32)
+	rand.Read(Secret)
+}
+
+// signValue returns base64url(value).base64url(hmac-sha256(value)).
+func signValue(value string) string {
+	mac := hmac.New(sha256.New, Secret)
+	mac.Write([]byte(value))
+	return b64url.EncodeToString([]byte(value)) + "." + b64url.EncodeToString(mac.Sum(nil))
+}
+
+func verifyValue(signed string) (string, bool) {
+	v, sig, ok := strings.Cut(signed, ".")
+	if !ok {
+		return "", false
+	}
+	value, err := b64url.DecodeString(v)
+	if err != nil {
+		return "", false
+	}
+	expect, err := b64url.DecodeString(sig)
+	if err != nil {
+		return "", false
+	}
+
+	mac := hmac.New(sha256.New, Secret)
+	mac.Write(value)
+	if !hmac.Equal(mac.Sum(nil), expect) {
+		return "", false
+	}
+
+	return string(value), true
+}
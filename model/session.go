@@ -0,0 +1,141 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	SessionMaxAge         int64 = 86400 // second, absolute lifetime of a token since login, -tm
+	SessionTouchPrecision int64 = 60    // second, the idle expiry moves at most once per precision
+
+	SessionPolicyErr = errors.New("idle timeout and max age must be > 0, idle timeout <= max age")
+)
+
+// SessionPolicy overrides the idle timeout(-tt) and max age(-tm) of tokens, per role or client.
+type SessionPolicy struct {
+	IdleTimeout int64 `json:"idleTimeout"` // second, extended on every request
+	MaxAge      int64 `json:"maxAge"`      // second, since login
+}
+
+func DefaultSessionPolicy() SessionPolicy {
+	return SessionPolicy{IdleTimeout: TokenLifeTime, MaxAge: SessionMaxAge}
+}
+
+func (p SessionPolicy) Check() error {
+	if p.IdleTimeout <= 0 || p.MaxAge <= 0 || p.IdleTimeout > p.MaxAge {
+		return SessionPolicyErr
+	}
+
+	return nil
+}
+
+// SetRoleSessionPolicy sets the policy of the role, nil restores the default.
+func SetRoleSessionPolicy(role string, p *SessionPolicy) (*Role, error) {
+	if p != nil {
+		if err := p.Check(); err != nil {
+			return nil, err
+		}
+	}
+
+	rLock.Lock()
+	defer rLock.Unlock()
+
+	r, ok := Roles[role]
+	if !ok {
+		return nil, RoleNotExistErr
+	}
+	updated := *r
+	updated.Session = p
+	Roles[updated.Name] = &updated
+	RoleIDs[updated.ID] = &updated
+
+	return &updated, nil
+}
+
+// SetClientSessionPolicy sets the policy of the client's tokens, nil restores the default.
+func SetClientSessionPolicy(clientID string, p *SessionPolicy) (*Client, error) {
+	if p != nil {
+		if err := p.Check(); err != nil {
+			return nil, err
+		}
+	}
+
+	cLock.Lock()
+	defer cLock.Unlock()
+
+	c, ok := Clients[clientID]
+	if !ok {
+		return nil, ClientNotExistErr
+	}
+	updated := *c
+	updated.Session = p
+	Clients[updated.ID] = &updated
+
+	return &updated, nil
+}
+
+// sessionPolicy takes the client's policy, or the strictest of the roles the token has,
+// or the default. Tokens keep the policy they were issued with.
+func sessionPolicy(user *User, clientID string, scopes []string) SessionPolicy {
+	if c := GetClient(clientID); c != nil && c.Session != nil {
+		return *c.Session
+	}
+	if user == nil {
+		return DefaultSessionPolicy()
+	}
+
+	var policy *SessionPolicy
+	for _, name := range ScopeRoles(user.Roles(), scopes) {
+		r := GetRole(name)
+		if r == nil || r.Session == nil {
+			continue
+		}
+		if policy == nil {
+			p := *r.Session
+			policy = &p
+			continue
+		}
+		if r.Session.IdleTimeout < policy.IdleTimeout {
+			policy.IdleTimeout = r.Session.IdleTimeout
+		}
+		if r.Session.MaxAge < policy.MaxAge {
+			policy.MaxAge = r.Session.MaxAge
+		}
+	}
+	if policy == nil {
+		return DefaultSessionPolicy()
+	}
+
+	return *policy
+}
+
+// Touch extends the idle expiry of the token on use, up to its max age. Writes are coalesced,
+// the expiry moves only when it gains SessionTouchPrecision, or a tenth of the idle timeout when shorter.
+func (t *Token) Touch() {
+	expireAt := time.Now().Unix() + t.IdleTimeout
+	if expireAt > t.MaxExpireAt {
+		expireAt = t.MaxExpireAt
+	}
+	precision := SessionTouchPrecision
+	if t.IdleTimeout/10 < precision {
+		precision = t.IdleTimeout / 10
+	}
+	if expireAt-t.Expiry() <= precision {
+		return
+	}
+
+	tLock.Lock()
+	if expireAt > t.ExpireAt {
+		t.ExpireAt = expireAt
+	}
+	tLock.Unlock()
+}
+
+// Expiry returns the idle expiry of the token, Touch moves it while requests read it.
+func (t *Token) Expiry() int64 {
+	tLock.RLock()
+	defer tLock.RUnlock()
+
+	return t.ExpireAt
+}
@@ -0,0 +1,467 @@
+package model
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JWTAlgRS256 = "RS256"
+	JWTAlgES256 = "ES256"
+	JWTAlgEdDSA = "EdDSA"
+
+	SigningKeyBits            = 2048 // rsa
+	SigningKeyEnv             = "AUTH_KEY_SECRET"
+	SigningKeySecretMinLength = 16
+)
+
+var (
+	SigningAlgs = []string{JWTAlgRS256, JWTAlgES256, JWTAlgEdDSA}
+
+	SigningAlg                = JWTAlgRS256 // of new keys
+	SigningKeyRotation int64  = 2592000     // second, active key age before scheduled rotation, 0 never
+	SigningKeyDir      string               // encrypted key files, keys are in memory only when empty
+	SigningKeySecret   []byte               // encrypts key files
+
+	SigningKeys = make([]*SigningKey, 0) // active key first, then retired keys, newest first
+
+	kLock sync.RWMutex // SigningKeys lock, also serializes key files
+
+	SigningAlgErr         = errors.New("alg only in RS256, ES256, EdDSA")
+	SigningKeyNotExistErr = errors.New("signing key not exist")
+	SigningKeySecretErr   = errors.New("key directory requires env AUTH_KEY_SECRET, len >= 16")
+	SigningKeyDecryptErr  = errors.New("can not decrypt signing key, wrong AUTH_KEY_SECRET")
+)
+
+// SigningKey signs id tokens while active. Retired keys only verify, and are published
+// until the tokens they signed have expired.
+type SigningKey struct {
+	ID        string        `json:"kid"`
+	Alg       string        `json:"alg"`
+	Key       crypto.Signer `json:"-"`
+	CreatedAt int64         `json:"createdAt"`
+	RetiredAt int64         `json:"retiredAt"` // 0 while active
+}
+
+// JWK is the public part of a signing key, RFC 7517 and RFC 8037.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// signingKeyFile is the key on disk, the pkcs8 private key is sealed with aes-256-gcm,
+// the aes key is derived from SigningKeySecret with argon2id.
+type signingKeyFile struct {
+	ID        string `json:"kid"`
+	Alg       string `json:"alg"`
+	CreatedAt int64  `json:"createdAt"`
+	RetiredAt int64  `json:"retiredAt"`
+	Salt      []byte `json:"salt"`
+	Nonce     []byte `json:"nonce"`
+	Key       []byte `json:"key"`
+}
+
+func CheckSigningAlg(alg string) error {
+	for _, a := range SigningAlgs {
+		if a == alg {
+			return nil
+		}
+	}
+
+	return SigningAlgErr
+}
+
+func generateSigningKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case JWTAlgRS256:
+		return rsa.GenerateKey(rand.Reader, SigningKeyBits)
+	case JWTAlgES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case JWTAlgEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+
+	return nil, SigningAlgErr
+}
+
+// RotateSigningKey generates a new active key with alg(SigningAlg when empty),
+// and retires the previous one.
+func RotateSigningKey(alg string) (*SigningKey, error) {
+	if len(alg) == 0 {
+		alg = SigningAlg
+	}
+	key, err := generateSigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	ts := time.Now().Unix()
+	k := &SigningKey{ID: fmt.Sprintf("%x", id), Alg: alg, Key: key, CreatedAt: ts}
+
+	kLock.Lock()
+	defer kLock.Unlock()
+
+	if err := saveSigningKey(k); err != nil {
+		return nil, err
+	}
+	if len(SigningKeys) > 0 && SigningKeys[0].RetiredAt == 0 {
+		retired := *SigningKeys[0]
+		retired.RetiredAt = ts
+		if err := saveSigningKey(&retired); err != nil {
+			removeSigningKeyFile(k.ID)
+			return nil, err
+		}
+		SigningKeys[0] = &retired
+	}
+	SigningKeys = append([]*SigningKey{k}, SigningKeys...)
+
+	return k, nil
+}
+
+// ActiveSigningKey generates the first key on demand.
+func ActiveSigningKey() (*SigningKey, error) {
+	kLock.RLock()
+	if len(SigningKeys) > 0 && SigningKeys[0].RetiredAt == 0 {
+		k := SigningKeys[0]
+		kLock.RUnlock()
+		return k, nil
+	}
+	kLock.RUnlock()
+
+	return RotateSigningKey("")
+}
+
+// RevokeSigningKey removes a compromised key at once, tokens it signed no longer verify.
+// A new key is activated when the active one is revoked.
+func RevokeSigningKey(id string) error {
+	kLock.RLock()
+	active := len(SigningKeys) > 0 && SigningKeys[0].ID == id && SigningKeys[0].RetiredAt == 0
+	kLock.RUnlock()
+	if active {
+		if _, err := RotateSigningKey(""); err != nil {
+			return err
+		}
+	}
+
+	kLock.Lock()
+	defer kLock.Unlock()
+
+	for i, k := range SigningKeys {
+		if k.ID == id {
+			if err := removeSigningKeyFile(id); err != nil {
+				return err
+			}
+			SigningKeys = append(SigningKeys[:i:i], SigningKeys[i+1:]...)
+			return nil
+		}
+	}
+
+	return SigningKeyNotExistErr
+}
+
+// SigningKeyRetention is how long retired keys are kept, the longest lifetime a token can be issued with:
+// id tokens, the max age(-tm) and the max age of role and client session policies.
+func SigningKeyRetention() int64 {
+	retention := IDTokenLifeTime()
+	if SessionMaxAge > retention {
+		retention = SessionMaxAge
+	}
+
+	rLock.RLock()
+	for _, r := range Roles {
+		if r.Session != nil && r.Session.MaxAge > retention {
+			retention = r.Session.MaxAge
+		}
+	}
+	rLock.RUnlock()
+
+	cLock.RLock()
+	for _, c := range Clients {
+		if c.Session != nil && c.Session.MaxAge > retention {
+			retention = c.Session.MaxAge
+		}
+	}
+	cLock.RUnlock()
+
+	return retention
+}
+
+// ScheduleSigningKeys rotates the active key when it is older than SigningKeyRotation,
+// and removes retired keys when the tokens they signed have expired. Called every minute.
+func ScheduleSigningKeys() error {
+	ts := time.Now().Unix()
+	retention := SigningKeyRetention()
+	kLock.RLock()
+	due := len(SigningKeys) > 0 && SigningKeys[0].RetiredAt == 0 &&
+		SigningKeyRotation > 0 && SigningKeys[0].CreatedAt+SigningKeyRotation <= ts
+	kLock.RUnlock()
+	if due {
+		if _, err := RotateSigningKey(""); err != nil {
+			return err
+		}
+	}
+
+	kLock.Lock()
+	defer kLock.Unlock()
+
+	kept := make([]*SigningKey, 0, len(SigningKeys))
+	for _, k := range SigningKeys {
+		if k.RetiredAt > 0 && k.RetiredAt+retention < ts {
+			if err := removeSigningKeyFile(k.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		kept = append(kept, k)
+	}
+	SigningKeys = kept
+
+	return nil
+}
+
+func ListSigningKeys() []SigningKey {
+	kLock.RLock()
+	defer kLock.RUnlock()
+
+	keys := make([]SigningKey, 0, len(SigningKeys))
+	for _, k := range SigningKeys {
+		keys = append(keys, *k)
+	}
+
+	return keys
+}
+
+func PublicJWKs() []JWK {
+	kLock.RLock()
+	defer kLock.RUnlock()
+
+	keys := make([]JWK, 0, len(SigningKeys))
+	for _, k := range SigningKeys {
+		keys = append(keys, k.JWK())
+	}
+
+	return keys
+}
+
+func (k *SigningKey) JWK() JWK {
+	jwk := JWK{Use: "sig", Alg: k.Alg, Kid: k.ID}
+	switch key := k.Key.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.Kty, jwk.Crv = "EC", "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32)))
+	case ed25519.PublicKey:
+		jwk.Kty, jwk.Crv = "OKP", "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(key)
+	}
+
+	return jwk
+}
+
+func (k *SigningKey) sign(signed []byte) ([]byte, error) {
+	sum := sha256.Sum256(signed)
+	switch key := k.Key.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey: // r || s, RFC 7518 3.4
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		if err != nil {
+			return nil, err
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), nil
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, signed), nil
+	}
+
+	return nil, SigningAlgErr
+}
+
+func (k *SigningKey) verify(signed, sig []byte) bool {
+	sum := sha256.Sum256(signed)
+	switch key := k.Key.Public().(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return false
+		}
+		return ecdsa.Verify(key, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signed, sig)
+	}
+
+	return false
+}
+
+// LoadSigningKeys reads the encrypted key files of the directory, and keeps new keys there.
+func LoadSigningKeys(dir string) error {
+	if len(SigningKeySecret) < SigningKeySecretMinLength {
+		return SigningKeySecretErr
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*SigningKey, 0, len(paths))
+	for _, path := range paths {
+		k, err := readSigningKey(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, k)
+	}
+	// active first, then most recently retired, at most one active key
+	sort.Slice(keys, func(i, j int) bool {
+		if (keys[i].RetiredAt == 0) != (keys[j].RetiredAt == 0) {
+			return keys[i].RetiredAt == 0
+		}
+		if keys[i].RetiredAt != keys[j].RetiredAt {
+			return keys[i].RetiredAt > keys[j].RetiredAt
+		}
+		return keys[i].CreatedAt > keys[j].CreatedAt
+	})
+
+	kLock.Lock()
+	defer kLock.Unlock()
+
+	SigningKeyDir = dir
+	for i, k := range keys {
+		if i > 0 && k.RetiredAt == 0 {
+			k.RetiredAt = keys[i-1].CreatedAt
+			if err := saveSigningKey(k); err != nil {
+				return err
+			}
+		}
+	}
+	SigningKeys = keys
+
+	return nil
+}
+
+func readSigningKey(path string) (*SigningKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f signingKeyFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	if err := CheckSigningAlg(f.Alg); err != nil {
+		return nil, err
+	}
+
+	gcm, err := signingKeyCipher(f.Salt)
+	if err != nil {
+		return nil, err
+	}
+	der, err := gcm.Open(nil, f.Nonce, f.Key, []byte(f.ID))
+	if err != nil {
+		return nil, SigningKeyDecryptErr
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, SigningAlgErr
+	}
+
+	return &SigningKey{ID: f.ID, Alg: f.Alg, Key: signer, CreatedAt: f.CreatedAt, RetiredAt: f.RetiredAt}, nil
+}
+
+// saveSigningKey writes the key file when SigningKeyDir is set, kLock held.
+func saveSigningKey(k *SigningKey) error {
+	if len(SigningKeyDir) == 0 {
+		return nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k.Key)
+	if err != nil {
+		return err
+	}
+	f := signingKeyFile{ID: k.ID, Alg: k.Alg, CreatedAt: k.CreatedAt, RetiredAt: k.RetiredAt, Salt: make([]byte, 16)}
+	if _, err := rand.Read(f.Salt); err != nil {
+		return err
+	}
+	gcm, err := signingKeyCipher(f.Salt)
+	if err != nil {
+		return err
+	}
+	f.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return err
+	}
+	f.Key = gcm.Seal(nil, f.Nonce, der, []byte(f.ID))
+
+	b, _ := json.Marshal(f)
+	path := signingKeyPath(k.ID)
+	if err := os.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func removeSigningKeyFile(id string) error {
+	if len(SigningKeyDir) == 0 {
+		return nil
+	}
+	if err := os.Remove(signingKeyPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func signingKeyPath(id string) string {
+	return filepath.Join(SigningKeyDir, strings.ReplaceAll(id, string(filepath.Separator), "")+".json")
+}
+
+func signingKeyCipher(salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(argon2.IDKey(SigningKeySecret, salt, 1, 64*1024, 4, 32))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -2,10 +2,14 @@ package model
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"sort"
 	"sync"
 	"time"
 )
@@ -17,6 +21,10 @@ const (
 var (
 	TokenLifeTime int64
 
+	// token transport, besides "Authorization: Bearer <token>"
+	TokenHeader = "Token" // legacy header, empty to disable
+	TokenCookie string    // HttpOnly cookie, set on login when not empty
+
 	Tokens = make(map[string]*Token, 0)
 
 	tLock sync.RWMutex // Tokens lock
@@ -26,17 +34,36 @@ var (
 
 type Token struct {
 	Token     string `json:"token"`
-	User      *User
-	CreatedAt int64 `json:"createdAt" binding:"-"`
-	ExpireAt  int64 `json:"expireAt"`
+	User      *User  // nil for client credentials tokens
+	CreatedAt int64  `json:"createdAt" binding:"-"`
+	ExpireAt  int64  `json:"expireAt"` // idle expiry, see Touch
+
+	IdleTimeout int64 `json:"idleTimeout"`
+	MaxExpireAt int64 `json:"maxExpireAt"` // absolute expiry
+
+	ClientID string   `json:"clientId"` // empty for /auth/token
+	Scopes   []string `json:"scopes"`
+	APIKeyID string   `json:"apiKeyId"` // set for api key requests, such tokens are not stored
+
+	CSRFToken string `json:"-"` // cookie sessions only
 }
 
 func GenerateToken(user *User) *Token {
+	return GenerateClientToken(user, "", nil)
+}
+
+// GenerateClientToken issues a token to an oauth client, on behalf of the user if not nil.
+func GenerateClientToken(user *User, clientID string, scopes []string) *Token {
 	ts := time.Now().Unix()
+	policy := sessionPolicy(user, clientID, scopes)
 	t := &Token{
-		User:      user,
-		CreatedAt: ts,
-		ExpireAt:  ts + TokenLifeTime, // 2h life time
+		User:        user,
+		CreatedAt:   ts,
+		ExpireAt:    ts + policy.IdleTimeout, // 2h idle timeout
+		IdleTimeout: policy.IdleTimeout,
+		MaxExpireAt: ts + policy.MaxAge,
+		ClientID:    clientID,
+		Scopes:      scopes,
 	}
 	b, _ := json.Marshal(t.User)
 	b = []byte(string(b) + uuid.New().String())
@@ -54,6 +81,106 @@ func GetToken(token string) *Token {
 	return Tokens[token]
 }
 
+// NewCSRFToken binds a synchronizer token to a cookie session, the browser sends it back in a header.
+func (t *Token) NewCSRFToken() (string, error) {
+	s, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	tLock.Lock()
+	t.CSRFToken = s
+	tLock.Unlock()
+
+	return s, nil
+}
+
+// CSRF returns the synchronizer token for rendering into forms, it is replaced under the lock by NewCSRFToken.
+func (t *Token) CSRF() string {
+	tLock.RLock()
+	defer tLock.RUnlock()
+
+	return t.CSRFToken
+}
+
+func (t *Token) CheckCSRFToken(s string) bool {
+	tLock.RLock()
+	defer tLock.RUnlock()
+
+	return len(t.CSRFToken) > 0 && subtle.ConstantTimeCompare([]byte(t.CSRFToken), []byte(s)) == 1
+}
+
+// RevokeUserTokens removes the access and refresh tokens of the user, all sessions end.
+func RevokeUserTokens(username string) {
+	tLock.Lock()
+	for token, t := range Tokens {
+		if t.User != nil && t.User.Username == username {
+			delete(Tokens, token)
+		}
+	}
+	tLock.Unlock()
+
+	oLock.Lock()
+	for token, r := range RefreshTokens {
+		if r.User != nil && r.User.Username == username {
+			delete(RefreshTokens, token)
+		}
+	}
+	oLock.Unlock()
+}
+
+// SessionID identifies the token in listings, the token itself is a credential and is not shown.
+func (t *Token) SessionID() string {
+	sum := sha256.Sum256([]byte(t.Token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// UserTokens returns the unexpired access tokens of the user, newest first.
+func UserTokens(username string) []*Token {
+	now := time.Now().Unix()
+	tokens := make([]*Token, 0)
+
+	tLock.RLock()
+	for _, t := range Tokens {
+		if t.User != nil && t.User.Username == username && t.ExpireAt >= now {
+			tokens = append(tokens, t)
+		}
+	}
+	tLock.RUnlock()
+
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].CreatedAt != tokens[j].CreatedAt {
+			return tokens[i].CreatedAt > tokens[j].CreatedAt
+		}
+		return tokens[i].Token < tokens[j].Token
+	})
+	return tokens
+}
+
+// RevokeUserToken removes an access token of the user by its SessionID, with the refresh token issued with it.
+func RevokeUserToken(username, id string) error {
+	var token *Token
+	for _, t := range UserTokens(username) {
+		if t.SessionID() == id {
+			token = t
+			break
+		}
+	}
+	if token == nil {
+		return TokenNotExistErr
+	}
+
+	oLock.Lock()
+	for k, r := range RefreshTokens {
+		if r.AccessToken == token.Token {
+			delete(RefreshTokens, k)
+		}
+	}
+	oLock.Unlock()
+
+	return token.Remove()
+}
+
 func (t *Token) Remove() error {
 	tLock.Lock()
 	defer tLock.Unlock()
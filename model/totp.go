@@ -0,0 +1,257 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	MFACodeRegex = `^[0-9]{6}$`
+
+	TOTPIssuer     = "auth-service-sample"
+	TOTPDigits     = 6
+	TOTPPeriod     = 30 // second
+	TOTPSkew       = 1  // steps accepted before and after current
+	TOTPSecretSize = 20
+
+	MFAChallengeLength   = 32
+	MFAChallengeLifeTime = 300 // second
+	MFAChallengeAttempts = 5
+	MFAUserAttempts      = 10  // per user within MFAAttemptWindow, across challenges
+	MFAAttemptWindow     = 900 // second
+)
+
+var (
+	MFAChallenges = make(map[string]*MFAChallenge, 0)
+	mfaAttempts   = make(map[string]*mfaAttempt, 0) // username as key
+
+	mLock sync.RWMutex // MFAChallenges and mfaAttempts lock
+
+	MFACodeErr        = errors.New("invalid mfa code")
+	MFAEnabledErr     = errors.New("mfa already enabled")
+	MFANotEnrolledErr = errors.New("mfa not enrolled")
+	MFAChallengeErr   = errors.New("invalid or expired mfa token")
+	MFAAttemptsErr    = errors.New("too many mfa attempts, try later")
+)
+
+// MFAChallenge is issued after password success, exchanged for a token with a valid code.
+type MFAChallenge struct {
+	Token    string `json:"mfaToken"`
+	User     *User
+	Scopes   []string // requested, for the token
+	ExpireAt int64    `json:"expireAt"`
+	Attempts int      `json:"attempts"`
+}
+
+// mfaAttempt counts the codes tried by a user since the first one of the window, a new challenge
+// after a correct password does not bring new attempts.
+type mfaAttempt struct {
+	Count int
+	Since int64
+}
+
+// EnrollTOTP generates a pending secret, mfa is enabled after VerifyTOTP.
+func (u *User) EnrollTOTP() (string, error) {
+	b := make([]byte, TOTPSecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	if u.MFAEnabled {
+		return "", MFAEnabledErr
+	}
+	u.TOTPSecret = secret
+	u.TOTPLastStep = 0
+
+	return secret, nil
+}
+
+// VerifyTOTP confirms enrollment with a code from the authenticator.
+func (u *User) VerifyTOTP(code string) error {
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	if u.MFAEnabled {
+		return MFAEnabledErr
+	}
+	if len(u.TOTPSecret) == 0 {
+		return MFANotEnrolledErr
+	}
+	step, ok := validateTOTP(u.TOTPSecret, code, u.TOTPLastStep, time.Now())
+	if !ok {
+		return MFACodeErr
+	}
+	u.TOTPLastStep = step
+	u.MFAEnabled = true
+
+	return nil
+}
+
+// CheckTOTP validates a login code, each time step is accepted only once.
+func (u *User) CheckTOTP(code string) bool {
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	if !u.MFAEnabled {
+		return false
+	}
+	step, ok := validateTOTP(u.TOTPSecret, code, u.TOTPLastStep, time.Now())
+	if !ok {
+		return false
+	}
+	u.TOTPLastStep = step
+
+	return true
+}
+
+func (u *User) HasMFA() bool {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	return u.MFAEnabled
+}
+
+func (u *User) ResetMFA() error {
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	if !u.MFAEnabled && len(u.TOTPSecret) == 0 {
+		return MFANotEnrolledErr
+	}
+	u.MFAEnabled = false
+	u.TOTPSecret = ""
+	u.TOTPLastStep = 0
+	u.RecoveryCodes = nil
+
+	return nil
+}
+
+func TOTPURI(username, secret string) string {
+	label := url.PathEscape(TOTPIssuer + ":" + username)
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTPIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(TOTPDigits))
+	v.Set("period", fmt.Sprint(TOTPPeriod))
+
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// TOTPCode computes the RFC 6238 code of a time step.
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation, RFC 4226 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTPDigits, bin%mod), nil
+}
+
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / TOTPPeriod
+}
+
+// validateTOTP returns the matched step, steps not after lastStep are rejected as replay.
+func validateTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	current := TOTPStep(now)
+	for step := current - TOTPSkew; step <= current+TOTPSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expect, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expect), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func NewMFAChallenge(user *User, scopes []string) (*MFAChallenge, error) {
+	b := make([]byte, MFAChallengeLength/2)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	c := &MFAChallenge{
+		Token:    fmt.Sprintf("%x", b),
+		User:     user,
+		Scopes:   scopes,
+		ExpireAt: time.Now().Unix() + MFAChallengeLifeTime,
+	}
+
+	mLock.Lock()
+	MFAChallenges[c.Token] = c
+	mLock.Unlock()
+
+	return c, nil
+}
+
+// GetMFAChallenge returns an unexpired challenge and counts the attempt, for the challenge and the user.
+// Challenges are dropped after too many attempts, users wait for the window after too many.
+func GetMFAChallenge(token string) (*MFAChallenge, error) {
+	now := time.Now().Unix()
+
+	mLock.Lock()
+	defer mLock.Unlock()
+
+	c, ok := MFAChallenges[token]
+	if !ok {
+		return nil, MFAChallengeErr
+	}
+	c.Attempts++
+	if c.ExpireAt < now || c.Attempts > MFAChallengeAttempts {
+		delete(MFAChallenges, token)
+		return nil, MFAChallengeErr
+	}
+	a, ok := mfaAttempts[c.User.Username]
+	if !ok || a.Since+MFAAttemptWindow < now {
+		a = &mfaAttempt{Since: now}
+		mfaAttempts[c.User.Username] = a
+	}
+	a.Count++
+	if a.Count > MFAUserAttempts {
+		return nil, MFAAttemptsErr
+	}
+
+	return c, nil
+}
+
+// Remove drops the challenge once used, with the attempts of the user.
+func (c *MFAChallenge) Remove() {
+	mLock.Lock()
+	defer mLock.Unlock()
+
+	delete(MFAChallenges, c.Token)
+	delete(mfaAttempts, c.User.Username)
+}
@@ -0,0 +1,598 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TransferJSONL = "jsonl"
+	TransferCSV   = "csv"
+
+	TransferUser  = "user"
+	TransferRole  = "role"
+	TransferGrant = "grant"
+
+	ImportMaxRecords = 100000
+)
+
+var (
+	TransferColumns = []string{"type", "id", "username", "password", "passwordHash", "pepperId", "email", "emailVerified",
+		"displayName", "department", "attributes", "disabled", "role", "description", "metadata"}
+
+	importLock sync.Mutex // one import at a time
+
+	TransferFormatErr  = errors.New("format only in jsonl, csv")
+	TransferColumnErr  = errors.New("invalid csv header or column count")
+	TransferTypeErr    = errors.New("type only in user, role, grant")
+	TransferPwdErr     = errors.New("user requires one of password, passwordHash")
+	TransferTooManyErr = errors.New("too many records, at most 100000")
+)
+
+// TransferRecord is one row of an import or export, the type decides which fields are used.
+// Roles are listed before users and grants after both in exports.
+type TransferRecord struct {
+	Type string `json:"type"`
+
+	ID            string                 `json:"id,omitempty"` // kept on import, generated when empty
+	Username      string                 `json:"username,omitempty"`
+	Password      string                 `json:"password,omitempty"`     // plain, hashed on import
+	PasswordHash  string                 `json:"passwordHash,omitempty"` // bcrypt or argon2id, used as is
+	PepperID      string                 `json:"pepperId,omitempty"`     // pepper applied before passwordHash
+	Email         string                 `json:"email,omitempty"`
+	EmailVerified bool                   `json:"emailVerified,omitempty"`
+	DisplayName   string                 `json:"displayName,omitempty"`
+	Department    string                 `json:"department,omitempty"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+	Disabled      bool                   `json:"disabled,omitempty"`
+
+	Role        string            `json:"role,omitempty"` // role and grant
+	Description string            `json:"description,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+
+	err error // decode error, reported for the row
+}
+
+type ImportOptions struct {
+	DryRun    bool // validate only
+	Atomic    bool // apply all rows or none, otherwise rows are applied one by one in batches
+	Offset    int  // batch mode, rows already processed
+	BatchSize int  // batch mode, rows processed by this call
+}
+
+type ImportError struct {
+	Row   int    `json:"row"` // 1-based, header excluded
+	Error string `json:"error"`
+}
+
+type ImportReport struct {
+	Total   int           `json:"total"`   // rows in the file
+	Applied int           `json:"applied"` // rows applied by this call, 0 in dry run
+	Errors  []ImportError `json:"errors"`
+	Next    int           `json:"next"` // offset of the next batch
+	Done    bool          `json:"done"`
+}
+
+// importPlan tracks users and roles created by earlier rows of the same import.
+type importPlan struct {
+	users map[string]struct{}
+	ids   map[string]struct{} // user ids
+	roles map[string]struct{}
+}
+
+func DecodeTransfer(r io.Reader, format string) ([]*TransferRecord, error) {
+	switch format {
+	case TransferJSONL:
+		return decodeJSONL(r)
+	case TransferCSV:
+		return decodeCSV(r)
+	default:
+		return nil, TransferFormatErr
+	}
+}
+
+func decodeJSONL(r io.Reader) ([]*TransferRecord, error) {
+	records := make([]*TransferRecord, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(records) >= ImportMaxRecords {
+			return nil, TransferTooManyErr
+		}
+		rec := &TransferRecord{}
+		rec.err = json.Unmarshal(line, rec)
+		records = append(records, rec)
+	}
+
+	return records, scanner.Err()
+}
+
+func decodeCSV(r io.Reader) ([]*TransferRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, TransferColumnErr
+	}
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		known := false
+		for _, column := range TransferColumns {
+			known = known || column == name
+		}
+		if _, dup := index[name]; !known || dup {
+			return nil, TransferColumnErr
+		}
+		index[name] = i
+	}
+
+	records := make([]*TransferRecord, 0)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if len(records) >= ImportMaxRecords {
+			return nil, TransferTooManyErr
+		}
+		rec := &TransferRecord{}
+		records = append(records, rec)
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return nil, err
+			}
+			rec.err = err
+			continue
+		}
+		if len(row) != len(header) {
+			rec.err = TransferColumnErr
+			continue
+		}
+		rec.err = rec.fromCSV(func(name string) string {
+			if i, ok := index[name]; ok {
+				return row[i]
+			}
+			return ""
+		})
+	}
+
+	return records, nil
+}
+
+func (rec *TransferRecord) fromCSV(get func(string) string) error {
+	rec.Type = get("type")
+	rec.ID = get("id")
+	rec.Username = get("username")
+	rec.Password = get("password")
+	rec.PasswordHash = get("passwordHash")
+	rec.PepperID = get("pepperId")
+	rec.Email = get("email")
+	rec.DisplayName = get("displayName")
+	rec.Department = get("department")
+	rec.Role = get("role")
+	rec.Description = get("description")
+
+	var err error
+	if v := get("emailVerified"); len(v) > 0 {
+		if rec.EmailVerified, err = strconv.ParseBool(v); err != nil {
+			return err
+		}
+	}
+	if v := get("disabled"); len(v) > 0 {
+		if rec.Disabled, err = strconv.ParseBool(v); err != nil {
+			return err
+		}
+	}
+	if v := get("attributes"); len(v) > 0 {
+		if err = json.Unmarshal([]byte(v), &rec.Attributes); err != nil {
+			return err
+		}
+	}
+	if v := get("metadata"); len(v) > 0 {
+		if err = json.Unmarshal([]byte(v), &rec.Metadata); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (rec *TransferRecord) toCSV() []string {
+	formatBool := func(b bool) string {
+		if !b {
+			return ""
+		}
+		return "true"
+	}
+	formatMap := func(m interface{}, n int) string {
+		if n == 0 {
+			return ""
+		}
+		b, _ := json.Marshal(m)
+		return string(b)
+	}
+
+	return []string{rec.Type, rec.ID, rec.Username, rec.Password, rec.PasswordHash, rec.PepperID, rec.Email,
+		formatBool(rec.EmailVerified), rec.DisplayName, rec.Department, formatMap(rec.Attributes, len(rec.Attributes)),
+		formatBool(rec.Disabled), rec.Role, rec.Description, formatMap(rec.Metadata, len(rec.Metadata))}
+}
+
+func EncodeTransfer(w io.Writer, format string, records []*TransferRecord) error {
+	switch format {
+	case TransferJSONL:
+		encoder := json.NewEncoder(w)
+		for _, rec := range records {
+			if err := encoder.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	case TransferCSV:
+		writer := csv.NewWriter(w)
+		writer.Write(TransferColumns)
+		for _, rec := range records {
+			writer.Write(rec.toCSV())
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		return TransferFormatErr
+	}
+}
+
+// ExportRecords returns roles, users with password hashes, and grants.
+// MFA secrets and webauthn credentials are not exported.
+func ExportRecords() []*TransferRecord {
+	records := make([]*TransferRecord, 0)
+
+	rLock.RLock()
+	roleNames := make([]string, 0, len(Roles))
+	for name := range Roles {
+		roleNames = append(roleNames, name)
+	}
+	sort.Strings(roleNames)
+	for _, name := range roleNames {
+		r := Roles[name]
+		records = append(records, &TransferRecord{
+			Type:        TransferRole,
+			Role:        r.Name,
+			Description: r.Description,
+			Metadata:    r.Metadata,
+		})
+	}
+	rLock.RUnlock()
+
+	uLock.RLock()
+	usernames := append([]string{}, userNames...)
+	for _, username := range usernames {
+		u := Users[username]
+		attrs := make(map[string]interface{}, len(u.Attributes))
+		for k, v := range u.Attributes {
+			attrs[k] = v
+		}
+		records = append(records, &TransferRecord{
+			Type:          TransferUser,
+			ID:            u.ID,
+			Username:      u.Username,
+			PasswordHash:  u.Password,
+			PepperID:      u.PepperID,
+			Email:         u.Email,
+			EmailVerified: u.EmailVerified,
+			DisplayName:   u.DisplayName,
+			Department:    u.Department,
+			Attributes:    attrs,
+			Disabled:      u.Disabled,
+		})
+	}
+	uLock.RUnlock()
+
+	rLock.RLock()
+	urLock.RLock()
+	for _, username := range usernames {
+		roles := make([]string, 0, len(UserRoles[username]))
+		for id := range UserRoles[username] {
+			if r, ok := RoleIDs[id]; ok {
+				roles = append(roles, r.Name)
+			}
+		}
+		sort.Strings(roles)
+		for _, role := range roles {
+			records = append(records, &TransferRecord{Type: TransferGrant, Username: username, Role: role})
+		}
+	}
+	urLock.RUnlock()
+	rLock.RUnlock()
+
+	return records
+}
+
+// Import validates rows against current data and earlier rows, and applies them.
+// In atomic mode nothing is applied when any row is invalid, and applied rows are
+// rolled back when a later row fails to apply. In batch mode rows from Offset are applied
+// one by one, invalid rows are reported and skipped, the import is resumed from Next.
+func Import(records []*TransferRecord, opts ImportOptions) *ImportReport {
+	importLock.Lock()
+	defer importLock.Unlock()
+
+	report := &ImportReport{Total: len(records), Errors: make([]ImportError, 0)}
+	plan := &importPlan{users: make(map[string]struct{}, 0), ids: make(map[string]struct{}, 0), roles: make(map[string]struct{}, 0)}
+	fail := func(i int, err error) {
+		report.Errors = append(report.Errors, ImportError{Row: i + 1, Error: err.Error()})
+	}
+
+	if opts.Atomic {
+		report.Next, report.Done = len(records), true
+		for i, rec := range records {
+			if err := rec.check(plan); err != nil {
+				fail(i, err)
+			}
+		}
+		if len(report.Errors) > 0 || opts.DryRun {
+			return report
+		}
+
+		undo := make([]func(), 0, len(records))
+		for i, rec := range records {
+			u, err := rec.apply()
+			if err != nil { // changed concurrently since checked
+				fail(i, err)
+				for j := len(undo) - 1; j >= 0; j-- {
+					undo[j]()
+				}
+				return report
+			}
+			undo = append(undo, u)
+		}
+		report.Applied = len(records)
+
+		return report
+	}
+
+	start, end := opts.Offset, opts.Offset+opts.BatchSize
+	if start > len(records) {
+		start = len(records)
+	}
+	if end > len(records) {
+		end = len(records)
+	}
+	// rows of earlier batches are not applied in dry run, check them again to plan
+	if opts.DryRun {
+		for _, rec := range records[:start] {
+			rec.check(plan)
+		}
+	}
+	for i := start; i < end; i++ {
+		rec := records[i]
+		if err := rec.check(plan); err != nil {
+			fail(i, err)
+			continue
+		}
+		if opts.DryRun {
+			continue
+		}
+		if _, err := rec.apply(); err != nil {
+			fail(i, err)
+			continue
+		}
+		report.Applied++
+	}
+	report.Next, report.Done = end, end == len(records)
+
+	return report
+}
+
+func (p *importPlan) add(rec *TransferRecord) {
+	switch rec.Type {
+	case TransferUser:
+		p.users[rec.Username] = struct{}{}
+		if len(rec.ID) > 0 {
+			p.ids[rec.ID] = struct{}{}
+		}
+	case TransferRole:
+		p.roles[rec.Role] = struct{}{}
+	}
+}
+
+func (p *importPlan) hasUser(username string) bool {
+	_, ok := p.users[username]
+	return ok || GetUser(username) != nil
+}
+
+func (p *importPlan) hasUserID(id string) bool {
+	_, ok := p.ids[id]
+	return ok || userIDExist(id)
+}
+
+func (p *importPlan) hasRole(role string) bool {
+	_, ok := p.roles[role]
+	return ok || GetRole(role) != nil
+}
+
+func (rec *TransferRecord) normalize() error {
+	rec.Type = strings.ToLower(strings.TrimSpace(rec.Type))
+	rec.ID = strings.TrimSpace(rec.ID)
+	rec.Username = strings.ToLower(strings.TrimSpace(rec.Username))
+	rec.Role = strings.ToLower(strings.TrimSpace(rec.Role))
+	rec.Email = strings.ToLower(strings.TrimSpace(rec.Email))
+
+	nameReg := regexp.MustCompile(UsernameRegex)
+	roleReg := regexp.MustCompile(RoleRegex)
+	switch rec.Type {
+	case TransferUser:
+		if !nameReg.MatchString(rec.Username) {
+			return UserNameErr
+		}
+	case TransferRole:
+		if !roleReg.MatchString(rec.Role) {
+			return RoleNameErr
+		}
+	case TransferGrant:
+		if !nameReg.MatchString(rec.Username) {
+			return UserNameErr
+		}
+		if !roleReg.MatchString(rec.Role) {
+			return RoleNameErr
+		}
+	default:
+		return TransferTypeErr
+	}
+
+	return nil
+}
+
+// check validates the row and adds it to the plan.
+func (rec *TransferRecord) check(plan *importPlan) error {
+	if rec.err != nil {
+		return rec.err
+	}
+	if err := rec.normalize(); err != nil {
+		return err
+	}
+
+	switch rec.Type {
+	case TransferUser:
+		if plan.hasUser(rec.Username) {
+			return UserExistErr
+		}
+		if len(rec.ID) > 0 {
+			if !regexp.MustCompile(UserIDRegex).MatchString(rec.ID) {
+				return UserIDErr
+			}
+			if plan.hasUserID(rec.ID) {
+				return UserIDExistErr
+			}
+		}
+		if (len(rec.PasswordHash) > 0) == (len(rec.Password) > 0) {
+			return TransferPwdErr
+		}
+		if len(rec.PasswordHash) > 0 {
+			if err := CheckPwdHash(rec.PasswordHash); err != nil {
+				return err
+			}
+			if _, err := pepper("", rec.PepperID); err != nil {
+				return err
+			}
+		} else if !regexp.MustCompile(PwdRegex).MatchString(rec.Password) {
+			return UserPwdErr
+		}
+		if len(rec.Email) > 0 && !regexp.MustCompile(EmailRegex).MatchString(rec.Email) {
+			return ProfileEmailErr
+		}
+		if len(rec.DisplayName) > ProfileMaxLength || len(rec.Department) > ProfileMaxLength {
+			return ProfileLengthErr
+		}
+		if err := CheckAttributes(rec.Attributes); err != nil {
+			return err
+		}
+	case TransferRole:
+		if plan.hasRole(rec.Role) {
+			return RoleExistErr
+		}
+		if len(rec.Description) > RoleDescriptionMaxLength {
+			return RoleDescriptionErr
+		}
+		if err := CheckRoleMetadata(rec.Metadata); err != nil {
+			return err
+		}
+	case TransferGrant:
+		if !plan.hasUser(rec.Username) {
+			return UserNotExistErr
+		}
+		if !plan.hasRole(rec.Role) {
+			return RoleNotExistErr
+		}
+	}
+	plan.add(rec)
+
+	return nil
+}
+
+// apply applies a checked row, and returns how to undo it.
+func (rec *TransferRecord) apply() (func(), error) {
+	switch rec.Type {
+	case TransferUser:
+		id := rec.ID
+		if len(id) == 0 {
+			var err error
+			if id, err = newUserID(); err != nil {
+				return nil, err
+			}
+		}
+		u := &User{
+			ID:            id,
+			Username:      rec.Username,
+			Password:      rec.PasswordHash,
+			PepperID:      rec.PepperID,
+			Disabled:      rec.Disabled,
+			CreatedAt:     time.Now().Unix(),
+			EmailVerified: rec.EmailVerified && len(rec.Email) > 0,
+		}
+		u.Email = rec.Email
+		u.DisplayName = rec.DisplayName
+		u.Department = rec.Department
+		u.Attributes = rec.Attributes
+		if len(rec.Password) > 0 {
+			u.PepperID = activePepper()
+			hash, err := hashPwd(rec.Password, u.PepperID)
+			if err != nil {
+				return nil, err
+			}
+			u.Password = hash
+		}
+
+		uLock.Lock()
+		if _, ok := Users[u.Username]; ok {
+			uLock.Unlock()
+			return nil, UserExistErr
+		}
+		if _, ok := userIDs[u.ID]; ok {
+			uLock.Unlock()
+			return nil, UserIDExistErr
+		}
+		Users[u.Username] = u
+		indexUser(u)
+		uLock.Unlock()
+
+		return func() { DeleteUser(u.Username) }, nil
+	case TransferRole:
+		if err := CreateRole(rec.Role, rec.Description, rec.Metadata); err != nil {
+			return nil, err
+		}
+		role := rec.Role
+
+		return func() { DeleteRole(role) }, nil
+	case TransferGrant:
+		user, role := GetUser(rec.Username), GetRole(rec.Role)
+		if user == nil {
+			return nil, UserNotExistErr
+		}
+		if role == nil {
+			return nil, RoleNotExistErr
+		}
+		if user.CheckRole(role.Name) {
+			return func() {}, nil
+		}
+		if err := user.AddRole(role); err != nil {
+			return nil, err
+		}
+
+		return func() { user.RevokeRole(role) }, nil
+	default:
+		return nil, TransferTypeErr
+	}
+}
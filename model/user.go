@@ -1,44 +1,109 @@
 package model
 
 import (
+	"crypto/rand"
 	"errors"
+	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	UsernameRegex = `^[a-zA-Z0-9]{3,15}$`
+	UserIDRegex   = `^[0-9a-f]{32}$`
+	UserIDLength  = 32
 	PwdRegex      = `^[ -~]{6,20}$`
 )
 
 var (
 	Users     = make(map[string]*User, 0)
-	UserRoles = make(map[string]map[string]struct{}, 0)
+	UserRoles = make(map[string]map[string]struct{}, 0) // username => role ids
+	RoleUsers = make(map[string]map[string]struct{}, 0) // role id => usernames
 
 	uLock  sync.RWMutex // Users lock
-	urLock sync.RWMutex // UserRoles lock
+	urLock sync.RWMutex // UserRoles and RoleUsers lock, taken after rLock
 
 	UserNameErr     = errors.New("username only contains number and alphabet, len 3-15")
 	UserPwdErr      = errors.New("password only contains ascii space-~, len 6-20")
 	UserCheckErr    = errors.New("invalid username or password")
 	UserExistErr    = errors.New("user already exist")
 	UserNotExistErr = errors.New("user not exist")
+	UserIDErr       = errors.New("user id only contains 32 lowercase hex digits")
+	UserIDExistErr  = errors.New("user id already exist")
+	UserDisabledErr = errors.New("user disabled")
 )
 
 type User struct {
+	ID       string `json:"id"` // random, never reused like usernames, the oidc subject
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	PepperID string `json:"pepperId"` // pepper key id applied before hashing
+	Disabled bool   `json:"disabled"` // disabled users can not login, tokens are rejected
+
+	ServiceAccount bool `json:"serviceAccount"` // no password login, api keys only
+	Profile
+
+	ExternalID string `json:"externalId"` // id in the provisioning client(scim)
+
+	CreatedAt     int64   `json:"createdAt"`
+	EmailVerified bool    `json:"emailVerified"`
+	Pending       bool    `json:"pending"` // created with email verification required, until verified
+	VerifyMails   []int64 `json:"-"`       // verification mail timestamps, for rate limiting
+	ResetMails    []int64 `json:"-"`       // password reset mail timestamps, for rate limiting
+
+	TOTPSecret   string `json:"-"`
+	TOTPLastStep int64  `json:"-"` // last accepted time step, for replay protection
+	MFAEnabled   bool   `json:"mfaEnabled"`
+
+	RecoveryCodes []string `json:"-"` // sha256 of unused recovery codes
+
+	WebAuthnID  string                `json:"-"` // user handle
+	Credentials []*WebAuthnCredential `json:"-"`
 }
 
 func (u *User) CheckPwd(password string) bool {
+	uLock.RLock()
+	hash, pepperID := u.Password, u.PepperID
+	uLock.RUnlock()
+
 	// Returns true on success, pwd1 is for the database.
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	peppered, err := pepper(password, pepperID)
 	if err != nil {
 		return false
-	} else {
-		return true
 	}
+	if !comparePwd(hash, peppered) {
+		return false
+	}
+
+	// pepper rotated or imported argon2 hash, re-hash with bcrypt and the active key,
+	// unless the password changed meanwhile
+	if id := activePepper(); id != pepperID || strings.HasPrefix(hash, Argon2Prefix) {
+		if rehash, err := hashPwd(password, id); err == nil {
+			uLock.Lock()
+			if u.Password == hash && u.PepperID == pepperID {
+				u.Password, u.PepperID = rehash, id
+			}
+			uLock.Unlock()
+		}
+	}
+
+	return true
+}
+
+func hashPwd(password, pepperID string) (string, error) {
+	peppered, err := pepper(password, pepperID)
+	if err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword(peppered, bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
 }
 
 func GetUser(username string) *User {
@@ -49,7 +114,25 @@ func GetUser(username string) *User {
 	return Users[username]
 }
 
-func CreateUser(username, password string) error {
+func newUserID() (string, error) {
+	b := make([]byte, UserIDLength/2)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", b), nil
+}
+
+// CreateUser with an optional email, which has to be verified when EmailVerifyRequired.
+func CreateUser(username, password, email string) error {
+	if EmailVerifyRequired && len(email) == 0 {
+		return EmailRequiredErr
+	}
+	id, err := newUserID()
+	if err != nil {
+		return err
+	}
+
 	// lock
 	uLock.Lock()
 	defer uLock.Unlock()
@@ -58,35 +141,190 @@ func CreateUser(username, password string) error {
 		return UserExistErr
 	} else {
 		u := &User{
-			Username: username,
+			ID:        id,
+			Username:  username,
+			CreatedAt: time.Now().Unix(),
+			Pending:   EmailVerifyRequired,
 		}
+		u.Email = email
 
 		// encrypt password
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		u.PepperID = activePepper()
+		hash, err := hashPwd(password, u.PepperID)
 		if err != nil {
 			return err
 		}
-		u.Password = string(hash)
+		u.Password = hash
 
 		Users[u.Username] = u
+		indexUser(u)
 
 		return nil
 	}
 }
 
+// UserChanges are the attributes a provisioning client sets, applied at once, nil is unchanged.
+type UserChanges struct {
+	Password    *string // empty disables password login
+	Email       *string
+	DisplayName *string
+	Department  *string
+	ExternalID  *string
+	Disabled    *bool
+}
+
+// ProvisionUser creates a user pushed by a provisioning client, without email verification.
+// Users without password can not login with password.
+func ProvisionUser(username string, changes UserChanges) (*User, error) {
+	hash, pepperID, err := changes.hash()
+	if err != nil {
+		return nil, err
+	}
+	id, err := newUserID()
+	if err != nil {
+		return nil, err
+	}
+	u := &User{
+		ID:        id,
+		Username:  username,
+		CreatedAt: time.Now().Unix(),
+	}
+	changes.apply(u, hash, pepperID)
+
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	if _, ok := Users[username]; ok {
+		return nil, UserExistErr
+	}
+	Users[u.Username] = u
+	indexUser(u)
+
+	return u, nil
+}
+
+// Provision applies the changes of a provisioning client, all or none when the user was deleted meanwhile.
+func (u *User) Provision(changes UserChanges) error {
+	hash, pepperID, err := changes.hash()
+	if err != nil {
+		return err
+	}
+
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	if Users[u.Username] != u {
+		return UserNotExistErr
+	}
+	changes.apply(u, hash, pepperID)
+
+	return nil
+}
+
+func (ch UserChanges) hash() (string, string, error) {
+	if ch.Password == nil || len(*ch.Password) == 0 {
+		return "", "", nil
+	}
+	pepperID := activePepper()
+	hash, err := hashPwd(*ch.Password, pepperID)
+	if err != nil {
+		return "", "", err
+	}
+
+	return hash, pepperID, nil
+}
+
+// apply sets the changes, the caller holds uLock or the user is not stored yet.
+func (ch UserChanges) apply(u *User, hash, pepperID string) {
+	if ch.Password != nil {
+		u.Password, u.PepperID = hash, pepperID
+	}
+	if ch.Email != nil && *ch.Email != u.Email {
+		u.Email = *ch.Email
+		u.EmailVerified = false
+	}
+	if ch.DisplayName != nil {
+		u.DisplayName = *ch.DisplayName
+	}
+	if ch.Department != nil {
+		u.Department = *ch.Department
+	}
+	if ch.ExternalID != nil {
+		u.ExternalID = *ch.ExternalID
+	}
+	if ch.Disabled != nil {
+		u.Disabled = *ch.Disabled
+	}
+}
+
+// BootstrapAdmin creates the admin role and grants it to the user, created without email verification
+// when it does not exist, an existing user keeps its password. Role grants are admin endpoints, the first
+// admin is created this way.
+func BootstrapAdmin(username, password string) error {
+	if err := CreateRole(AdminRole, "", nil); err != nil && err != RoleExistErr {
+		return err
+	}
+	if _, err := ProvisionUser(username, UserChanges{Password: &password}); err != nil && err != UserExistErr {
+		return err
+	}
+
+	user, role := GetUser(username), GetRole(AdminRole)
+	if user == nil || role == nil { // deleted concurrently
+		return UserNotExistErr
+	}
+	return user.AddRole(role)
+}
+
+// SetPassword replaces the password, empty disables password login.
+func (u *User) SetPassword(password string) error {
+	hash, pepperID := "", ""
+	if len(password) > 0 {
+		pepperID = activePepper()
+		var err error
+		if hash, err = hashPwd(password, pepperID); err != nil {
+			return err
+		}
+	}
+
+	uLock.Lock()
+	u.Password, u.PepperID = hash, pepperID
+	uLock.Unlock()
+
+	return nil
+}
+
+func (u *User) GetExternalID() string {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	return u.ExternalID
+}
+
 func DeleteUser(username string) error {
+	return deleteUser(username, nil)
+}
+
+// deleteUser deletes the user when match, if not nil, holds for it under the lock.
+func deleteUser(username string, match func(u *User) bool) error {
 	// lock
 	uLock.Lock()
 
-	if _, ok := Users[username]; !ok {
+	if u, ok := Users[username]; !ok || match != nil && !match(u) {
 		uLock.Unlock()
 		return UserNotExistErr
 	} else {
 		delete(Users, username)
+		unindexUser(u)
 		uLock.Unlock()
 
-		// delete user in UserRoles
+		deleteCredentials(u)
+		deleteAPIKeys(username)
+
+		// delete user in UserRoles and RoleUsers
 		urLock.Lock()
+		for role := range UserRoles[username] {
+			delete(RoleUsers[role], username)
+		}
 		delete(UserRoles, username)
 		urLock.Unlock()
 	}
@@ -94,54 +332,107 @@ func DeleteUser(username string) error {
 	return nil
 }
 
+// SetDisabled disables or re-enables a user, role grants are kept.
+func SetDisabled(username string, disabled bool) error {
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	if u, ok := Users[username]; !ok {
+		return UserNotExistErr
+	} else {
+		u.Disabled = disabled
+	}
+
+	return nil
+}
+
+// CanLogin checks the account state after credentials are verified.
+func (u *User) CanLogin() error {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	if u.Disabled {
+		return UserDisabledErr
+	}
+	if u.ServiceAccount {
+		return ServiceAccountLoginErr
+	}
+	if u.Pending && EmailVerifyRequired {
+		return EmailNotVerifiedErr
+	}
+
+	return nil
+}
+
+func (u *User) IsDisabled() bool {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	return u.Disabled
+}
+
+// AddRole grants a role, roles deleted concurrently are rejected.
 func (u *User) AddRole(role *Role) error {
+	rLock.RLock()
+	defer rLock.RUnlock()
+
+	if _, ok := RoleIDs[role.ID]; !ok {
+		return RoleNotExistErr
+	}
+
 	urLock.Lock()
 	defer urLock.Unlock()
 
 	if _, ok := UserRoles[u.Username]; !ok {
-		roles := make(map[string]struct{}, 0)
-		roles[role.Name] = struct{}{}
-		UserRoles[u.Username] = roles
-	} else {
-		UserRoles[u.Username][role.Name] = struct{}{}
+		UserRoles[u.Username] = make(map[string]struct{}, 0)
 	}
+	UserRoles[u.Username][role.ID] = struct{}{}
+	if _, ok := RoleUsers[role.ID]; !ok {
+		RoleUsers[role.ID] = make(map[string]struct{}, 0)
+	}
+	RoleUsers[role.ID][u.Username] = struct{}{}
 
 	return nil
 }
 
+// RevokeRole removes a grant, it is a no-op when the role is not held.
+func (u *User) RevokeRole(role *Role) {
+	urLock.Lock()
+	defer urLock.Unlock()
+
+	delete(UserRoles[u.Username], role.ID)
+	delete(RoleUsers[role.ID], u.Username)
+}
+
+// CheckRole checks the role by its current name.
 func (u *User) CheckRole(role string) bool {
-	urLock.RLock()
-	defer urLock.RUnlock()
+	rLock.RLock()
+	defer rLock.RUnlock()
 
-	if m, ok := UserRoles[u.Username]; !ok {
+	r, ok := Roles[role]
+	if !ok {
 		return false
-	} else {
-		if _, ok := m[role]; ok {
-			return true
-		} else {
-			return false
-		}
 	}
+
+	urLock.RLock()
+	defer urLock.RUnlock()
+
+	_, ok = UserRoles[u.Username][r.ID]
+	return ok
 }
 
 func (u *User) Roles() []string {
-	urLock.Lock()
+	rLock.RLock()
+	urLock.RLock()
 
-	roles := make([]string, 0)
-	if m, ok := UserRoles[u.Username]; !ok {
-		urLock.Unlock()
-		return roles
-	} else {
-		for r := range m {
-			role := GetRole(r)
-			if role == nil { // role has been deleted
-				delete(UserRoles[u.Username], r)
-			} else {
-				roles = append(roles, r)
-			}
+	roles := make([]string, 0, len(UserRoles[u.Username]))
+	for id := range UserRoles[u.Username] {
+		if r, ok := RoleIDs[id]; ok {
+			roles = append(roles, r.Name)
 		}
-		urLock.Unlock()
 	}
+	urLock.RUnlock()
+	rLock.RUnlock()
 
 	sort.Strings(roles)
 	return roles
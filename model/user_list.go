@@ -0,0 +1,205 @@
+package model
+
+import (
+	"sort"
+	"strings"
+)
+
+var (
+	UserListBatch = 256 // users examined per uLock hold
+
+	userNames = make([]string, 0)          // sorted usernames, guarded by uLock
+	userIDs   = make(map[string]string, 0) // user id => username, guarded by uLock
+)
+
+type UserFilter struct {
+	Prefix        string
+	Contains      string
+	Role          string
+	Disabled      *bool
+	CreatedAfter  int64 // unix second, 0 means no bound
+	CreatedBefore int64
+}
+
+func (f *UserFilter) match(u *User) bool {
+	if len(f.Contains) > 0 && !strings.Contains(u.Username, f.Contains) {
+		return false
+	}
+	if f.Disabled != nil && u.Disabled != *f.Disabled {
+		return false
+	}
+	if f.CreatedAfter > 0 && u.CreatedAt < f.CreatedAfter {
+		return false
+	}
+	if f.CreatedBefore > 0 && u.CreatedAt >= f.CreatedBefore {
+		return false
+	}
+
+	return true
+}
+
+func userIDExist(id string) bool {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	_, ok := userIDs[id]
+	return ok
+}
+
+// must hold uLock
+func indexUser(u *User) {
+	i := sort.SearchStrings(userNames, u.Username)
+	userNames = append(userNames, "")
+	copy(userNames[i+1:], userNames[i:])
+	userNames[i] = u.Username
+	userIDs[u.ID] = u.Username
+}
+
+// must hold uLock
+func unindexUser(u *User) {
+	i := sort.SearchStrings(userNames, u.Username)
+	if i < len(userNames) && userNames[i] == u.Username {
+		userNames = append(userNames[:i], userNames[i+1:]...)
+	}
+	delete(userIDs, u.ID)
+}
+
+// ListUsers returns up to limit users ordered by username after cursor(the last username of the previous page),
+// and the cursor of the next page, empty when there is none.
+// Users are scanned in batches, uLock is released between batches.
+// With a role filter only the members of the role are scanned.
+func ListUsers(filter UserFilter, cursor string, limit int, desc bool) ([]*User, string) {
+	var names []string
+	if len(filter.Role) > 0 {
+		names = RoleMembers(filter.Role)
+	}
+
+	users := make([]*User, 0, limit+1)
+	for len(users) <= limit {
+		batch, last := scanUsers(&filter, names, cursor, desc)
+		for _, u := range batch {
+			users = append(users, u)
+			if len(users) > limit {
+				break
+			}
+		}
+		if len(last) == 0 {
+			break
+		}
+		cursor = last
+	}
+
+	if len(users) > limit {
+		return users[:limit], users[limit-1].Username
+	}
+	return users, ""
+}
+
+// RoleMembers returns sorted usernames holding the role.
+func RoleMembers(role string) []string {
+	names := make([]string, 0)
+
+	rLock.RLock()
+	if r, ok := Roles[role]; ok {
+		urLock.RLock()
+		for username := range RoleUsers[r.ID] {
+			names = append(names, username)
+		}
+		urLock.RUnlock()
+	}
+	rLock.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// scanUsers examines one batch of names(all users when nil) after cursor, returns matched users and
+// the last username examined, empty when the scan is finished.
+func scanUsers(filter *UserFilter, names []string, cursor string, desc bool) ([]*User, string) {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	all := userNames
+	if names != nil {
+		all = names
+	}
+
+	matched := make([]*User, 0)
+	last := ""
+	if !desc {
+		i := sort.SearchStrings(all, cursor)
+		if i < len(all) && all[i] == cursor {
+			i++
+		}
+		if j := sort.SearchStrings(all, filter.Prefix); j > i {
+			i = j
+		}
+		for n := 0; n < UserListBatch && i < len(all); n, i = n+1, i+1 {
+			name := all[i]
+			if !strings.HasPrefix(name, filter.Prefix) { // sorted, no more
+				return matched, ""
+			}
+			if u := Users[name]; u != nil && filter.match(u) {
+				matched = append(matched, u)
+			}
+			last = name
+		}
+		if i >= len(all) {
+			last = ""
+		}
+	} else {
+		i := len(all)
+		if len(cursor) > 0 {
+			i = sort.SearchStrings(all, cursor)
+		}
+		if len(filter.Prefix) > 0 { // usernames are ascii, all with prefix sort before prefix+DEL
+			if j := sort.SearchStrings(all, filter.Prefix+"\x7f"); j < i {
+				i = j
+			}
+		}
+		i--
+		for n := 0; n < UserListBatch && i >= 0; n, i = n+1, i-1 {
+			name := all[i]
+			if !strings.HasPrefix(name, filter.Prefix) { // sorted, no more
+				return matched, ""
+			}
+			if u := Users[name]; u != nil && filter.match(u) {
+				matched = append(matched, u)
+			}
+			last = name
+		}
+		if i < 0 {
+			last = ""
+		}
+	}
+
+	return matched, last
+}
+
+// UsersPage returns users by offset(0-based) ordered by username, and the number of users.
+func UsersPage(offset, count int) ([]*User, int) {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	users := make([]*User, 0, count)
+	for i := offset; i < offset+count && i < len(userNames); i++ {
+		users = append(users, Users[userNames[i]])
+	}
+
+	return users, len(userNames)
+}
+
+// FindUsersByExternalID scans all users.
+func FindUsersByExternalID(externalID string) []*User {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	users := make([]*User, 0)
+	for _, name := range userNames {
+		if u := Users[name]; u.ExternalID == externalID {
+			users = append(users, u)
+		}
+	}
+
+	return users
+}
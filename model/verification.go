@@ -0,0 +1,137 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	VerifyResendInterval = 60    // second between two mails
+	VerifyResendMax      = 5     // mails per window
+	VerifyResendWindow   = 86400 // second
+)
+
+var (
+	EmailVerifyRequired bool           // pending accounts can not login
+	EmailVerifyLifeTime int64 = 86400  // verification link life time(second)
+	UnverifiedLifeTime  int64 = 604800 // pending accounts are deleted after(second), 0 never
+
+	EmailRequiredErr     = errors.New("email required")
+	EmailVerifiedErr     = errors.New("email already verified")
+	EmailNotVerifiedErr  = errors.New("email not verified")
+	VerifyTokenErr       = errors.New("invalid or expired verification token")
+	VerifyRateLimitedErr = errors.New("too many verification mails, try later")
+)
+
+// VerificationToken signs the current email, changing email invalidates earlier links.
+func (u *User) VerificationToken() (string, error) {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	if len(u.Email) == 0 {
+		return "", EmailRequiredErr
+	}
+	if u.EmailVerified {
+		return "", EmailVerifiedErr
+	}
+	exp := time.Now().Unix() + EmailVerifyLifeTime
+
+	return signValue(fmt.Sprintf("verify|%s|%s|%d", u.Username, u.Email, exp)), nil
+}
+
+// VerifyEmail marks the email of the token verified and activates a pending account.
+func VerifyEmail(token string) (*User, error) {
+	value, ok := verifyValue(token)
+	if !ok {
+		return nil, VerifyTokenErr
+	}
+	parts := strings.Split(value, "|")
+	if len(parts) != 4 || parts[0] != "verify" {
+		return nil, VerifyTokenErr
+	}
+	exp, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil || exp < time.Now().Unix() {
+		return nil, VerifyTokenErr
+	}
+
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	u, ok := Users[parts[1]]
+	if !ok || u.Email != parts[2] {
+		return nil, VerifyTokenErr
+	}
+	u.EmailVerified = true
+	u.Pending = false
+
+	return u, nil
+}
+
+func (u *User) IsEmailVerified() bool {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	return u.EmailVerified
+}
+
+// AllowVerifyMail records a verification mail, rate limited per user.
+func (u *User) AllowVerifyMail() error {
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	if u.EmailVerified {
+		return EmailVerifiedErr
+	}
+	var ok bool
+	if u.VerifyMails, ok = allowMail(u.VerifyMails); !ok {
+		return VerifyRateLimitedErr
+	}
+
+	return nil
+}
+
+// allowMail drops timestamps out of the window, and appends now when another mail is allowed.
+func allowMail(mails []int64) ([]int64, bool) {
+	now := time.Now().Unix()
+	sent := make([]int64, 0, len(mails)+1)
+	for _, ts := range mails {
+		if ts > now-VerifyResendWindow {
+			sent = append(sent, ts)
+		}
+	}
+	if len(sent) >= VerifyResendMax || (len(sent) > 0 && sent[len(sent)-1] > now-VerifyResendInterval) {
+		return sent, false
+	}
+
+	return append(sent, now), true
+}
+
+// ExpireUnverifiedUsers deletes pending accounts older than UnverifiedLifeTime.
+func ExpireUnverifiedUsers() []string {
+	if !EmailVerifyRequired || UnverifiedLifeTime <= 0 {
+		return nil
+	}
+
+	stale := make([]*User, 0)
+	deadline := time.Now().Unix() - UnverifiedLifeTime
+	uLock.RLock()
+	for _, u := range Users {
+		if u.Pending && u.CreatedAt < deadline {
+			stale = append(stale, u)
+		}
+	}
+	uLock.RUnlock()
+
+	// verified or deleted and created again meanwhile, kept
+	expired := make([]string, 0, len(stale))
+	for _, s := range stale {
+		if deleteUser(s.Username, func(u *User) bool { return u == s && u.Pending }) == nil {
+			expired = append(expired, s.Username)
+		}
+	}
+
+	return expired
+}
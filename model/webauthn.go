@@ -0,0 +1,434 @@
+package model
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/fxamacker/cbor/v2"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	WebAuthnChallengeSize = 32
+	WebAuthnTimeout       = 300 // second
+
+	WebAuthnCreate = "webauthn.create"
+	WebAuthnGet    = "webauthn.get"
+
+	// COSE algorithms
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+
+	// authenticator data flags
+	flagUserPresent = 0x01
+	flagAttested    = 0x40
+)
+
+var (
+	WebAuthnRPID   = "localhost"
+	WebAuthnRPName = "auth service sample"
+	WebAuthnOrigin = "http://localhost:8080"
+
+	WebAuthnSessions = make(map[string]*WebAuthnSession, 0) // challenge => session
+	Credentials      = make(map[string]string, 0)           // credential id => username
+
+	wLock sync.RWMutex // WebAuthnSessions, Credentials lock
+
+	WebAuthnSessionErr     = errors.New("invalid or expired webauthn challenge")
+	WebAuthnClientDataErr  = errors.New("invalid webauthn client data")
+	WebAuthnAuthDataErr    = errors.New("invalid webauthn authenticator data")
+	WebAuthnAttestationErr = errors.New("invalid webauthn attestation")
+	WebAuthnSignatureErr   = errors.New("invalid webauthn signature")
+	WebAuthnAlgorithmErr   = errors.New("unsupported webauthn public key algorithm")
+	WebAuthnSignCountErr   = errors.New("webauthn sign count not increased, authenticator may be cloned")
+	CredentialExistErr     = errors.New("credential already exist")
+	CredentialNotExistErr  = errors.New("credential not exist")
+
+	b64url = base64.RawURLEncoding
+
+	// packed attestation cert extension id-fido-gen-ce-aaguid
+	oidAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+)
+
+// WebAuthnSession holds a ceremony challenge until it is answered or expired.
+type WebAuthnSession struct {
+	Challenge string `json:"challenge"`
+	Type      string `json:"type"` // webauthn.create or webauthn.get
+	Username  string `json:"username"`
+	ExpireAt  int64  `json:"expireAt"`
+}
+
+type WebAuthnCredential struct {
+	ID          string `json:"id"`        // base64url credential id
+	PublicKey   []byte `json:"publicKey"` // COSE key
+	Algorithm   int64  `json:"algorithm"`
+	SignCount   uint32 `json:"signCount"`
+	Attestation string `json:"attestation"` // attestation format
+	CreatedAt   int64  `json:"createdAt"`
+	LastUsedAt  int64  `json:"lastUsedAt"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type attestationObject struct {
+	Fmt      string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+type packedAttestation struct {
+	Alg int64    `cbor:"alg"`
+	Sig []byte   `cbor:"sig"`
+	X5C [][]byte `cbor:"x5c,omitempty"`
+}
+
+type coseKey struct {
+	Kty int64           `cbor:"1,keyasint"`
+	Alg int64           `cbor:"3,keyasint"`
+	P1  cbor.RawMessage `cbor:"-1,keyasint"` // crv, n for rsa
+	P2  []byte          `cbor:"-2,keyasint"` // x, e for rsa
+	P3  []byte          `cbor:"-3,keyasint"` // y
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte // COSE key
+}
+
+// WebAuthnUserID returns the user handle, generated on first use.
+func (u *User) WebAuthnUserID() string {
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	if len(u.WebAuthnID) == 0 {
+		b := make([]byte, 16)
+		rand.Read(b)
+		u.WebAuthnID = b64url.EncodeToString(b)
+	}
+
+	return u.WebAuthnID
+}
+
+func (u *User) WebAuthnCredentials() []*WebAuthnCredential {
+	uLock.RLock()
+	defer uLock.RUnlock()
+
+	credentials := make([]*WebAuthnCredential, len(u.Credentials))
+	copy(credentials, u.Credentials)
+	return credentials
+}
+
+func NewWebAuthnSession(typ, username string) (*WebAuthnSession, error) {
+	b := make([]byte, WebAuthnChallengeSize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	s := &WebAuthnSession{
+		Challenge: b64url.EncodeToString(b),
+		Type:      typ,
+		Username:  username,
+		ExpireAt:  time.Now().Unix() + WebAuthnTimeout,
+	}
+
+	wLock.Lock()
+	WebAuthnSessions[s.Challenge] = s
+	wLock.Unlock()
+
+	return s, nil
+}
+
+// takeWebAuthnSession verifies client data and consumes its session.
+func takeWebAuthnSession(clientDataJSON []byte, typ string) (*WebAuthnSession, error) {
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return nil, WebAuthnClientDataErr
+	}
+	if cd.Type != typ || cd.Origin != WebAuthnOrigin {
+		return nil, WebAuthnClientDataErr
+	}
+
+	wLock.Lock()
+	defer wLock.Unlock()
+
+	s, ok := WebAuthnSessions[cd.Challenge]
+	if !ok || s.Type != typ {
+		return nil, WebAuthnSessionErr
+	}
+	delete(WebAuthnSessions, cd.Challenge)
+	if s.ExpireAt < time.Now().Unix() {
+		return nil, WebAuthnSessionErr
+	}
+
+	return s, nil
+}
+
+// RegisterWebAuthn verifies a registration ceremony, supports attestation none and packed.
+func (u *User) RegisterWebAuthn(clientDataJSON, attestation []byte) (*WebAuthnCredential, error) {
+	s, err := takeWebAuthnSession(clientDataJSON, WebAuthnCreate)
+	if err != nil {
+		return nil, err
+	}
+	if s.Username != u.Username {
+		return nil, WebAuthnSessionErr
+	}
+
+	var obj attestationObject
+	if err := cbor.Unmarshal(attestation, &obj); err != nil {
+		return nil, WebAuthnAttestationErr
+	}
+	ad, err := parseAuthenticatorData(obj.AuthData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.Flags&flagAttested == 0 {
+		return nil, WebAuthnAuthDataErr
+	}
+	key, alg, err := parseCOSEKey(ad.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, obj.AuthData...), clientDataHash[:]...)
+	switch obj.Fmt {
+	case "none":
+	case "packed":
+		var stmt packedAttestation
+		if err := cbor.Unmarshal(obj.AttStmt, &stmt); err != nil {
+			return nil, WebAuthnAttestationErr
+		}
+		if len(stmt.X5C) > 0 {
+			// full attestation, signed by the attestation certificate
+			cert, err := x509.ParseCertificate(stmt.X5C[0])
+			if err != nil || cert.Version != 3 || cert.IsCA {
+				return nil, WebAuthnAttestationErr
+			}
+			for _, ext := range cert.Extensions {
+				var aaguid []byte
+				if ext.Id.Equal(oidAAGUID) {
+					if _, err := asn1.Unmarshal(ext.Value, &aaguid); err != nil || !bytes.Equal(aaguid, ad.AAGUID) {
+						return nil, WebAuthnAttestationErr
+					}
+				}
+			}
+			if err := verifySignature(cert.PublicKey, stmt.Alg, signed, stmt.Sig); err != nil {
+				return nil, err
+			}
+		} else {
+			// self attestation, signed by the credential key
+			if stmt.Alg != alg {
+				return nil, WebAuthnAttestationErr
+			}
+			if err := verifySignature(key, alg, signed, stmt.Sig); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, WebAuthnAttestationErr
+	}
+
+	now := time.Now().Unix()
+	cred := &WebAuthnCredential{
+		ID:          b64url.EncodeToString(ad.CredentialID),
+		PublicKey:   ad.PublicKey,
+		Algorithm:   alg,
+		SignCount:   ad.SignCount,
+		Attestation: obj.Fmt,
+		CreatedAt:   now,
+		LastUsedAt:  now,
+	}
+
+	wLock.Lock()
+	defer wLock.Unlock()
+
+	if _, ok := Credentials[cred.ID]; ok {
+		return nil, CredentialExistErr
+	}
+	Credentials[cred.ID] = u.Username
+
+	uLock.Lock()
+	u.Credentials = append(u.Credentials, cred)
+	uLock.Unlock()
+
+	return cred, nil
+}
+
+// LoginWebAuthn verifies an assertion and returns the user it belongs to.
+func LoginWebAuthn(credentialID string, clientDataJSON, authData, signature []byte) (*User, error) {
+	s, err := takeWebAuthnSession(clientDataJSON, WebAuthnGet)
+	if err != nil {
+		return nil, err
+	}
+
+	wLock.RLock()
+	owner, ok := Credentials[credentialID]
+	wLock.RUnlock()
+	if !ok || owner != s.Username {
+		return nil, CredentialNotExistErr
+	}
+	user := GetUser(owner)
+	if user == nil {
+		return nil, UserNotExistErr
+	}
+	var cred *WebAuthnCredential
+	for _, c := range user.WebAuthnCredentials() {
+		if c.ID == credentialID {
+			cred = c
+		}
+	}
+	if cred == nil {
+		return nil, CredentialNotExistErr
+	}
+
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	key, _, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	if err := verifySignature(key, cred.Algorithm, signed, signature); err != nil {
+		return nil, err
+	}
+
+	uLock.Lock()
+	defer uLock.Unlock()
+
+	// counters are optional, both zero means unsupported
+	if (ad.SignCount != 0 || cred.SignCount != 0) && ad.SignCount <= cred.SignCount {
+		return nil, WebAuthnSignCountErr
+	}
+	cred.SignCount = ad.SignCount
+	cred.LastUsedAt = time.Now().Unix()
+
+	return user, nil
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, WebAuthnAuthDataErr
+	}
+	ad := &authenticatorData{
+		RPIDHash:  data[0:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(WebAuthnRPID))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) || ad.Flags&flagUserPresent == 0 {
+		return nil, WebAuthnAuthDataErr
+	}
+
+	if ad.Flags&flagAttested != 0 {
+		rest := data[37:]
+		if len(rest) < 18 {
+			return nil, WebAuthnAuthDataErr
+		}
+		ad.AAGUID = rest[0:16]
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < n {
+			return nil, WebAuthnAuthDataErr
+		}
+		ad.CredentialID = rest[0:n]
+
+		// public key may be followed by extensions
+		var key cbor.RawMessage
+		left, err := cbor.UnmarshalFirst(rest[n:], &key)
+		if err != nil {
+			return nil, WebAuthnAuthDataErr
+		}
+		ad.PublicKey = rest[n : len(rest)-len(left)]
+	}
+
+	return ad, nil
+}
+
+func parseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+	var k coseKey
+	if err := cbor.Unmarshal(data, &k); err != nil {
+		return nil, 0, WebAuthnAlgorithmErr
+	}
+
+	switch {
+	case k.Kty == 2 && k.Alg == AlgES256: // EC2
+		var crv int64
+		if err := cbor.Unmarshal(k.P1, &crv); err != nil || crv != 1 || len(k.P2) != 32 || len(k.P3) != 32 {
+			return nil, 0, WebAuthnAlgorithmErr
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(k.P2), Y: new(big.Int).SetBytes(k.P3)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, 0, WebAuthnAlgorithmErr
+		}
+		return key, k.Alg, nil
+	case k.Kty == 1 && k.Alg == AlgEdDSA: // OKP
+		var crv int64
+		if err := cbor.Unmarshal(k.P1, &crv); err != nil || crv != 6 || len(k.P2) != ed25519.PublicKeySize {
+			return nil, 0, WebAuthnAlgorithmErr
+		}
+		return ed25519.PublicKey(k.P2), k.Alg, nil
+	case k.Kty == 3 && k.Alg == AlgRS256: // RSA
+		var n []byte
+		if err := cbor.Unmarshal(k.P1, &n); err != nil || len(n) < 256 || len(k.P2) == 0 || len(k.P2) > 4 {
+			return nil, 0, WebAuthnAlgorithmErr
+		}
+		e := 0
+		for _, b := range k.P2 {
+			e = e<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: e}, k.Alg, nil
+	}
+
+	return nil, 0, WebAuthnAlgorithmErr
+}
+
+func verifySignature(key crypto.PublicKey, alg int64, data, sig []byte) error {
+	digest := sha256.Sum256(data)
+	ok := false
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		ok = alg == AlgES256 && ecdsa.VerifyASN1(k, digest[:], sig)
+	case ed25519.PublicKey:
+		ok = alg == AlgEdDSA && ed25519.Verify(k, data, sig)
+	case *rsa.PublicKey:
+		ok = alg == AlgRS256 && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	}
+	if !ok {
+		return WebAuthnSignatureErr
+	}
+
+	return nil
+}
+
+func deleteCredentials(u *User) {
+	wLock.Lock()
+	defer wLock.Unlock()
+
+	for _, c := range u.WebAuthnCredentials() {
+		delete(Credentials, c.ID)
+	}
+}
@@ -0,0 +1,96 @@
+// Package page renders the hosted html pages, from the embedded templates or a theme directory.
+package page
+
+import (
+	"embed"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	Layout = "layout.html" // defines the page around the "title" and "content" of each page
+
+	Authorize = "authorize.html" // oauth login
+	Consent   = "consent.html"   // oauth consent, with a browser session
+	Device    = "device.html"    // oauth device verification
+	Login     = "login.html"
+	MFA       = "mfa.html"
+	Logout    = "logout.html"
+	Account   = "account.html"
+	Forgot    = "forgot.html" // requests a password reset mail
+	Reset     = "reset.html"  // the link in the mail
+
+	ConsoleUsers = "console_users.html" // admin console, user search
+	ConsoleUser  = "console_user.html"  // admin console, roles, status and sessions of a user
+)
+
+var (
+	Pages = []string{Authorize, Consent, Device, Login, MFA, Logout, Account, Forgot, Reset, ConsoleUsers, ConsoleUser}
+
+	//go:embed templates/*.html
+	embedded embed.FS
+
+	pages map[string]*template.Template
+
+	PageNotExistErr = errors.New("page not exist")
+)
+
+func init() {
+	if err := Load(""); err != nil {
+		panic(any(err))
+	}
+}
+
+// Load parses the pages, a file in dir replaces the embedded template of the same name,
+// e.g. layout.html alone restyles all pages. Pages may define "class", of the main element.
+func Load(dir string) error {
+	read := func(name string) (string, error) {
+		if len(dir) > 0 {
+			b, err := os.ReadFile(filepath.Join(dir, name))
+			if err == nil {
+				return string(b), nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return "", err
+			}
+		}
+		b, err := embedded.ReadFile("templates/" + name)
+		return string(b), err
+	}
+
+	text, err := read(Layout)
+	if err != nil {
+		return err
+	}
+	layout, err := template.New(Layout).Parse(text)
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]*template.Template, len(Pages))
+	for _, name := range Pages {
+		if text, err = read(name); err != nil {
+			return err
+		}
+		t, err := template.Must(layout.Clone()).New(name).Parse(text)
+		if err != nil {
+			return err
+		}
+		loaded[name] = t
+	}
+	pages = loaded
+
+	return nil
+}
+
+func Render(w io.Writer, name string, data interface{}) error {
+	t, ok := pages[name]
+	if !ok {
+		return PageNotExistErr
+	}
+
+	return t.ExecuteTemplate(w, Layout, data)
+}
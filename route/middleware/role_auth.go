@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/nieben/auth-service-sample/api"
+	"github.com/nieben/auth-service-sample/model"
+	"net/http"
+)
+
+var (
+	// OpenManagement keeps user delete, role grants and role create/delete open to anyone, as before the admin
+	// role, -om. Only for deployments behind a trusted network.
+	OpenManagement bool
+
+	PermissionDeniedErr = errors.New("permission denied")
+)
+
+// RoleAuth must be used after TokenAuth, the role must be within the token's role scopes.
+func RoleAuth(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authorize(c, role) {
+			c.Next()
+		}
+	}
+}
+
+// ManagementAuth guards the endpoints granting privileges, TokenAuth and RoleAuth of the admin role
+// unless OpenManagement.
+func ManagementAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if OpenManagement || authenticate(c) && authorize(c, model.AdminRole) {
+			c.Next()
+		}
+	}
+}
+
+// authorize aborts and returns false when the role is not within the token's role scopes.
+func authorize(c *gin.Context, role string) bool {
+	token, _ := c.Get("token")
+	if t, ok := token.(*model.Token); !ok || !t.CheckRole(role) {
+		c.AbortWithStatusJSON(http.StatusForbidden, api.NewFailResponse(PermissionDeniedErr, nil))
+		return false
+	}
+
+	return true
+}
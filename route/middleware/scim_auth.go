@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/nieben/auth-service-sample/api"
+	"net/http"
+	"strings"
+)
+
+const (
+	SCIMTokenEnv       = "AUTH_SCIM_TOKEN"
+	SCIMTokenMinLength = 32
+)
+
+var (
+	SCIMToken string // bearer token of the provisioning client, scim is disabled when empty
+
+	SCIMDisabledErr = errors.New("scim disabled")
+)
+
+// SCIMAuth checks the bearer token of the provisioning client, errors are in scim format.
+func SCIMAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(SCIMToken) == 0 {
+			abortSCIM(c, http.StatusNotFound, SCIMDisabledErr)
+			return
+		}
+
+		token, ok := strings.CutPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+		if !ok || len(token) == 0 {
+			c.Header("WWW-Authenticate", `Bearer realm="scim"`)
+			abortSCIM(c, http.StatusUnauthorized, TokenRequiredErr)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(SCIMToken)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="scim", error="invalid_token"`)
+			abortSCIM(c, http.StatusUnauthorized, TokenInvalidErr)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func abortSCIM(c *gin.Context, status int, err error) {
+	c.Header("Content-Type", api.SCIMContentType)
+	c.AbortWithStatusJSON(status, api.NewSCIMError(status, "", err))
+}
@@ -2,10 +2,12 @@ package middleware
 
 import (
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/nieben/auth-service-sample/api"
 	"github.com/nieben/auth-service-sample/model"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -13,33 +15,87 @@ var (
 	TokenRequiredErr = errors.New("token required")
 	TokenInvalidErr  = errors.New("invalid token")
 	TokenExpiredErr  = errors.New("token expired")
+	ClientTokenErr   = errors.New("client token has no user")
+	CSRFTokenErr     = errors.New("csrf token missing or invalid")
 )
 
+const (
+	APIKeyScheme = "ApiKey"
+	CSRFHeader   = "X-CSRF-Token"
+)
+
+// TokenAuth takes an api key in "Authorization: ApiKey <key>", or the token in "Authorization: Bearer <token>",
+// the legacy header model.TokenHeader or the cookie model.TokenCookie, in that order.
+// Requests authenticated by the cookie, other than GET, HEAD and OPTIONS, send the csrf token in CSRFHeader.
 func TokenAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token := c.Request.Header.Get("Token")
-		if len(token) == 0 {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, api.NewFailResponse(TokenRequiredErr, nil))
-			return
+		if authenticate(c) {
+			c.Next()
 		}
-		if len(token) != model.TokenLength {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, api.NewFailResponse(TokenInvalidErr, nil))
-			return
+	}
+}
+
+// authenticate sets the user and token of the request, otherwise it aborts and returns false.
+func authenticate(c *gin.Context) bool {
+	var t *model.Token
+	var err error
+	if key, ok := strings.CutPrefix(c.Request.Header.Get("Authorization"), APIKeyScheme+" "); ok {
+		t, err = checkAPIKey(strings.TrimSpace(key))
+	} else {
+		token, cookie := requestToken(c)
+		if t, err = checkToken(token); err == nil && cookie && !safeMethod(c.Request.Method) &&
+			!t.CheckCSRFToken(c.Request.Header.Get(CSRFHeader)) {
+			c.AbortWithStatusJSON(http.StatusForbidden, api.NewFailResponse(CSRFTokenErr, nil))
+			return false
 		}
+		if err == nil {
+			t.Touch()
+		}
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, api.NewFailResponse(err, nil))
+		return false
+	}
 
-		t := model.GetToken(token)
-		if t == nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, api.NewFailResponse(TokenInvalidErr, nil))
-			return
+	c.Set("user", t.User)
+	c.Set("token", t)
+	return true
+}
+
+// Session sets the user and token of a valid browser session in the cookie model.TokenCookie, for the hosted
+// pages, which never require one and check the csrf token in their forms.
+func Session() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(model.TokenCookie) > 0 {
+			if token, err := c.Cookie(model.TokenCookie); err == nil {
+				if t, err := checkToken(token); err == nil {
+					t.Touch()
+					c.Set("user", t.User)
+					c.Set("token", t)
+				}
+			}
 		}
-		if t.ExpireAt < time.Now().Unix() {
-			t.Remove()
-			c.AbortWithStatusJSON(http.StatusUnauthorized, api.NewFailResponse(TokenExpiredErr, nil))
-			return
+		c.Next()
+	}
+}
+
+// BearerAuth takes the token from the Authorization header or the access_token form field(RFC 6750),
+// for oauth clients, errors are reported in WWW-Authenticate.
+func BearerAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if len(token) == 0 && c.Request.Method == http.MethodPost && c.ContentType() == "application/x-www-form-urlencoded" {
+			token = c.PostForm("access_token")
 		}
-		if model.GetUser(t.User.Username) == nil { // user deleted
-			t.Remove()
-			c.AbortWithStatusJSON(http.StatusUnauthorized, api.NewFailResponse(model.UserNotExistErr, nil))
+
+		t, err := checkToken(token)
+		if err != nil {
+			if err == TokenRequiredErr {
+				c.Header("WWW-Authenticate", `Bearer realm="oauth"`)
+			} else {
+				c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer realm="oauth", error="%s", error_description="%s"`, api.OAuthInvalidToken, err))
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, api.NewOAuthError(api.OAuthInvalidToken, err))
 			return
 		}
 
@@ -48,3 +104,80 @@ func TokenAuth() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+func bearerToken(c *gin.Context) string {
+	if h := c.Request.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+
+	return ""
+}
+
+// requestToken returns the token, and whether it is from the cookie.
+func requestToken(c *gin.Context) (string, bool) {
+	if token := bearerToken(c); len(token) > 0 {
+		return token, false
+	}
+	if len(model.TokenHeader) > 0 {
+		if token := c.Request.Header.Get(model.TokenHeader); len(token) > 0 {
+			return token, false
+		}
+	}
+	if len(model.TokenCookie) > 0 {
+		if token, err := c.Cookie(model.TokenCookie); err == nil {
+			return token, true
+		}
+	}
+
+	return "", false
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func checkAPIKey(key string) (*model.Token, error) {
+	k, err := model.AuthenticateAPIKey(key)
+	if err != nil {
+		return nil, err
+	}
+	user := model.GetUser(k.Username)
+	if user == nil {
+		return nil, model.UserNotExistErr
+	}
+	if user.IsDisabled() {
+		return nil, model.UserDisabledErr
+	}
+
+	return k.Token(user), nil
+}
+
+func checkToken(token string) (*model.Token, error) {
+	if len(token) == 0 {
+		return nil, TokenRequiredErr
+	}
+	if len(token) != model.TokenLength {
+		return nil, TokenInvalidErr
+	}
+
+	t := model.GetToken(token)
+	if t == nil {
+		return nil, TokenInvalidErr
+	}
+	if t.Expiry() < time.Now().Unix() {
+		t.Remove()
+		return nil, TokenExpiredErr
+	}
+	if t.User == nil { // client credentials
+		return nil, ClientTokenErr
+	}
+	if model.GetUser(t.User.Username) == nil { // user deleted
+		t.Remove()
+		return nil, model.UserNotExistErr
+	}
+	if t.User.IsDisabled() { // kept until enabled again
+		return nil, model.UserDisabledErr
+	}
+
+	return t, nil
+}
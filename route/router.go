@@ -2,7 +2,9 @@ package route
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/nieben/auth-service-sample/api"
 	"github.com/nieben/auth-service-sample/controller"
+	"github.com/nieben/auth-service-sample/model"
 	"github.com/nieben/auth-service-sample/route/middleware"
 )
 
@@ -10,6 +12,17 @@ var (
 	userController = &controller.UserController{}
 	roleController = &controller.RoleController{}
 	authController = &controller.AuthController{}
+
+	transferController = &controller.TransferController{}
+	keyController      = &controller.KeyController{}
+	scimController     = &controller.SCIMController{}
+	oauthController    = &controller.OAuthController{}
+	oidcController     = &controller.OIDCController{}
+
+	webAuthnController = &controller.WebAuthnController{}
+	apiKeyController   = &controller.APIKeyController{}
+	pageController     = &controller.PageController{}
+	consoleController  = &controller.ConsoleController{}
 )
 
 func Init() *gin.Engine {
@@ -19,22 +32,139 @@ func Init() *gin.Engine {
 	user := router.Group("/user")
 	{
 		user.POST("/create", userController.Create)
-		user.POST("/delete", userController.Delete)
-		user.POST("/addRole", userController.AddRole)
+		user.GET("/verifyEmail", userController.VerifyEmail)
+		user.POST("/resendVerification", userController.ResendVerification)
+		user.POST("/delete", middleware.ManagementAuth(), userController.Delete)
+		user.POST("/addRole", middleware.ManagementAuth(), userController.AddRole)
+		user.POST("/disable", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole), userController.Disable)
+		user.POST("/enable", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole), userController.Enable)
 		user.POST("/checkRole", middleware.TokenAuth(), userController.CheckRole)
 		user.POST("/roles", middleware.TokenAuth(), userController.Roles)
+		user.POST("/profile", middleware.TokenAuth(), userController.Profile)
+		user.POST("/updateProfile", middleware.TokenAuth(), userController.UpdateProfile)
+		user.POST("/setProfile", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole), userController.SetProfile)
+		user.POST("/mfa/enroll", middleware.TokenAuth(), userController.EnrollMFA)
+		user.POST("/mfa/verify", middleware.TokenAuth(), userController.VerifyMFA)
+		user.POST("/mfa/status", middleware.TokenAuth(), userController.MFAStatus)
+		user.POST("/mfa/recoveryCodes", middleware.TokenAuth(), userController.RecoveryCodes)
+		user.POST("/mfa/reset", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole), userController.ResetMFA)
+	}
+
+	router.GET("/users", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole), userController.List)
+
+	router.POST("/serviceAccount/create", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole), apiKeyController.CreateServiceAccount)
+
+	apiKey := router.Group("/apiKey", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole))
+	{
+		apiKey.POST("/create", apiKeyController.Create)
+		apiKey.POST("/revoke", apiKeyController.Revoke)
 	}
 
+	router.GET("/apiKeys", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole), apiKeyController.List)
+
 	role := router.Group("/role")
 	{
-		role.POST("/create", roleController.Create)
-		role.POST("/delete", roleController.Delete)
+		role.POST("/create", middleware.ManagementAuth(), roleController.Create)
+		role.POST("/delete", middleware.ManagementAuth(), roleController.Delete)
+		role.POST("/update", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole), roleController.Update)
+		role.POST("/sessionPolicy", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole), roleController.SetSessionPolicy)
+	}
+
+	roles := router.Group("/roles", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole))
+	{
+		roles.GET("", roleController.List)
+		roles.GET("/:name", roleController.Get)
+		roles.GET("/:name/members", roleController.Members)
+	}
+
+	admin := router.Group("/admin", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole))
+	{
+		admin.POST("/import", transferController.Import)
+		admin.GET("/export", transferController.Export)
+		admin.GET("/keys", keyController.List)
+		admin.POST("/keys/rotate", keyController.Rotate)
+		admin.POST("/keys/revoke", keyController.Revoke)
+	}
+
+	scim := router.Group(controller.SCIMPath, middleware.SCIMAuth())
+	{
+		scim.GET("/ServiceProviderConfig", scimController.ServiceProviderConfig)
+		scim.GET("/Users", scimController.ListUsers)
+		scim.POST("/Users", scimController.CreateUser)
+		scim.GET("/Users/:id", scimController.GetUser)
+		scim.PUT("/Users/:id", scimController.ReplaceUser)
+		scim.PATCH("/Users/:id", scimController.PatchUser)
+		scim.DELETE("/Users/:id", scimController.DeleteUser)
+		scim.GET("/Groups", scimController.ListGroups)
+		scim.POST("/Groups", scimController.CreateGroup)
+		scim.GET("/Groups/:id", scimController.GetGroup)
+		scim.PUT("/Groups/:id", scimController.ReplaceGroup)
+		scim.PATCH("/Groups/:id", scimController.PatchGroup)
+		scim.DELETE("/Groups/:id", scimController.DeleteGroup)
+	}
+
+	oauth := router.Group("/oauth")
+	{
+		oauth.GET("/authorize", middleware.Session(), oauthController.Authorize)
+		oauth.POST("/authorize", oauthController.Login)
+		oauth.POST("/consent", middleware.Session(), oauthController.Consent)
+		oauth.POST("/token", oauthController.Token)
+		oauth.POST("/device_authorization", oauthController.DeviceAuthorization)
+		oauth.GET("/device", oauthController.DevicePage)
+		oauth.POST("/device", oauthController.DeviceApprove)
+		oauth.POST("/introspect", oauthController.Introspect)
+		oauth.POST("/revoke", oauthController.Revoke)
+		oauth.POST("/client/create", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole), oauthController.CreateClient)
+		oauth.POST("/client/delete", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole), oauthController.DeleteClient)
+		oauth.POST("/client/sessionPolicy", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole), oauthController.SetSessionPolicy)
+		oauth.GET("/clients", middleware.TokenAuth(), middleware.RoleAuth(model.AdminRole), oauthController.ListClients)
 	}
 
+	router.GET(controller.OIDCConfigurationPath, oidcController.Configuration)
+	router.GET(controller.JWKSPath, oidcController.JWKS)
+	router.GET(controller.UserinfoPath, middleware.BearerAuth(), oidcController.Userinfo)
+	router.POST(controller.UserinfoPath, middleware.BearerAuth(), oidcController.Userinfo)
+
 	auth := router.Group("/auth")
 	{
 		auth.POST("/token", authController.Token)
+		auth.POST("/mfa", authController.MFA)
 		auth.POST("/logout", middleware.TokenAuth(), authController.Logout)
+		auth.POST("/introspect", middleware.TokenAuth(), authController.Introspect)
+	}
+
+	webAuthn := router.Group("/webauthn")
+	{
+		webAuthn.POST("/register/begin", middleware.TokenAuth(), webAuthnController.RegisterBegin)
+		webAuthn.POST("/register/finish", middleware.TokenAuth(), webAuthnController.RegisterFinish)
+		webAuthn.POST("/login/begin", webAuthnController.LoginBegin)
+		webAuthn.POST("/login/finish", webAuthnController.LoginFinish)
+	}
+
+	// hosted pages
+	hosted := router.Group("", middleware.Session())
+	{
+		hosted.GET("/login", pageController.LoginPage)
+		hosted.POST("/login", pageController.Login)
+		hosted.POST("/login/mfa", pageController.MFA)
+		hosted.GET("/logout", pageController.LogoutPage)
+		hosted.POST("/logout", pageController.Logout)
+		hosted.GET("/account", pageController.Account)
+		hosted.GET("/password/forgot", pageController.ForgotPage)
+		hosted.POST("/password/forgot", pageController.Forgot)
+		hosted.GET("/password/reset", pageController.ResetPage)
+		hosted.POST("/password/reset", pageController.Reset)
+	}
+
+	// admin console, hosted pages for admins
+	console := router.Group(api.ConsolePath, middleware.Session())
+	{
+		console.GET("", consoleController.Index)
+		console.GET("/users", consoleController.Users)
+		console.GET("/users/:username", consoleController.User)
+		console.POST("/users/:username/roles", consoleController.Role)
+		console.POST("/users/:username/status", consoleController.Status)
+		console.POST("/users/:username/sessions", consoleController.Sessions)
 	}
 
 	return router